@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/stapelberg/hmgo/internal/bidcos"
+	"github.com/stapelberg/hmgo/internal/inventory"
+)
+
+// loadKeys reads the AES keys from path: the current key on the first
+// line, optionally followed by the previous key, each in the form
+// index:hex (see bidcos.ParseKey).
+func loadKeys(path string) ([]bidcos.Key, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []bidcos.Key
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		k, err := bidcos.ParseKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		keys = append(keys, k)
+	}
+	if got, want := len(keys), 2; got > want {
+		return nil, fmt.Errorf("%s: too many keys: got %d, want current and previous key", path, got)
+	}
+	return keys, nil
+}
+
+// writeKeys atomically replaces the contents of path with keys, see
+// loadKeys.
+func writeKeys(path string, keys []bidcos.Key) error {
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%d:%x\n", k.Index, k.Key)
+	}
+	if err := os.WriteFile(path+".new", []byte(b.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".new", path)
+}
+
+// configureKeys makes the gateway and bcs use keys, see loadKeys.
+func configureKeys(gw gateway, bcs *bidcos.Sender, keys []bidcos.Key) error {
+	if err := gw.SetCurrentKey(keys[0]); err != nil {
+		return fmt.Errorf("setting current AES key: %v", err)
+	}
+	if len(keys) > 1 {
+		if err := gw.SetPreviousKey(keys[1]); err != nil {
+			return fmt.Errorf("setting previous AES key: %v", err)
+		}
+	}
+	bcs.SetKeys(keys...)
+	return nil
+}
+
+// rotateKey switches the gateway and all AES devices of inv from the
+// current key to next, keeping the current key as previous key so that
+// devices which could not be switched remain reachable.
+func rotateKey(gw gateway, bcs *bidcos.Sender, inv *inventory.Inventory, next bidcos.Key) error {
+	current := bcs.Keys()[0]
+	if next.Index == current.Index {
+		return fmt.Errorf("new key must use a different index than the current key (%d)", current.Index)
+	}
+	if err := gw.SetTempKey(next); err != nil {
+		return fmt.Errorf("setting temporary AES key: %v", err)
+	}
+	var failed []string
+	for _, d := range inv.Devices {
+		if !d.AES {
+			continue
+		}
+		log.Printf("switching %s (%x) to AES key %d", d.Name, d.Addr, next.Index)
+		if err := bcs.ChangeKey(context.Background(), d.Addr, current, next); err != nil {
+			log.Printf("switching %s (%x) to AES key %d: %v", d.Name, d.Addr, next.Index, err)
+			failed = append(failed, d.Name)
+		}
+	}
+	if err := configureKeys(gw, bcs, []bidcos.Key{next, current}); err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("devices still using the previous key: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// handleRotateKey implements key rotation via HTTP, e.g.:
+//
+//	curl -d key=4:… http://localhost:8012/aes/rotate
+func handleRotateKey(w http.ResponseWriter, r *http.Request, gw gateway, bcs *bidcos.Sender, inv *inventory.Inventory) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if *aesKeyFile == "" {
+		http.Error(w, "-aes_key_file not set, refusing to rotate a key which would be lost on restart", http.StatusPreconditionFailed)
+		return
+	}
+	next, err := bidcos.ParseKey(r.FormValue("key"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rotateErr := rotateKey(gw, bcs, inv, next)
+	// Persist the keys even if some devices could not be switched: the
+	// UARTGW already uses the new key.
+	if err := writeKeys(*aesKeyFile, bcs.Keys()); err != nil {
+		log.Printf("writing AES keys: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if rotateErr != nil {
+		log.Printf("rotating AES key: %v", rotateErr)
+		http.Error(w, rotateErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "OK")
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/stapelberg/hmgo/internal/pcapng"
+	"github.com/stapelberg/hmgo/internal/uartgw"
+)
+
+// capture writes all frames of a UARTGW to a pcapng file, which can be
+// opened in Wireshark with contrib/wireshark/homematic.lua.
+type capture struct {
+	gw *uartgw.UARTGW
+
+	mu     sync.Mutex
+	f      *os.File // nil when not capturing
+	cancel func()
+}
+
+// start starts capturing to path. Capturing to an existing file appends
+// a new pcapng section.
+func (c *capture) start(path string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f != nil {
+		return fmt.Errorf("already capturing to %s", c.f.Name())
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	pw, err := pcapng.NewWriter(f, pcapng.LinkTypeUser15)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	c.f = f
+	c.cancel = c.gw.Observe(func(fr uartgw.Frame) {
+		dir := pcapng.Inbound
+		if fr.Direction == uartgw.Sent {
+			dir = pcapng.Outbound
+		}
+		if err := pw.WritePacket(fr.Time, dir, fr.Bytes()); err != nil {
+			log.Printf("capturing to %s: %v", path, err)
+		}
+	})
+	log.Printf("capturing UARTGW frames to %s", path)
+	return nil
+}
+
+// stop stops capturing.
+func (c *capture) stop() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f == nil {
+		return fmt.Errorf("not capturing")
+	}
+	c.cancel()
+	err := c.f.Close()
+	log.Printf("stopped capturing UARTGW frames to %s", c.f.Name())
+	c.f = nil
+	return err
+}
+
+// handleCapture starts or stops capturing via HTTP, e.g.:
+//
+//	curl -d file=/tmp/hmgo.pcapng http://localhost:8012/capture/start
+//	curl -d '' http://localhost:8012/capture/stop
+//
+// The file defaults to -pcap_file.
+func handleCapture(w http.ResponseWriter, r *http.Request, c *capture) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if c == nil {
+		http.Error(w, "capturing is only supported with -gateway=uartgw or -gateway=lgw", http.StatusNotFound)
+		return
+	}
+	var err error
+	switch r.URL.Path {
+	case "/capture/start":
+		path := r.FormValue("file")
+		if path == "" {
+			path = *pcapFile
+		}
+		if path == "" {
+			http.Error(w, "neither file nor -pcap_file specified", http.StatusBadRequest)
+			return
+		}
+		err = c.start(path)
+	case "/capture/stop":
+		err = c.stop()
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "OK")
+}
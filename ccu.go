@@ -1,15 +1,15 @@
 package main
 
 import (
-	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"maps"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"sync"
-	"syscall"
 	"time"
 
 	"golang.org/x/sys/unix"
@@ -23,6 +23,7 @@ import (
 	"github.com/stapelberg/hmgo/internal/hm/heating"
 	"github.com/stapelberg/hmgo/internal/hm/power"
 	"github.com/stapelberg/hmgo/internal/hm/thermal"
+	"github.com/stapelberg/hmgo/internal/inventory"
 	"github.com/stapelberg/hmgo/internal/serial"
 	"github.com/stapelberg/hmgo/internal/uartgw"
 )
@@ -37,6 +38,23 @@ var (
 		},
 		[]string{"address", "name", "hmtype"})
 
+	rssi = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "hm",
+			Name:      "rssi_dbm",
+			Help:      "received signal strength of the most recent packet of a device in dBm",
+		},
+		[]string{"address", "name", "hmtype"})
+
+	rssiDistribution = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "hm",
+			Name:      "packet_rssi_dbm",
+			Help:      "received signal strength of packets in dBm",
+			Buckets:   prometheus.LinearBuckets(-110, 10, 8),
+		},
+		[]string{"address", "name", "hmtype"})
+
 	packetsDecoded = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: "hm",
@@ -48,14 +66,54 @@ var (
 
 func init() {
 	prometheus.MustRegister(lastContact)
+	prometheus.MustRegister(rssi)
+	prometheus.MustRegister(rssiDistribution)
 	prometheus.MustRegister(packetsDecoded)
 }
 
+// devicesMu guards the device maps and inventory devices of main,
+// which the main loop modifies when pairing new devices (see
+// pairingWindow), against concurrent reads by HTTP handlers and the
+// reconciler.
+var devicesMu sync.Mutex
+
 // flags
 var (
+	gatewayType = flag.String("gateway",
+		"uartgw",
+		"radio gateway to use: uartgw (HM-MOD-RPI-PCB on -serial_port), cul (CUL stick running culfw on -serial_port), lgw (HM-LGW-O-TW-W-FS at -gateway_address) hmlan (HM-CFG-LAN at -gateway_address) or simulator (simulates the inventory devices, see internal/simulator)")
+
+	gatewayAddress = flag.String("gateway_address",
+		"",
+		"host (lgw) or host[:port] (hmlan) of the LAN gateway")
+
 	serialPort = flag.String("serial_port",
 		"/dev/serial0",
-		"path to a serial port to communicate with the HM-MOD-RPI-PCB")
+		"path to a serial port to communicate with the HM-MOD-RPI-PCB or CUL (e.g. /dev/ttyACM0)")
+
+	watchdogTimeout = flag.Duration("uartgw_watchdog",
+		10*time.Minute,
+		"reset and re-initialize the HM-MOD-RPI-PCB when no frame was received for this long; 0 disables the watchdog")
+
+	maxFrameErrors = flag.Int("uartgw_max_frame_errors",
+		uartgw.DefaultMaxFrameErrors,
+		"number of consecutive invalid frames (e.g. checksum mismatches) after which hmgo gives up reading from the HM-MOD-RPI-PCB")
+
+	simulatorInterval = flag.Duration("simulator_interval",
+		2*time.Minute,
+		"how often simulated devices send their events (-gateway=simulator only)")
+
+	uartgwRecord = flag.String("uartgw_record",
+		"",
+		"path to a file to which all bytes exchanged with the UARTGW are written, for replaying in tests (see internal/recording); uartgw and lgw only")
+
+	shareListen = flag.String("share_listen",
+		"",
+		"TCP host:port or path of a Unix socket on which to share the UARTGW frames with other programs, see internal/share; empty disables sharing (uartgw and lgw only)")
+
+	pcapFile = flag.String("pcap_file",
+		"",
+		"path to a pcapng file to which all UARTGW frames are appended, for contrib/wireshark/homematic.lua; also the default for /capture/start. Empty disables capturing at startup (uartgw and lgw only)")
 
 	listenAddress = flag.String("listen",
 		":8013",
@@ -64,329 +122,250 @@ var (
 	mqttBroker = flag.String("mqtt_broker",
 		"tcp://mqtt.lan:1883",
 		"MQTT broker URL; empty string disables MQTT publishing")
+
+	inventoryPath = flag.String("inventory",
+		"/perm/hmgo/inventory.json",
+		"path to the JSON file listing the HomeMatic devices to talk to, see contrib/inventory/inventory.json for an example")
+
+	aesKeyFile = flag.String("aes_key_file",
+		"",
+		"path to a file containing the installation’s AES key as index:hex (e.g. 2:00112233445566778899aabbccddeeff), optionally followed by the previous key on the second line; empty means the default key. Rotating the key via /aes/rotate rewrites the file")
+
+	powerSwitchName = flag.String("power_switch",
+		"avr",
+		"name of the power switch controlled via /power/on and /power/off")
+
+	reconcileInterval = flag.Duration("reconcile_interval",
+		6*time.Hour,
+		"how often to compare the config memory and peers of devices with the inventory and correct any drift. Unreachable devices are retried when they next send a packet")
 )
 
-func overrideWinter(program []thermal.Program) []thermal.Program {
-	month := time.Now().Month()
-	if month == time.May ||
-		month == time.June ||
-		month == time.July ||
-		month == time.August {
-		return program // no change during summer
+// newDevice constructs the hm.Device implementation for the inventory
+// device d.
+func newDevice(bcs *bidcos.Sender, d *inventory.Device) hm.Device {
+	// for convenience
+	device := func() hm.StandardDevice {
+		return hm.NewStandardDevice(bcs, d.Addr, d.Name)
 	}
-	log.Printf("initial program: %+v", program)
-	for i, prog := range program {
-		for ii, entry := range prog.Endtimes {
-			if entry.Endtime > uint64((6 * time.Hour).Minutes()) {
-				prog.Endtimes[ii].Temperature = 24.0 // cannot be reached, i.e. heat permanently
-			}
-		}
-		program[i] = prog
+	switch d.Type {
+	case inventory.Thermal:
+		return thermal.NewThermalControl(device())
+	case inventory.Heating:
+		return heating.NewThermostat(device())
+	case inventory.Power:
+		return power.NewPowerSwitch(device())
 	}
-	log.Printf("modified program: %+v", program)
-	return program
+	// inventory.Parse rejects unknown types
+	panic(fmt.Sprintf("BUG: unknown device type %q", d.Type))
 }
 
-func main() {
-	flag.Parse()
+// addPeer adds the inventory device d to the gateway’s peer table.
+func addPeer(gw gateway, d *inventory.Device, dev hm.Device) error {
+	if d.AES {
+		return gw.AddPeerAES(d.Addr[:], dev.Channels())
+	}
+	return gw.AddPeer(d.Addr[:], dev.Channels())
+}
 
-	gokrazy.WaitForClock()
+// modelName returns the name of the model with the specified ID, for
+// log messages.
+func modelName(id uint16) string {
+	if m := hm.ModelByID(id); m != nil {
+		return m.Name
+	}
+	return "unknown model"
+}
 
-	// TODO(later): drop privileges (only need network + serial port)
+// unreachable returns whether err indicates that a device did not
+// reply, in which case we carry on with the other devices.
+func unreachable(err error) bool {
+	var nre *bidcos.NoReplyError
+	return errors.As(err, &nre)
+}
 
+// openUARTGW opens and configures the serial port of the
+// HM-MOD-RPI-PCB, then resets it. withFd calls f with the file
+// descriptor of the serial port.
+func openUARTGW() (uart *os.File, withFd func(f func(fd uintptr) error) error, _ error) {
 	log.Printf("opening serial port %s", *serialPort)
 
+	// The serial port stays in non-blocking mode so that the Go
+	// runtime can poll it, which is required for read deadlines (see
+	// uartgw.UARTGW.Watchdog). Calling uart.Fd() would switch it to
+	// blocking mode, hence we use the raw connection instead.
 	uart, err := os.OpenFile(*serialPort, os.O_EXCL|os.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK, 0600)
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, err
 	}
-	if err := serial.Configure(uintptr(uart.Fd())); err != nil {
-		log.Fatal(err)
+	rc, err := uart.SyscallConn()
+	if err != nil {
+		return nil, nil, err
+	}
+	withFd = func(f func(fd uintptr) error) error {
+		var err error
+		if cerr := rc.Control(func(fd uintptr) { err = f(fd) }); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+	if err := withFd(serial.Configure); err != nil {
+		return nil, nil, err
 	}
 
 	log.Printf("resetting HM-MOD-RPI-PCB via GPIO")
 
 	// Reset the HM-MOD-RPI-PCB to ensure we are starting in a
 	// known-good state.
-	if err := gpio.ResetUARTGW(uintptr(uart.Fd())); err != nil {
-		log.Fatal(err)
+	if err := withFd(gpio.ResetUARTGW); err != nil {
+		return nil, nil, err
 	}
 
-	// Re-enable blocking syscalls, which are required by the Go
-	// standard library.
-	if err := syscall.SetNonblock(int(uart.Fd()), false); err != nil {
-		log.Fatal(err)
+	return uart, withFd, nil
+}
+
+// configureGateway brings the gateway into the configured state:
+// stale peers are removed and all devices of inv are added as peers.
+// The devices themselves are configured by the reconciler.
+func configureGateway(gw gateway, inv *inventory.Inventory, byAddr map[[3]byte]hm.Device) error {
+	// Remove peers which are no longer configured, e.g. left over from
+	// replaced hardware.
+	if pl, ok := gw.(peerLister); ok {
+		peers, err := pl.Peers()
+		if err != nil {
+			log.Printf("listing gateway peers, not removing stale peers: %v", err)
+		}
+		for _, addr := range peers {
+			if _, ok := byAddr[addr]; ok {
+				continue
+			}
+			log.Printf("removing stale peer %x", addr[:])
+			if err := gw.RemovePeer(addr); err != nil {
+				return err
+			}
+		}
 	}
 
-	hmid := [3]byte{0xfd, 0xb0, 0x2c}
-	gw, err := uartgw.NewUARTGW(uart, hmid, time.Now())
-	if err != nil {
-		log.Fatal(err)
+	for _, d := range inv.Devices {
+		log.Printf("adding peer %x", d.Addr[:])
+		if err := addPeer(gw, d, byAddr[d.Addr]); err != nil {
+			return err
+		}
 	}
 
-	log.Printf("initialized UARTGW %s (firmware %s)", gw.SerialNumber, gw.FirmwareVersion)
+	return nil
+}
 
-	// TODO(later): implement support for the UARTGW acknowledging commands as “pending”.
+func main() {
+	flag.Parse()
 
-	// TODO(later): add deadline for reading a frame
+	if flag.Arg(0) == "update_firmware" {
+		if err := updateFirmware(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	bcs, err := bidcos.NewSender(gw, hmid)
+	// Load the inventory before touching the UARTGW so that
+	// configuration errors are reported right away.
+	inv, err := inventory.Load(*inventoryPath)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// map from src addr to device
-	byAddr := make(map[[3]byte]hm.Device)
-	bySerial := make(map[string]hm.Device)
-
-	// for convenience
-	device := func(addr [3]byte, name string) hm.StandardDevice {
-		return hm.StandardDevice{
-			BCS:       bcs,
-			Addr:      addr,
-			HumanName: name,
-		}
-	}
-
-	avr := power.NewPowerSwitch(device([3]byte{0x40, 0xc2, 0xa8}, "avr"))
-
-	thermalBad := thermal.NewThermalControl(device([3]byte{0x39, 0x0f, 0x17}, "Bad"))
-	thermalWohnzimmer := thermal.NewThermalControl(device([3]byte{0x39, 0x06, 0xeb}, "Wohnzimmer"))
-	thermalSchlafzimmer := thermal.NewThermalControl(device([3]byte{0x39, 0x06, 0xda}, "Schlafzimmer"))
-	thermalLea := thermal.NewThermalControl(device([3]byte{0x39, 0x0f, 0x27}, "Lea"))
-
-	thermostatBad := heating.NewThermostat(device([3]byte{0x73, 0xf7, 0xee}, "Bad"))
-	thermostatWohnzimmer := heating.NewThermostat(device([3]byte{0x38, 0xf5, 0x9c}, "Wohnzimmer"))
-	thermostatSchlafzimmer := heating.NewThermostat(device([3]byte{0x38, 0xe8, 0xe3}, "Schlafzimmer"))
-	thermostatLea := heating.NewThermostat(device([3]byte{0x38, 0xe8, 0xef}, "Lea"))
-
-	bySerial["MEQ0090662"] = thermalBad
-	bySerial["MEQ0089016"] = thermalWohnzimmer
-	bySerial["MEQ0088999"] = thermalSchlafzimmer
-	bySerial["MEQ0090675"] = thermalLea
-
-	bySerial["MEQ0059922"] = thermostatWohnzimmer
-	bySerial["REQ1905196"] = thermostatBad
-	bySerial["MEQ0059220"] = thermostatSchlafzimmer
-	bySerial["MEQ0059216"] = thermostatLea
-
-	bySerial["MEQ1341845"] = avr
-
-	byAddr[thermalBad.Addr] = thermalBad
-	byAddr[thermalWohnzimmer.Addr] = thermalWohnzimmer
-	byAddr[thermalSchlafzimmer.Addr] = thermalSchlafzimmer
-	byAddr[thermalLea.Addr] = thermalLea
-
-	byAddr[thermostatWohnzimmer.Addr] = thermostatWohnzimmer
-	byAddr[thermostatBad.Addr] = thermostatBad
-	byAddr[thermostatSchlafzimmer.Addr] = thermostatSchlafzimmer
-	byAddr[thermostatLea.Addr] = thermostatLea
+	gokrazy.WaitForClock()
 
-	byAddr[avr.Addr] = avr
+	// TODO(later): drop privileges (only need network + serial port)
 
-	// Explicitly reset the prometheus metric for last contact so that
-	// all devices have an entry.
-	for _, dev := range byAddr {
-		lastContact.With(prometheus.Labels{"name": dev.Name(), "address": dev.AddrHex(), "hmtype": dev.HomeMaticType()}).Set(0)
+	hmid := [3]byte{0xfd, 0xb0, 0x2c}
+	gw, err := openGateway(hmid, inv)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	for addr, dev := range byAddr {
-		log.Printf("adding peer %x", addr[:])
-		if err := gw.AddPeer(addr[:], dev.Channels()); err != nil {
+	if *shareListen != "" {
+		if err := shareGateway(gw, *shareListen); err != nil {
 			log.Fatal(err)
 		}
 	}
 
-	log.Printf("reading program configuration of %v", thermalWohnzimmer)
-	if err := thermalWohnzimmer.EnsureConfigured(0 /* channel */, 7 /* plist */, func(mem []byte) error {
-		thermalWohnzimmer.SetPrograms(mem, overrideWinter([]thermal.Program{
-			{
-				DayMask: thermal.WeekdayMask,
-				Endtimes: [13]thermal.ProgramEntry{
-					{ /* 00:00- */ uint64((6 * time.Hour).Minutes()), 17.0},
-					{ /* 06:00- */ uint64((10 * time.Hour).Minutes()), 22.0},
-					{ /* 10:00- */ uint64((17 * time.Hour).Minutes()), 17.0},
-					{ /* 17:00- */ uint64((23 * time.Hour).Minutes()), 22.0},
-				},
-			},
-			{
-				DayMask: thermal.WeekendMask,
-				Endtimes: [13]thermal.ProgramEntry{
-					{ /* 00:00- */ uint64((6 * time.Hour).Minutes()), 17.0},
-					{ /* 06:00- */ uint64((23 * time.Hour).Minutes()), 22.0},
-				},
-			},
-		}))
-		return nil
-	}); err != nil {
-		log.Fatal(err)
-	}
-
-	log.Printf("reading program configuration of %v", thermalBad)
-	if err := thermalBad.EnsureConfigured(0 /* channel */, 7 /* plist */, func(mem []byte) error {
-
-		const valveOffsetOffset = 11
-		const valveMaxOffset = 12
-		log.Printf("valve offset: %d", mem[valveOffsetOffset])
-		mem[valveOffsetOffset] = 100 & hm.Mask7Bit
-		log.Printf("valve max: %d", mem[valveMaxOffset])
-
-		thermalBad.SetPrograms(mem, overrideWinter([]thermal.Program{
-			{
-				DayMask: thermal.WeekdayMask,
-				Endtimes: [13]thermal.ProgramEntry{
-					{ /* 00:00- */ uint64((6 * time.Hour).Minutes()), 17.0},
-					{ /* 06:00- */ uint64((10 * time.Hour).Minutes()), 22.0},
-					{ /* 10:00- */ uint64((17 * time.Hour).Minutes()), 17.0},
-					{ /* 17:00- */ uint64((23 * time.Hour).Minutes()), 22.0},
-				},
-			},
-			{
-				DayMask: thermal.WeekendMask,
-				Endtimes: [13]thermal.ProgramEntry{
-					{ /* 00:00- */ uint64((6 * time.Hour).Minutes()), 17.0},
-					{ /* 06:00- */ uint64((23 * time.Hour).Minutes()), 22.0},
-				},
-			},
-		}))
-		return nil
-	}); err != nil {
-		log.Fatal(err)
+	var capt *capture
+	if u, ok := gw.(*uartgw.UARTGW); ok {
+		capt = &capture{gw: u}
 	}
-
-	log.Printf("reading program configuration of %v", thermalSchlafzimmer)
-	if err := thermalSchlafzimmer.EnsureConfigured(0 /* channel */, 7 /* plist */, func(mem []byte) error {
-		thermalSchlafzimmer.SetPrograms(mem, overrideWinter([]thermal.Program{
-			{
-				DayMask: thermal.WeekdayMask,
-				Endtimes: [13]thermal.ProgramEntry{
-					{ /* 00:00- */ uint64((6 * time.Hour).Minutes()), 17.0},
-					{ /* 06:00- */ uint64((10 * time.Hour).Minutes()), 22.0},
-					{ /* 10:00- */ uint64((17 * time.Hour).Minutes()), 17.0},
-					{ /* 17:00- */ uint64((23 * time.Hour).Minutes()), 22.0},
-				},
-			},
-			{
-				DayMask: thermal.WeekendMask,
-				Endtimes: [13]thermal.ProgramEntry{
-					{ /* 00:00- */ uint64((6 * time.Hour).Minutes()), 17.0},
-					{ /* 06:00- */ uint64((23 * time.Hour).Minutes()), 22.0},
-				},
-			},
-		}))
-		return nil
-	}); err != nil {
-		log.Fatal(err)
+	if *pcapFile != "" {
+		if capt == nil {
+			log.Fatal("-pcap_file is only supported with -gateway=uartgw or -gateway=lgw")
+		}
+		if err := capt.start(*pcapFile); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	log.Printf("reading program configuration of %v", thermalLea)
-	if err := thermalLea.EnsureConfigured(0 /* channel */, 7 /* plist */, func(mem []byte) error {
-		thermalLea.SetPrograms(mem, []thermal.Program{
-			{
-				DayMask: thermal.WeekdayMask,
-				Endtimes: [13]thermal.ProgramEntry{
-					{ /* 00:00- */ uint64((6 * time.Hour).Minutes()), 24.0},
-					{ /* 06:00- */ uint64((10 * time.Hour).Minutes()), 24.0},
-					{ /* 10:00- */ uint64((17 * time.Hour).Minutes()), 24.0},
-					{ /* 17:00- */ uint64((23 * time.Hour).Minutes()), 24.0},
-				},
-			},
-			{
-				DayMask: thermal.WeekendMask,
-				Endtimes: [13]thermal.ProgramEntry{
-					{ /* 00:00- */ uint64((6 * time.Hour).Minutes()), 24.0},
-					{ /* 06:00- */ uint64((23 * time.Hour).Minutes()), 24.0},
-				},
-			},
-		})
-		return nil
-	}); err != nil {
+	bcs, err := bidcos.NewSender(gw, hmid)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	log.Printf("ensuring %v is peered with %v", thermalWohnzimmer, thermostatWohnzimmer)
-	if err := thermalWohnzimmer.EnsurePeeredWith(
-		thermal.ThermalControlTransmit,
-		hm.FullyQualifiedChannel{
-			Peer:    thermostatWohnzimmer.Addr,
-			Channel: heating.ClimateControlReceiver,
-		}); err != nil {
-		log.Fatal(err)
+	// The HM-CFG-LAN only verifies AES peers once a key is set.
+	keys := []bidcos.Key{bidcos.DefaultKey}
+	if *aesKeyFile != "" {
+		keys, err = loadKeys(*aesKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
-	log.Printf("ensuring %v is peered with %v", thermostatWohnzimmer, thermalWohnzimmer)
-	if err := thermostatWohnzimmer.EnsurePeeredWith(
-		heating.ClimateControlReceiver,
-		hm.FullyQualifiedChannel{
-			Peer:    thermalWohnzimmer.Addr,
-			Channel: thermal.ThermalControlTransmit,
-		}); err != nil {
+	if err := configureKeys(gw, bcs, keys); err != nil {
 		log.Fatal(err)
 	}
 
-	log.Printf("ensuring %v is peered with %v", thermalBad, thermostatBad)
-	if err := thermalBad.EnsurePeeredWith(
-		thermal.ThermalControlTransmit,
-		hm.FullyQualifiedChannel{
-			Peer:    thermostatBad.Addr,
-			Channel: heating.ClimateControlReceiver,
-		}); err != nil {
-		log.Fatal(err)
-	}
-	log.Printf("ensuring %v is peered with %v", thermostatBad, thermalBad)
-	if err := thermostatBad.EnsurePeeredWith(
-		heating.ClimateControlReceiver,
-		hm.FullyQualifiedChannel{
-			Peer:    thermalBad.Addr,
-			Channel: thermal.ThermalControlTransmit,
-		}); err != nil {
-		log.Fatal(err)
+	// Subscribe right away so that device events which are received
+	// while configuring devices are not lost.
+	events := bcs.Subscribe()
+
+	// map from src addr to device
+	byAddr := make(map[[3]byte]hm.Device)
+	bySerial := make(map[string]hm.Device)
+	// aesDevices contains the addresses of devices whose packets must
+	// be signed.
+	aesDevices := make(map[[3]byte]bool)
+
+	for _, d := range inv.Devices {
+		dev := newDevice(bcs, d)
+		byAddr[d.Addr] = dev
+		bySerial[d.Serial] = dev
+		aesDevices[d.Addr] = d.AES
 	}
 
-	log.Printf("ensuring %v is peered with %v", thermalSchlafzimmer, thermostatSchlafzimmer)
-	if err := thermalSchlafzimmer.EnsurePeeredWith(
-		thermal.ThermalControlTransmit,
-		hm.FullyQualifiedChannel{
-			Peer:    thermostatSchlafzimmer.Addr,
-			Channel: heating.ClimateControlReceiver,
-		}); err != nil {
-		log.Fatal(err)
+	// Explicitly reset the prometheus metric for last contact so that
+	// all devices have an entry.
+	for _, dev := range byAddr {
+		lastContact.With(prometheus.Labels{"name": dev.Name(), "address": dev.AddrHex(), "hmtype": dev.HomeMaticType()}).Set(0)
 	}
-	log.Printf("ensuring %v is peered with %v", thermostatSchlafzimmer, thermalSchlafzimmer)
-	if err := thermostatSchlafzimmer.EnsurePeeredWith(
-		heating.ClimateControlReceiver,
-		hm.FullyQualifiedChannel{
-			Peer:    thermalSchlafzimmer.Addr,
-			Channel: thermal.ThermalControlTransmit,
-		}); err != nil {
+
+	if err := configureGateway(gw, inv, byAddr); err != nil {
 		log.Fatal(err)
 	}
 
-	log.Printf("ensuring %v is peered with %v", thermalLea, thermostatLea)
-	if err := thermalLea.EnsurePeeredWith(
-		thermal.ThermalControlTransmit,
-		hm.FullyQualifiedChannel{
-			Peer:    thermostatLea.Addr,
-			Channel: heating.ClimateControlReceiver,
-		}); err != nil {
-		log.Fatal(err)
+	rec := newReconciler(inv, bySerial, *reconcileInterval)
+	go rec.run()
+
+	var avr *power.PowerSwitch
+	for _, dev := range bySerial {
+		if ps, ok := dev.(*power.PowerSwitch); ok && ps.Name() == *powerSwitchName {
+			avr = ps
+		}
 	}
-	log.Printf("ensuring %v is peered with %v", thermostatLea, thermalLea)
-	if err := thermostatLea.EnsurePeeredWith(
-		heating.ClimateControlReceiver,
-		hm.FullyQualifiedChannel{
-			Peer:    thermalLea.Addr,
-			Channel: thermal.ThermalControlTransmit,
-		}); err != nil {
-		log.Fatal(err)
+	if avr == nil {
+		log.Printf("power switch %q not found in inventory, /power/on and /power/off disabled", *powerSwitchName)
 	}
 
-	var readMu sync.Mutex
-
 	// Expose power on/off control on localhost
 	localMux := http.NewServeMux()
 	localMux.HandleFunc("/power/off", func(w http.ResponseWriter, r *http.Request) {
-		readMu.Lock()
-		defer readMu.Unlock()
+		if avr == nil {
+			http.Error(w, "power switch not configured", http.StatusNotFound)
+			return
+		}
 		if err := avr.LevelSet(power.ChannelSwitch, power.Off, 0x00); err != nil {
 			log.Printf("avr.LevelSet(power.Off): %v", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -395,8 +374,10 @@ func main() {
 		fmt.Fprintf(w, "OK")
 	})
 	localMux.HandleFunc("/power/on", func(w http.ResponseWriter, r *http.Request) {
-		readMu.Lock()
-		defer readMu.Unlock()
+		if avr == nil {
+			http.Error(w, "power switch not configured", http.StatusNotFound)
+			return
+		}
 		if err := avr.LevelSet(power.ChannelSwitch, power.On, 0x00); err != nil {
 			log.Printf("avr.LevelSet(power.On): %v", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -404,49 +385,108 @@ func main() {
 		}
 		fmt.Fprintf(w, "OK")
 	})
+	localMux.HandleFunc("/aes/rotate", func(w http.ResponseWriter, r *http.Request) {
+		devicesMu.Lock()
+		snapshot := *inv
+		devicesMu.Unlock()
+		handleRotateKey(w, r, gw, bcs, &snapshot)
+	})
+	localMux.HandleFunc("/capture/", func(w http.ResponseWriter, r *http.Request) {
+		handleCapture(w, r, capt)
+	})
+	pairing := &pairingWindow{}
+	localMux.HandleFunc("/pairing/", func(w http.ResponseWriter, r *http.Request) {
+		handlePairing(w, r, pairing)
+	})
+	localMux.HandleFunc("/unpair", func(w http.ResponseWriter, r *http.Request) {
+		handleUnpair(w, r, gw, func(serial string) (*inventory.Device, hm.Device) {
+			devicesMu.Lock()
+			defer devicesMu.Unlock()
+			return inv.BySerial(serial), bySerial[serial]
+		}, rec.ignore)
+	})
 	go http.ListenAndServe("localhost:8012", localMux)
 
 	log.Printf("entering BidCoS packet handling main loop")
 
 	mqttCh := MQTT()
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { handleStatus(w, r, bySerial) })
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		devicesMu.Lock()
+		devs := maps.Clone(bySerial)
+		devicesMu.Unlock()
+		handleStatus(w, r, devs, rec.States())
+	})
 	http.Handle("/metrics", promhttp.Handler())
 	go http.ListenAndServe(*listenAddress, nil)
 
 	t := time.Tick(1 * time.Hour)
 	for {
+		var (
+			bpkt *bidcos.Packet
+			ok   bool
+		)
 		select {
 		case <-t:
 			if err := gw.SetTime(time.Now()); err != nil {
-				log.Fatalf("setting time: %v", err)
+				if !errors.Is(err, bidcos.ErrGatewayReset) {
+					log.Fatalf("setting time: %v", err)
+				}
+				// Re-initializing the gateway sets its time, too.
+				log.Printf("setting time: %v", err)
 			}
-		default:
-		}
+			continue
 
-		readMu.Lock()
-		pkt, err := gw.ReadPacket()
-		readMu.Unlock()
-		if err != nil {
-			log.Fatal(err)
-		}
-		if got, want := pkt.Cmd, uartgw.AppRecv; got != want {
-			log.Fatalf("unexpected uartgw command in packet %+v: got %v, want %v", pkt, got, want)
+		case bpkt, ok = <-events:
+			if !ok {
+				log.Fatal(bcs.Err())
+			}
 		}
 
-		bpkt, err := bidcos.Decode(pkt.Payload)
-		if err != nil {
-			log.Printf("skipping invalid bidcos packet: %v", err)
+		dev, ok := byAddr[bpkt.Source]
+		if !ok && bpkt.Cmd == bidcos.DeviceInfo && pairing.isOpen(time.Now()) {
+			info, err := bidcos.DecodeDeviceInfo(bpkt.Payload)
+			if err != nil {
+				log.Printf("decoding DeviceInfo of [BidCoS:%x]: %v", bpkt.Source, err)
+				continue
+			}
+			if _, ok := bySerial[info.Serial]; ok {
+				log.Printf("device with serial %q uses unconfigured BidCoS address %x, not pairing", info.Serial, bpkt.Source)
+				continue
+			}
+			log.Printf("pairing new device (fw %s, model %s (%d), serial %s, address %x)", info.FirmwareVersion(), modelName(info.Model), info.Model, info.Serial, bpkt.Source)
+			d, dev, err := pairNew(gw, bcs, *inventoryPath, bpkt.Source, info)
+			if err != nil {
+				log.Printf("pairing new device %s: %v", info.Serial, err)
+				continue
+			}
+			devicesMu.Lock()
+			inv.Devices = append(inv.Devices, d)
+			byAddr[d.Addr] = dev
+			bySerial[d.Serial] = dev
+			devicesMu.Unlock()
+			log.Printf("paired %v, added to %s as %q", dev, *inventoryPath, d.Name)
 			continue
 		}
-
-		dev, ok := byAddr[bpkt.Source]
 		if !ok {
 			log.Printf("ignoring packet from unknown device [BidCoS:%x]", bpkt.Source)
 			continue
 		}
+		rec.wakeup(bpkt.Source)
 
-		lastContact.With(prometheus.Labels{"name": dev.Name(), "address": dev.AddrHex(), "hmtype": dev.HomeMaticType()}).Set(float64(time.Now().Unix()))
+		labels := prometheus.Labels{"name": dev.Name(), "address": dev.AddrHex(), "hmtype": dev.HomeMaticType()}
+		lastContact.With(labels).Set(float64(time.Now().Unix()))
+		if bpkt.RSSI != 0 {
+			rssi.With(labels).Set(float64(bpkt.RSSI))
+			rssiDistribution.With(labels).Observe(float64(bpkt.RSSI))
+		}
+		if bpkt.WrongKey() {
+			log.Printf("packet from %v signed using a different AES key", dev)
+		}
+		if aesDevices[bpkt.Source] && !bpkt.AES() && bpkt.Cmd != bidcos.DeviceInfo {
+			log.Printf("ignoring unsigned packet from AES device %v", dev)
+			continue
+		}
 
 		switch bpkt.Cmd {
 		default:
@@ -536,20 +576,18 @@ func main() {
 
 		case bidcos.DeviceInfo:
 			// c.f. https://github.com/Homegear/Homegear-HomeMaticBidCoS/blob/5255288954f3da42e12fa72a06963b99089d323f/src/HomeMaticCentral.cpp#L2997
-			// TODO: add PeeringRequest type and decode method
 			log.Printf("configuring new peer")
-			if got, want := len(bpkt.Payload), 13; got < want {
-				log.Printf("unexpectedly short payload: got %d, want >= %d", got, want)
+			info, err := bidcos.DecodeDeviceInfo(bpkt.Payload)
+			if err != nil {
+				log.Print(err)
 				continue
 			}
-			firmware := bpkt.Payload[0]
-			typ := binary.BigEndian.Uint16(bpkt.Payload[1 : 1+2])
-			serial := string(bpkt.Payload[3 : 3+10])
-			// e.g. peer request (fw 18, typ 173, serial MEQ0089016)
-			log.Printf("peer request (fw %x, typ %d, serial %s)", firmware, typ, serial)
+			serial := info.Serial
+			// e.g. peer request (fw 1.2, model HM-TC-IT-WM-W-EU (173), serial MEQ0089016)
+			log.Printf("peer request (fw %s, model %s (%d), serial %s)", info.FirmwareVersion(), modelName(info.Model), info.Model, serial)
 			dev, ok := bySerial[serial]
 			if !ok {
-				log.Printf("serial %q not configured, not replying to peering request", serial)
+				log.Printf("serial %q not configured, not replying to peering request (see /pairing/start)", serial)
 				continue
 			}
 
@@ -558,13 +596,25 @@ func main() {
 				continue
 			}
 
-			if err := gw.AddPeer(bpkt.Source[:], dev.Channels()); err != nil {
+			if rec.ignored(serial) && !pairing.isOpen(time.Now()) {
+				log.Printf("%v was unpaired, not replying to peering request (see /pairing/start)", dev)
+				continue
+			}
+
+			if err := addPeer(gw, inv.BySerial(serial), dev); err != nil {
 				log.Fatal(err)
 			}
 
 			log.Printf("peer added, starting config")
 			if err := dev.Pair(); err != nil {
-				log.Fatal(err)
+				if !unreachable(err) {
+					log.Fatal(err)
+				}
+				log.Printf("pairing %v: %v", dev, err)
+				continue
+			}
+			if rec.ignored(serial) {
+				rec.ignore(serial, false) // re-paired via a pairing window
 			}
 			log.Printf("config end")
 		}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stapelberg/hmgo/internal/bidcos"
+	"github.com/stapelberg/hmgo/internal/hm"
+	"github.com/stapelberg/hmgo/internal/hm/heating"
+	"github.com/stapelberg/hmgo/internal/hm/power"
+	"github.com/stapelberg/hmgo/internal/hm/thermal"
+	"github.com/stapelberg/hmgo/internal/inventory"
+	"github.com/stapelberg/hmgo/internal/recording"
+	"github.com/stapelberg/hmgo/internal/simulator"
+	"github.com/stapelberg/hmgo/internal/uartgw"
+)
+
+var (
+	hmid = [3]byte{0xfd, 0xb0, 0x2c}
+	now  = time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// loadInventory loads testdata/inventory.json.
+func loadInventory(t *testing.T) *inventory.Inventory {
+	t.Helper()
+	inv, err := inventory.Load("testdata/inventory.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return inv
+}
+
+// startup runs the startup sequence of main on the HM-MOD-RPI-PCB
+// connected via uart.
+func startup(t *testing.T, uart io.ReadWriter) {
+	t.Helper()
+	gw, err := uartgw.NewUARTGW(uart, hmid, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configure(t, gw, loadInventory(t))
+}
+
+// configure runs configureGateway for the devices of inv and
+// reconciles them once, failing the test if any device could not be
+// brought into its desired state.
+func configure(t *testing.T, gw gateway, inv *inventory.Inventory) *reconciler {
+	t.Helper()
+	rec, _ := newReconcilerFor(t, gw, inv)
+	rec.reconcileAll(now)
+	for serial, s := range rec.States() {
+		if s.Err != nil {
+			t.Fatalf("reconciling %s: %v", serial, s.Err)
+		}
+	}
+	return rec
+}
+
+// newReconcilerFor runs configureGateway for the devices of inv and
+// returns a reconciler for them, and the sender they use.
+func newReconcilerFor(t *testing.T, gw gateway, inv *inventory.Inventory) (*reconciler, *bidcos.Sender) {
+	t.Helper()
+	bcs, err := bidcos.NewSender(gw, hmid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A reply missing from a recording fails the test right away
+	// instead of after retransmissions, which would not match the
+	// recording anyway.
+	bcs.Attempts = 1
+	byAddr := make(map[[3]byte]hm.Device)
+	bySerial := make(map[string]hm.Device)
+	for _, d := range inv.Devices {
+		dev := newDevice(bcs, d)
+		byAddr[d.Addr] = dev
+		bySerial[d.Serial] = dev
+	}
+	if err := configureGateway(gw, inv, byAddr); err != nil {
+		t.Fatal(err)
+	}
+	return newReconciler(inv, bySerial, 6*time.Hour), bcs
+}
+
+// TestStartup replays testdata/startup.rec (see package recording and
+// the -uartgw_record flag): an HM-MOD-RPI-PCB which was just reset,
+// with the thermostat and valve drive of testdata/inventory.json. The
+// thermostat’s valve offset needs to be configured, and the valve
+// drive needs to be peered with the thermostat.
+func TestStartup(t *testing.T) {
+	f, err := os.Open("testdata/startup.rec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	uart, err := recording.NewReplayer(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uart.Close()
+	startup(t, uart)
+	if err := uart.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestStartupSimulated runs the startup sequence against simulated
+// devices and verifies that they end up configured.
+func TestStartupSimulated(t *testing.T) {
+	inv := loadInventory(t)
+	sim := simulator.New(hmid)
+	defer sim.Close()
+	for _, d := range inv.Devices {
+		sim.Add(simulator.NewDevice(simulatedModels[d.Type], d.Addr, d.Serial))
+	}
+	configure(t, sim, inv)
+
+	thermalAddr := [3]byte{0x39, 0x06, 0xeb}
+	heatingAddr := [3]byte{0x38, 0xf5, 0x9c}
+	regs := sim.Device(thermalAddr).Registers(simulator.List{Channel: 0, List: 7})
+	if got, want := regs[11], byte(50); got != want {
+		t.Errorf("unexpected valve offset: got %d, want %d", got, want)
+	}
+	if got, want := sim.Device(thermalAddr).Peers(thermal.ThermalControlTransmit), []hm.FullyQualifiedChannel{
+		{Peer: heatingAddr, Channel: heating.ClimateControlReceiver},
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected thermostat peers: got %+v, want %+v", got, want)
+	}
+	if got, want := sim.Device(heatingAddr).Peers(heating.ClimateControlReceiver), []hm.FullyQualifiedChannel{
+		{Peer: thermalAddr, Channel: thermal.ThermalControlTransmit},
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected valve drive peers: got %+v, want %+v", got, want)
+	}
+	peers, err := sim.Peers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := peers, [][3]byte{heatingAddr, thermalAddr}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected gateway peers: got %x, want %x", got, want)
+	}
+}
+
+func TestPairNew(t *testing.T) {
+	b, err := os.ReadFile("testdata/inventory.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "inventory.json")
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	powerAddr := [3]byte{0x3e, 0x5a, 0x01}
+	sim := simulator.New(hmid)
+	defer sim.Close()
+	sim.Add(simulator.NewDevice(simulator.PowerSwitch, powerAddr, "MEQ1234567"))
+	bcs, err := bidcos.NewSender(sim, hmid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := &bidcos.DeviceInfoFrame{Model: 0xffff, Serial: "MEQ1234567"}
+	if _, _, err := pairNew(sim, bcs, path, powerAddr, info); err == nil {
+		t.Fatalf("pairNew of an unsupported model unexpectedly succeeded")
+	}
+
+	info.Model = simulator.PowerSwitch.Type
+	d, dev, err := pairNew(sim, bcs, path, powerAddr, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dev.(*power.PowerSwitch); !ok {
+		t.Errorf("unexpected device type: got %T, want *power.PowerSwitch", dev)
+	}
+	regs := sim.Device(powerAddr).Registers(simulator.List{Channel: 0, List: 0})
+	if got, want := [3]byte{regs[0x0a], regs[0x0b], regs[0x0c]}, hmid; got != want {
+		t.Errorf("unexpected central address: got %x, want %x", got, want)
+	}
+	peers, err := sim.Peers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := peers, [][3]byte{powerAddr}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected gateway peers: got %x, want %x", got, want)
+	}
+
+	inv, err := inventory.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := inv.BySerial("MEQ1234567")
+	if got == nil {
+		t.Fatalf("MEQ1234567 not added to the inventory")
+	}
+	if got.Addr != d.Addr || got.Type != inventory.Power || got.Name != "new-MEQ1234567" {
+		t.Errorf("unexpected inventory device: got %+v, want %+v", got, d)
+	}
+}
+
+func TestHandleUnpair(t *testing.T) {
+	inv := loadInventory(t)
+	sim := simulator.New(hmid)
+	defer sim.Close()
+	for _, d := range inv.Devices {
+		sim.Add(simulator.NewDevice(simulatedModels[d.Type], d.Addr, d.Serial))
+	}
+	bcs, err := bidcos.NewSender(sim, hmid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bySerial := make(map[string]hm.Device)
+	for _, d := range inv.Devices {
+		dev := newDevice(bcs, d)
+		bySerial[d.Serial] = dev
+		if err := addPeer(sim, d, dev); err != nil {
+			t.Fatal(err)
+		}
+		if err := dev.Pair(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The offline device is not simulated, so unpairing it fails.
+	offline := *inv.BySerial("MEQ0089016")
+	offline.Serial = "MEQ0000000"
+	offline.Addr = [3]byte{0x01, 0x02, 0x03}
+	bySerial[offline.Serial] = newDevice(bcs, &offline)
+	bcs.ReplyTimeout = 100 * time.Millisecond
+	lookup := func(serial string) (*inventory.Device, hm.Device) {
+		if serial == offline.Serial {
+			return &offline, bySerial[serial]
+		}
+		return inv.BySerial(serial), bySerial[serial]
+	}
+	ignored := make(map[string]bool)
+
+	unpair := func(form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/unpair", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		handleUnpair(rec, req, sim, lookup, func(serial string, ign bool) { ignored[serial] = ign })
+		return rec
+	}
+
+	if got, want := unpair(url.Values{"serial": {"MEQ9999999"}}).Code, http.StatusNotFound; got != want {
+		t.Errorf("unpairing an unknown serial: got HTTP %d, want %d", got, want)
+	}
+
+	rec := unpair(url.Values{"serial": {"MEQ0059922"}, "factory_reset": {"true"}})
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Fatalf("unexpected HTTP status: got %d (%s), want %d", got, rec.Body.String(), want)
+	}
+	heatingAddr := [3]byte{0x38, 0xf5, 0x9c}
+	regs := sim.Device(heatingAddr).Registers(simulator.List{Channel: 0, List: 0})
+	if got, want := [3]byte{regs[0x0a], regs[0x0b], regs[0x0c]}, [3]byte{}; got != want {
+		t.Errorf("unexpected central address: got %x, want %x", got, want)
+	}
+	peers, err := sim.Peers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := peers, [][3]byte{{0x39, 0x06, 0xeb}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected gateway peers: got %x, want %x", got, want)
+	}
+	if got, want := ignored, map[string]bool{"MEQ0059922": true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected devices ignored by the reconciler: got %v, want %v", got, want)
+	}
+
+	if got, want := unpair(url.Values{"serial": {offline.Serial}}).Code, http.StatusInternalServerError; got != want {
+		t.Errorf("unpairing an offline device: got HTTP %d, want %d", got, want)
+	}
+	if ignored[offline.Serial] {
+		t.Errorf("offline device still ignored by the reconciler after unpairing failed")
+	}
+}
+
+// TestReconcile verifies that the reconciler reports and corrects
+// drift, and that it waits for a device which is asleep to wake up.
+func TestReconcile(t *testing.T) {
+	inv := loadInventory(t)
+	sim := simulator.New(hmid)
+	defer sim.Close()
+	thermalAddr := [3]byte{0x39, 0x06, 0xeb}
+	heatingAddr := [3]byte{0x38, 0xf5, 0x9c}
+	thermalDev := inv.BySerial("MEQ0089016")
+	heatingDev := inv.BySerial("MEQ0059922")
+	// The valve drive is asleep: it does not reply at all.
+	sim.Add(simulator.NewDevice(simulatedModels[thermalDev.Type], thermalDev.Addr, thermalDev.Serial))
+	rec, bcs := newReconcilerFor(t, sim, inv)
+	bcs.ReplyTimeout = 100 * time.Millisecond
+
+	rec.reconcileAll(now)
+	states := rec.States()
+	if s := states[thermalDev.Serial]; s.Err != nil || len(s.Drift) == 0 || s.Synced != now {
+		t.Errorf("thermostat: got %+v, want initial drift corrected", s)
+	}
+	if s := states[heatingDev.Serial]; s.Err == nil || !s.Asleep || !s.Synced.IsZero() {
+		t.Errorf("valve drive: got %+v, want asleep", s)
+	}
+	if rec.due(heatingDev, now.Add(reconcileRetry)) {
+		t.Errorf("valve drive unexpectedly due before waking up")
+	}
+
+	// The valve drive wakes up, but too soon after the last attempt.
+	sim.Add(simulator.NewDevice(simulatedModels[heatingDev.Type], heatingDev.Addr, heatingDev.Serial))
+	rec.woke(heatingAddr, now.Add(reconcileRetry/2))
+	if got, want := rec.States()[heatingDev.Serial].Checked, now; got != want {
+		t.Errorf("valve drive reconciled %v after waking up too soon", got)
+	}
+	later := now.Add(reconcileRetry)
+	rec.woke(heatingAddr, later)
+	if s := rec.States()[heatingDev.Serial]; s.Err != nil || s.Synced != later {
+		t.Errorf("valve drive: got %+v, want synced at %v", s, later)
+	}
+	if got, want := sim.Device(heatingAddr).Peers(heating.ClimateControlReceiver), []hm.FullyQualifiedChannel{
+		{Peer: thermalAddr, Channel: thermal.ThermalControlTransmit},
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected valve drive peers: got %+v, want %+v", got, want)
+	}
+
+	// Somebody peers the thermostat with another device by hand.
+	stray := hm.FullyQualifiedChannel{Peer: [3]byte{0x11, 0x22, 0x33}, Channel: 1}
+	sim.Device(thermalAddr).AddPeer(thermal.ThermalControlTransmit, stray)
+	if rec.due(thermalDev, later) {
+		t.Errorf("thermostat unexpectedly due before the reconcile interval passed")
+	}
+	if !rec.due(thermalDev, now.Add(rec.interval)) {
+		t.Errorf("thermostat unexpectedly not due after the reconcile interval passed")
+	}
+	rec.reconcileAll(now.Add(rec.interval))
+	if got, want := rec.States()[thermalDev.Serial].Drift, []string{"unexpected peer 112233:1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected thermostat drift: got %q, want %q", got, want)
+	}
+	if got, want := sim.Device(thermalAddr).Peers(thermal.ThermalControlTransmit), []hm.FullyQualifiedChannel{
+		{Peer: heatingAddr, Channel: heating.ClimateControlReceiver},
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected thermostat peers: got %+v, want %+v", got, want)
+	}
+	if got, want := rec.States()[heatingDev.Serial].Drift, []string(nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected valve drive drift: got %q, want %q", got, want)
+	}
+}
+
+// TestIgnoreWaitsForReconcile verifies that unpairing a device does
+// not overlap with reconciling it.
+func TestIgnoreWaitsForReconcile(t *testing.T) {
+	inv := loadInventory(t)
+	sim := simulator.New(hmid)
+	defer sim.Close()
+	rec, _ := newReconcilerFor(t, sim, inv)
+
+	rec.reconciling.Lock() // as if a reconcile was in progress
+	done := make(chan struct{})
+	go func() {
+		rec.ignore("MEQ0059922", true)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatalf("ignore returned while a reconcile was in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+	rec.reconciling.Unlock()
+	<-done
+	if !rec.ignored("MEQ0059922") {
+		t.Errorf("device not ignored")
+	}
+}
+
+// TestReconcileConcurrently reconciles devices while they are being
+// paired and switched, like the main loop and HTTP handlers do. Run
+// with -race to detect unsynchronized access to the devices. The
+// configuration sessions of Pair and the reconciler must not
+// interleave.
+func TestReconcileConcurrently(t *testing.T) {
+	inv := loadInventory(t)
+	inv.Devices = append(inv.Devices, &inventory.Device{
+		Serial: "MEQ0123456",
+		Addr:   [3]byte{0x3a, 0x5b, 0x7c},
+		Name:   "Verstärker",
+		Type:   inventory.Power,
+	})
+	sim := simulator.New(hmid)
+	defer sim.Close()
+	for _, d := range inv.Devices {
+		sim.Add(simulator.NewDevice(simulatedModels[d.Type], d.Addr, d.Serial))
+	}
+	rec, _ := newReconcilerFor(t, sim, inv)
+	_, devs := rec.devices()
+	thermalDev := devs["MEQ0089016"]
+	powerDev := devs["MEQ0123456"].(*power.PowerSwitch)
+
+	const rounds = 5
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			rec.reconcileAll(now)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			if err := thermalDev.Pair(); err != nil {
+				t.Errorf("Pair: %v", err)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			if err := powerDev.LevelSet(power.ChannelSwitch, power.On, 0x00); err != nil {
+				t.Errorf("LevelSet: %v", err)
+			}
+		}
+	}()
+	wg.Wait()
+	for serial, s := range rec.States() {
+		if s.Err != nil {
+			t.Errorf("reconciling %s: %v", serial, s.Err)
+		}
+	}
+}
@@ -1,8 +1,9 @@
 local p_bidcos = Proto("bidcos", "BidCos");
 
-local f_typ = ProtoField.uint8("bidcos.typ", "Type", base.DEC, { [5] = "APP_RECV" })
+local f_typ = ProtoField.uint8("bidcos.typ", "Type", base.DEC, { [2] = "APP_SEND", [5] = "APP_RECV" })
 local f_status = ProtoField.uint8("bidcos.status", "Status", base.DEC);
 local f_info = ProtoField.uint8("bidcos.info", "Info", base.DEC);
+-- RSSI in -dBm for received packets, burst flag for sent packets
 local f_rssi = ProtoField.uint8("bidcos.rssi", "RSSI", base.DEC);
 local f_mnr = ProtoField.uint8("bidcos.mnr", "Message Counter", base.DEC);
 local f_flags = ProtoField.uint8("bidcos.flags", "Flags", base.DEC);
@@ -69,8 +70,12 @@ function p_hm.dissector(buf, pkt, tree)
 	subtree:add(f_dest, buf(3,1))
 	subtree:add(f_devcnt, buf(4,1))
 
+	-- Only APP_SEND and APP_RECV frames contain BidCoS packets, all
+	-- other frames are commands to or responses from the UARTGW.
+	local dest = buf(3,1):uint()
+	local typ = buf(5,1):uint()
 	local dissector = Dissector.get("bidcos")
-	if dissector ~= nil then
+	if dissector ~= nil and dest == 1 and (typ == 2 or typ == 5) then
 		dissector:call(buf(5):tvb(), pkt, tree)
 	end
 end
@@ -78,6 +83,7 @@ end
 local wtap_encap_table = DissectorTable.get("wtap_encap")
 local udp_encap_table = DissectorTable.get("udp.port")
 
+-- hmgo -pcap_file writes LINKTYPE_USER15 captures
 wtap_encap_table:add(wtap.USER15, p_hm)
 wtap_encap_table:add(wtap.USER12, p_hm)
 udp_encap_table:add(6080, p_hm)
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/stapelberg/hmgo/internal/uartgw"
+)
+
+// updateFirmware implements the update_firmware subcommand, which
+// writes an eQ-3 firmware image (.eq3 file) to the HM-MOD-RPI-PCB.
+func updateFirmware(args []string) error {
+	fset := flag.NewFlagSet("update_firmware", flag.ExitOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "syntax: hmgo [flags] update_firmware <firmware.eq3>\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if fset.NArg() != 1 {
+		fset.Usage()
+		os.Exit(2)
+	}
+
+	image, err := os.Open(fset.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+
+	uart, _, err := openUARTGW()
+	if err != nil {
+		return err
+	}
+	defer uart.Close()
+
+	gw, err := uartgw.NewBootloader(uart)
+	if err != nil {
+		return err
+	}
+
+	var lastPercent int
+	if err := gw.UpdateFirmware(image, func(done, total int) {
+		if percent := 100 * done / total; percent/10 != lastPercent/10 {
+			log.Printf("firmware update: %d%% (block %d of %d)", percent, done, total)
+			lastPercent = percent
+		}
+	}); err != nil {
+		return err
+	}
+	log.Printf("firmware update done, HM-MOD-RPI-PCB now runs firmware %s", gw.FirmwareVersion())
+	return nil
+}
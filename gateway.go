@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/stapelberg/hmgo/internal/bidcos"
+	"github.com/stapelberg/hmgo/internal/cul"
+	"github.com/stapelberg/hmgo/internal/gpio"
+	"github.com/stapelberg/hmgo/internal/hmlan"
+	"github.com/stapelberg/hmgo/internal/inventory"
+	"github.com/stapelberg/hmgo/internal/lgw"
+	"github.com/stapelberg/hmgo/internal/recording"
+	"github.com/stapelberg/hmgo/internal/serial"
+	"github.com/stapelberg/hmgo/internal/share"
+	"github.com/stapelberg/hmgo/internal/simulator"
+	"github.com/stapelberg/hmgo/internal/uartgw"
+)
+
+// gateway is implemented by all radio gateways which hmgo supports
+// (see the -gateway flag).
+type gateway interface {
+	bidcos.Gateway
+
+	AddPeer(addr []byte, channels int) error
+	AddPeerAES(addr []byte, channels int) error
+	RemovePeer(addr [3]byte) error
+	SetTime(now time.Time) error
+
+	SetCurrentKey(k bidcos.Key) error
+	SetPreviousKey(k bidcos.Key) error
+	SetTempKey(k bidcos.Key) error
+}
+
+// peerLister is implemented by gateways which can list their peer
+// table, so that stale peers can be removed.
+type peerLister interface {
+	Peers() ([][3]byte, error)
+}
+
+// simulatedModels maps inventory device types to the model which
+// -gateway=simulator simulates.
+var simulatedModels = map[string]*simulator.Model{
+	inventory.Thermal: simulator.ThermalControl,
+	inventory.Heating: simulator.Thermostat,
+	inventory.Power:   simulator.PowerSwitch,
+}
+
+// openGateway connects to and initializes the gateway selected by the
+// -gateway flag. The devices of inv are simulated for -gateway=simulator.
+func openGateway(hmid [3]byte, inv *inventory.Inventory) (gateway, error) {
+	switch *gatewayType {
+	case "uartgw":
+		uart, withFd, err := openUARTGW()
+		if err != nil {
+			return nil, err
+		}
+		rw, err := record(uart)
+		if err != nil {
+			return nil, err
+		}
+		gw, err := uartgw.NewUARTGW(rw, hmid, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		gw.SetMaxFrameErrors(*maxFrameErrors)
+		if *watchdogTimeout > 0 {
+			if err := gw.Watchdog(*watchdogTimeout, func() error {
+				log.Printf("resetting HM-MOD-RPI-PCB via GPIO")
+				return withFd(gpio.ResetUARTGW)
+			}); err != nil {
+				return nil, err
+			}
+		}
+		log.Printf("initialized UARTGW %s (firmware %s)", gw.SerialNumber(), gw.FirmwareVersion())
+		return gw, nil
+
+	case "lgw":
+		if *gatewayAddress == "" {
+			return nil, fmt.Errorf("-gateway=lgw requires -gateway_address")
+		}
+		conn, err := lgw.Dial(*gatewayAddress)
+		if err != nil {
+			return nil, err
+		}
+		rw, err := record(conn)
+		if err != nil {
+			return nil, err
+		}
+		gw, err := uartgw.NewRunningUARTGW(rw, hmid, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		gw.SetMaxFrameErrors(*maxFrameErrors)
+		log.Printf("initialized HM-LGW %s (firmware %s)", gw.SerialNumber(), gw.FirmwareVersion())
+		return gw, nil
+
+	case "cul":
+		port, err := openCUL()
+		if err != nil {
+			return nil, err
+		}
+		gw, err := cul.NewCUL(port, hmid)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("initialized CUL (culfw %s)", gw.Version)
+		return gw, nil
+
+	case "hmlan":
+		if *gatewayAddress == "" {
+			return nil, fmt.Errorf("-gateway=hmlan requires -gateway_address")
+		}
+		gw, err := hmlan.Dial(*gatewayAddress, hmid, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("initialized HM-CFG-LAN %s (firmware %s)", gw.SerialNumber, gw.FirmwareVersion)
+		return gw, nil
+
+	case "simulator":
+		sim := simulator.New(hmid)
+		for _, d := range inv.Devices {
+			dev := simulator.NewDevice(simulatedModels[d.Type], d.Addr, d.Serial)
+			dev.Interval = *simulatorInterval
+			sim.Add(dev)
+		}
+		log.Printf("simulating %d devices", len(inv.Devices))
+		return sim, nil
+	}
+	return nil, fmt.Errorf("unknown -gateway %q, expected one of uartgw, cul, lgw, hmlan or simulator", *gatewayType)
+}
+
+// record wraps rw in a recording.Recorder when -uartgw_record is set.
+func record(rw io.ReadWriter) (io.ReadWriter, error) {
+	if *uartgwRecord == "" {
+		return rw, nil
+	}
+	f, err := os.Create(*uartgwRecord)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("recording UARTGW traffic to %s", *uartgwRecord)
+	return recording.NewRecorder(rw, f), nil
+}
+
+// openCUL opens and configures the serial port of the CUL.
+func openCUL() (*os.File, error) {
+	log.Printf("opening serial port %s", *serialPort)
+	port, err := os.OpenFile(*serialPort, os.O_EXCL|os.O_RDWR|unix.O_NOCTTY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := port.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = serial.ConfigureSpeed(fd, unix.B38400)
+	}); err != nil {
+		return nil, err
+	}
+	if serr != nil {
+		return nil, serr
+	}
+	return port, nil
+}
+
+// shareGateway makes the frames of gw available on addr, a TCP
+// host:port or the path of a Unix socket (starting with /).
+func shareGateway(gw gateway, addr string) error {
+	u, ok := gw.(*uartgw.UARTGW)
+	if !ok {
+		return fmt.Errorf("-share_listen is only supported with -gateway=uartgw or -gateway=lgw")
+	}
+	network := "tcp"
+	if strings.HasPrefix(addr, "/") {
+		network = "unix"
+		// Remove the socket of a previous run.
+		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("sharing UARTGW frames on %s %s", network, addr)
+	go func() {
+		log.Printf("sharing UARTGW frames: %v", share.Serve(ln, u))
+	}()
+	return nil
+}
@@ -0,0 +1,232 @@
+package bidcos
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Key is an AES key used to sign BidCoS packets. Devices announce
+// which key they expect via its Index.
+type Key struct {
+	// Index is the key index as transmitted, i.e. twice the key number
+	// shown by the CCU2 or FHEM.
+	Index byte
+	Key   [16]byte
+}
+
+// DefaultKey is the well-known key with which devices are shipped,
+// i.e. key number 1.
+var DefaultKey = Key{
+	Index: 0x02,
+	Key:   [16]byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff},
+}
+
+// ParseKey parses a key in the form “index:hex”, e.g.
+// “2:00112233445566778899aabbccddeeff”.
+func ParseKey(s string) (Key, error) {
+	idx, hexkey, ok := strings.Cut(strings.TrimSpace(s), ":")
+	if !ok {
+		return Key{}, fmt.Errorf("invalid AES key: want index:hex")
+	}
+	index, err := strconv.ParseUint(idx, 0, 8)
+	if err != nil {
+		return Key{}, fmt.Errorf("invalid AES key index %q: %v", idx, err)
+	}
+	b, err := hex.DecodeString(hexkey)
+	if err != nil {
+		return Key{}, fmt.Errorf("invalid AES key: %v", err)
+	}
+	k := Key{Index: byte(index)}
+	if got, want := len(b), len(k.Key); got != want {
+		return Key{}, fmt.Errorf("invalid AES key length: got %d bytes, want %d", got, want)
+	}
+	copy(k.Key[:], b)
+	return k, nil
+}
+
+// challengeLen is the length of an AES challenge.
+const challengeLen = 6
+
+// tempKey derives the key for answering challenge from k.
+func (k Key) tempKey(challenge []byte) []byte {
+	tk := append([]byte(nil), k.Key[:]...)
+	for i := 0; i < challengeLen; i++ {
+		tk[i] ^= challenge[i]
+	}
+	return tk
+}
+
+// signedBytes returns the bytes of pkt which are covered by an AES
+// signature, i.e. the packet without status, info and RSSI.
+func (p *Packet) signedBytes() []byte {
+	b := []byte{p.Msgcnt, p.Flags, p.Cmd}
+	b = append(b, p.Source[:]...)
+	b = append(b, p.Dest[:]...)
+	return append(b, p.Payload...)
+}
+
+// AESResponse returns the payload of an AESReply packet which proves
+// to the recipient of pkt that pkt was sent by the owner of k. random
+// must be 6 random bytes.
+//
+// c.f. https://github.com/Homegear/Homegear-HomeMaticBidCoS/blob/master/src/AesHandshake.cpp
+func AESResponse(k Key, challenge []byte, pkt *Packet, random []byte) ([]byte, error) {
+	if got, want := len(challenge), challengeLen; got != want {
+		return nil, fmt.Errorf("invalid challenge length: got %d, want %d", got, want)
+	}
+	block, err := aes.NewCipher(k.tempKey(challenge))
+	if err != nil {
+		return nil, err
+	}
+	signed := pkt.signedBytes()
+	pd := make([]byte, aes.BlockSize)
+	copy(pd, random[:6])
+	copy(pd[6:], signed)
+	resp := make([]byte, aes.BlockSize)
+	block.Encrypt(resp, pd)
+	if len(signed) > 10 {
+		for i, b := range signed[10:] {
+			if i == aes.BlockSize {
+				break
+			}
+			resp[i] ^= b
+		}
+	}
+	block.Encrypt(resp, resp)
+	return resp, nil
+}
+
+// VerifyAESResponse verifies that response (the payload of an AESReply
+// packet) proves that pkt was sent by the owner of k.
+func VerifyAESResponse(k Key, challenge []byte, pkt *Packet, response []byte) error {
+	if got, want := len(challenge), challengeLen; got != want {
+		return fmt.Errorf("invalid challenge length: got %d, want %d", got, want)
+	}
+	if got, want := len(response), aes.BlockSize; got < want {
+		return fmt.Errorf("AES response too short: got %d, want >= %d", got, want)
+	}
+	block, err := aes.NewCipher(k.tempKey(challenge))
+	if err != nil {
+		return err
+	}
+	signed := pkt.signedBytes()
+	pd := make([]byte, aes.BlockSize)
+	block.Decrypt(pd, response[:aes.BlockSize])
+	if len(signed) > 10 {
+		for i, b := range signed[10:] {
+			if i == aes.BlockSize {
+				break
+			}
+			pd[i] ^= b
+		}
+	}
+	block.Decrypt(pd, pd)
+	want := make([]byte, 10)
+	copy(want, signed)
+	if !bytes.Equal(pd[6:], want) {
+		return fmt.Errorf("invalid AES signature of packet from [BidCoS:%x]", pkt.Source)
+	}
+	return nil
+}
+
+// isChallenge returns whether pkt is an AES challenge, i.e. an Ack
+// with subcommand AckAES, followed by the challenge and the key index.
+func (p *Packet) isChallenge() bool {
+	return p.Cmd == Ack && len(p.Payload) >= 1+challengeLen+1 && p.Payload[0] == AckAES
+}
+
+// SetKeys sets the AES keys with which Send answers challenges of
+// devices which require signed commands, looked up by the key index
+// the device requests. The first key is the current one. Initially,
+// only DefaultKey is set.
+func (s *Sender) SetKeys(keys ...Key) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = append([]Key(nil), keys...)
+}
+
+// Keys returns the keys set via SetKeys.
+func (s *Sender) Keys() []Key {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Key(nil), s.keys...)
+}
+
+// key returns the key with the specified index.
+func (s *Sender) key(index byte) (Key, bool) {
+	for _, k := range s.Keys() {
+		if k.Index == index {
+			return k, true
+		}
+	}
+	return Key{}, false
+}
+
+// answerChallenge replies to the AES challenge which the destination
+// of pkt sent, proving that we sent pkt.
+func (s *Sender) answerChallenge(pkt, challenge *Packet) error {
+	index := challenge.Payload[1+challengeLen]
+	k, ok := s.key(index)
+	if !ok {
+		return fmt.Errorf("[BidCoS:%x] requested unknown AES key %d", pkt.Dest, index)
+	}
+	random := make([]byte, 6)
+	if _, err := rand.Read(random); err != nil {
+		return err
+	}
+	resp, err := AESResponse(k, challenge.Payload[1:1+challengeLen], pkt, random)
+	if err != nil {
+		return err
+	}
+	return s.WritePacket(&Packet{
+		Msgcnt:  pkt.Msgcnt,
+		Flags:   pkt.Flags &^ Repeated,
+		Cmd:     AESReply,
+		Dest:    pkt.Dest,
+		Payload: resp,
+	})
+}
+
+// ChangeKey makes the device dest switch from key old to key new. The
+// new key is transferred in two AESKey packets, each containing half
+// of the key encrypted using the old key.
+//
+// To keep communicating with devices which still use the old key, set
+// both keys (see SetKeys, and configure the gateway if it handles AES
+// itself).
+func (s *Sender) ChangeKey(ctx context.Context, dest [3]byte, old, new Key) error {
+	block, err := aes.NewCipher(old.Key[:])
+	if err != nil {
+		return err
+	}
+	for part := 0; part < 2; part++ {
+		plain := make([]byte, aes.BlockSize)
+		copy(plain, new.Key[8*part:8*part+8])
+		plain[8] = new.Index + byte(part)
+		if _, err := rand.Read(plain[9:]); err != nil {
+			return err
+		}
+		payload := make([]byte, 1+aes.BlockSize)
+		payload[0] = 0x01
+		block.Encrypt(payload[1:], plain)
+		reply, err := s.Send(ctx, &Packet{
+			Flags:   DefaultFlags,
+			Cmd:     AESKey,
+			Dest:    dest,
+			Payload: payload,
+		})
+		if err != nil {
+			return err
+		}
+		if reply.Cmd != Ack || reply.Nack() {
+			return fmt.Errorf("[BidCoS:%x] rejected AES key part %d: %x %x", dest, part+1, reply.Cmd, reply.Payload)
+		}
+	}
+	return nil
+}
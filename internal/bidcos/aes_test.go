@@ -0,0 +1,120 @@
+package bidcos_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stapelberg/hmgo/internal/bidcos"
+)
+
+var (
+	challenge = []byte{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc}
+	random    = []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06}
+)
+
+func TestAESResponse(t *testing.T) {
+	other, err := bidcos.ParseKey("2:0f0e0d0c0b0a09080706050403020100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, payload := range [][]byte{
+		nil,
+		{0x01, 0x01, 0xc8, 0x00, 0x00},
+		// longer than one AES block after the first 10 bytes
+		{0x00, 0x08, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f},
+	} {
+		pkt := &bidcos.Packet{
+			Msgcnt:  0x42,
+			Flags:   bidcos.DefaultFlags,
+			Cmd:     bidcos.Config,
+			Source:  hmid,
+			Dest:    thermal,
+			Payload: payload,
+		}
+		resp, err := bidcos.AESResponse(bidcos.DefaultKey, challenge, pkt, random)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bidcos.VerifyAESResponse(bidcos.DefaultKey, challenge, pkt, resp); err != nil {
+			t.Errorf("payload %x: %v", payload, err)
+		}
+		if err := bidcos.VerifyAESResponse(other, challenge, pkt, resp); err == nil {
+			t.Errorf("payload %x: response unexpectedly valid for a different key", payload)
+		}
+		tampered := *pkt
+		tampered.Msgcnt++
+		if err := bidcos.VerifyAESResponse(bidcos.DefaultKey, challenge, &tampered, resp); err == nil {
+			t.Errorf("payload %x: response unexpectedly valid for a different packet", payload)
+		}
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	k, err := bidcos.ParseKey("2:00112233445566778899aabbccddeeff\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := k, bidcos.DefaultKey; got != want {
+		t.Fatalf("unexpected key: got %x, want %x", got, want)
+	}
+	for _, s := range []string{
+		"",
+		"00112233445566778899aabbccddeeff",
+		"x:00112233445566778899aabbccddeeff",
+		"2:0011",
+		"2:zz",
+	} {
+		if _, err := bidcos.ParseKey(s); err == nil {
+			t.Errorf("ParseKey(%q) unexpectedly succeeded", s)
+		}
+	}
+}
+
+func TestSendAESChallenge(t *testing.T) {
+	gw := newTestGateway()
+	bcs, err := bidcos.NewSender(gw, hmid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(gw.incoming)
+
+	done := make(chan error)
+	go func() {
+		reply, err := bcs.Send(context.Background(), &bidcos.Packet{
+			Msgcnt:  0x42,
+			Flags:   bidcos.DefaultFlags,
+			Cmd:     bidcos.Config,
+			Dest:    thermal,
+			Payload: []byte{0x01, bidcos.ConfigStart},
+		})
+		if err == nil && reply.Payload[0] != bidcos.AckOK {
+			t.Errorf("unexpected reply: got %x, want Ack", reply.Payload)
+		}
+		done <- err
+	}()
+	sent, err := bidcos.Decode(<-gw.written)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gw.incoming <- packet(thermal, bidcos.Ack, append(append([]byte{bidcos.AckAES}, challenge...), bidcos.DefaultKey.Index)...).Encode()
+
+	reply, err := bidcos.Decode(<-gw.written)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := reply.Cmd, byte(bidcos.AESReply); got != want {
+		t.Fatalf("unexpected cmd: got %x, want %x", got, want)
+	}
+	if got, want := reply.Msgcnt, sent.Msgcnt; got != want {
+		t.Fatalf("unexpected msgcnt: got %x, want %x", got, want)
+	}
+	if err := bidcos.VerifyAESResponse(bidcos.DefaultKey, challenge, sent, reply.Payload); err != nil {
+		t.Fatal(err)
+	}
+
+	gw.incoming <- packet(thermal, bidcos.Ack, bidcos.AckOK).Encode()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -3,11 +3,41 @@
 package bidcos
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// prometheus metrics
+var (
+	retransmissions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "hm",
+			Name:      "Retransmissions",
+			Help:      "number of BidCoS packets retransmitted because the device did not reply",
+		},
+		[]string{"address"})
+
+	sendFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "hm",
+			Name:      "SendFailures",
+			Help:      "number of BidCoS packets which the device did not reply to after all attempts",
+		},
+		[]string{"address"})
 )
 
+func init() {
+	prometheus.MustRegister(retransmissions)
+	prometheus.MustRegister(sendFailures)
+}
+
 // cmd is top-level (e.g. SET), frames usually specify a subtype (e.g. MANU_MODE_SET)
 
 // BidCoS commands
@@ -15,6 +45,8 @@ const (
 	DeviceInfo byte = iota
 	Config
 	Ack
+	AESReply
+	AESKey
 	Info             = 0x10
 	ClimateEvent     = 0x58
 	ThermalControl   = 0x5a
@@ -24,6 +56,15 @@ const (
 	Timestamp        = 0x3f
 )
 
+// BidCoS Ack subcommands
+const (
+	AckOK       byte = 0x00
+	AckStatus   byte = 0x01
+	AckAES      byte = 0x04
+	Nack        byte = 0x80
+	NackInvalid byte = 0x84
+)
+
 // BidCoS Config subcommands
 const (
 	_ byte = iota
@@ -68,7 +109,7 @@ const (
 	Burst
 	// Bi-directional, i.e. response expected.
 	BiDi
-	// Packet was repeated (not seen in the wild).
+	// Packet was repeated, i.e. relayed by a repeater or retransmitted.
 	Repeated
 	// Packet can be repeated (always set).
 	RepeatEnable
@@ -76,11 +117,25 @@ const (
 
 const DefaultFlags = RepeatEnable | BiDi
 
+// Status bits of received packets, set by the gateway.
+const (
+	// The packet’s AES signature was verified.
+	StatusAES byte = 1 << iota
+	// The packet was signed using a key other than ours.
+	StatusWrongKey
+)
+
 // Packet is a BidCoS packet.
 type Packet struct {
-	status  uint8
-	info    uint8
-	rssi    uint8
+	// Status (see Status bits above) and Info are set by the gateway
+	// for received packets.
+	Status uint8
+	Info   uint8
+
+	// RSSI is the received signal strength in dBm. It is zero for
+	// packets which were not received via radio.
+	RSSI int
+
 	Msgcnt  uint8
 	Flags   uint8 // see Packet flags above
 	Cmd     uint8 // see BidCoS commands above
@@ -89,23 +144,64 @@ type Packet struct {
 	Payload []byte // at most 17 bytes
 }
 
+// AES returns whether p was received with a verified AES signature.
+func (p *Packet) AES() bool {
+	return p.Status&StatusAES != 0
+}
+
+// WrongKey returns whether p was signed using a key other than ours.
+func (p *Packet) WrongKey() bool {
+	return p.Status&StatusWrongKey != 0
+}
+
+// IsRepeated returns whether p was relayed by a repeater (or
+// retransmitted, see Sender.Send).
+func (p *Packet) IsRepeated() bool {
+	return p.Flags&Repeated != 0
+}
+
+// DecodeRSSI converts the raw RSSI byte reported by the HM-MOD-RPI-PCB
+// into dBm. c.f. Homegear-HomeMaticBidCoS/src/PhysicalInterfaces/Hm-Mod-Rpi-Pcb.cpp:
+// “Range should be from 0x0B to 0x8A. 0x0B is -11dBm, 0x8A -138dBm.”
+func DecodeRSSI(raw byte) int {
+	return -int(raw)
+}
+
+// Nack returns whether p is a negative acknowledgement.
+func (p *Packet) Nack() bool {
+	return p.Cmd == Ack && len(p.Payload) > 0 && p.Payload[0]&Nack == Nack
+}
+
 var messageCounter struct {
 	counter byte
 	sync.RWMutex
 }
 
-func (p *Packet) Encode() []byte {
-	// c.f. https://svn.fhem.de/trac/browser/trunk/fhem/FHEM/00_HMUARTLGW.pm?rev=13367#L1464
-	// c.f. https://github.com/Homegear/Homegear-HomeMaticBidCoS/blob/5255288954f3da42e12fa72a06963b99089d323f/src/PhysicalInterfaces/Hm-Mod-Rpi-Pcb.cpp#L858
+// nextMessageCounter returns the message counter to use for the next
+// packet which does not specify one.
+func nextMessageCounter() byte {
 	messageCounter.Lock()
 	defer messageCounter.Unlock()
-	cnt := p.Msgcnt
-	if cnt == 0 {
-		cnt = messageCounter.counter
+	for {
+		cnt := messageCounter.counter
 		// The Homematic CCU2 increments its message counter by 9 between
 		// each message. My guess is that the resulting pattern has better
 		// radio characteristics.
 		messageCounter.counter += 9
+		// 0 means “not specified” (see Send and Encode), so Send would
+		// wait for a reply to message 0 while Encode sends the next one.
+		if cnt != 0 {
+			return cnt
+		}
+	}
+}
+
+func (p *Packet) Encode() []byte {
+	// c.f. https://svn.fhem.de/trac/browser/trunk/fhem/FHEM/00_HMUARTLGW.pm?rev=13367#L1464
+	// c.f. https://github.com/Homegear/Homegear-HomeMaticBidCoS/blob/5255288954f3da42e12fa72a06963b99089d323f/src/PhysicalInterfaces/Hm-Mod-Rpi-Pcb.cpp#L858
+	cnt := p.Msgcnt
+	if cnt == 0 {
+		cnt = nextMessageCounter()
 	}
 	var burst byte
 	if p.Flags&0x10 == 0x10 {
@@ -125,17 +221,24 @@ func (p *Packet) Encode() []byte {
 	return res
 }
 
+// decodeError is returned by Decode for invalid packets.
+type decodeError struct {
+	msg string
+}
+
+func (e *decodeError) Error() string { return e.msg }
+
+// Decode decodes a packet as received from the gateway, i.e. status,
+// info and RSSI bytes followed by the BidCoS frame.
 func Decode(b []byte) (*Packet, error) {
 	if got, want := len(b), 12; got < want {
-		return nil, fmt.Errorf("too short for a bidcos packet: got %d, want >= %d", got, want)
+		return nil, &decodeError{fmt.Sprintf("too short for a bidcos packet: got %d, want >= %d", got, want)}
 	}
 
-	// TODO(later): decode RSSI, see Homegear-HomeMaticBidCoS/src/BidCoSPacket.cpp
-
 	return &Packet{
-		status:  b[0],
-		info:    b[1],
-		rssi:    b[2],
+		Status:  b[0],
+		Info:    b[1],
+		RSSI:    DecodeRSSI(b[2]),
 		Msgcnt:  b[3],                        // hg: “message counter”
 		Flags:   b[4],                        // hg: “control byte”
 		Cmd:     b[5],                        // hg: “message type”
@@ -145,30 +248,116 @@ func Decode(b []byte) (*Packet, error) {
 	}, nil
 }
 
+// Gateway sends and receives BidCoS packets. Confirm returns whether
+// the gateway accepted the packet sent by the most recent Write call.
 type Gateway interface {
 	io.ReadWriter
 	Confirm() error
 }
 
+// Errors which Gateway.Confirm may return (possibly wrapped) when the
+// gateway did not send a packet, but might succeed later.
+var (
+	// ErrNoCredits means the gateway exhausted its duty cycle budget,
+	// i.e. transmitted for more than 1% of the last hour.
+	ErrNoCredits = errors.New("gateway duty cycle budget exhausted")
+
+	// ErrChannelBusy means the gateway’s carrier sense (CSMA/CA)
+	// found the radio channel to be busy.
+	ErrChannelBusy = errors.New("radio channel busy")
+
+	// ErrGatewayReset means the gateway was reset or re-initialized
+	// (e.g. by a watchdog) while sending the packet.
+	ErrGatewayReset = errors.New("gateway reset while sending")
+)
+
+// ErrNoAck is returned (possibly wrapped) by Gateway.Confirm when the
+// gateway sent a BiDi packet, but the destination device did not
+// acknowledge it. Send treats it like a missing reply.
+var ErrNoAck = errors.New("packet not acknowledged by the destination")
+
+// CreditGateway is implemented by gateways which report their
+// remaining duty cycle budget.
+type CreditGateway interface {
+	Gateway
+
+	// Credits returns the remaining duty cycle budget in percent.
+	Credits() (float64, error)
+}
+
 // Sender is a convenience wrapper around a Gateway which fills in the
 // BidCoS source address for outgoing packets, automatically confirms
 // outgoing packets and decodes incoming packets.
+//
+// A single goroutine reads all incoming packets and delivers each to
+// the first Receiver whose match function accepts it, or to all
+// subscribers (see Subscribe) otherwise.
 type Sender struct {
 	Gateway Gateway
 	Addr    [3]byte
+
+	// ReplyTimeout is how long Send waits for a reply to each attempt.
+	ReplyTimeout time.Duration
+
+	// Attempts is how often Send transmits a packet before giving up.
+	Attempts int
+
+	// RetryBackoff is how long Send waits before the first
+	// retransmission. The wait doubles with every further one.
+	RetryBackoff time.Duration
+
+	// When the gateway is a CreditGateway with less than LowCredits
+	// percent of its duty cycle budget remaining, or when it reports
+	// ErrNoCredits, WritePacket waits for CreditWait before trying
+	// again. The budget is queried at most every CreditInterval while
+	// it is not low.
+	LowCredits     float64
+	CreditWait     time.Duration
+	CreditInterval time.Duration
+
+	// writeMu serializes Write/Confirm pairs.
+	writeMu sync.Mutex
+
+	// credits is the duty cycle budget as of creditsChecked (zero if
+	// it needs to be queried), see throttle. Both are guarded by
+	// writeMu.
+	credits        float64
+	creditsChecked time.Time
+
+	mu          sync.Mutex
+	receivers   []*Receiver
+	subscribers []chan *Packet
+	keys        []Key // see SetKeys
+
+	// done is closed when the reader goroutine exits, after setting
+	// readErr.
+	done    chan struct{}
+	readErr error
 }
 
+// NewSender returns a Sender for gw and starts a goroutine which reads
+// packets from gw until reading fails.
 func NewSender(gw Gateway, addr [3]byte) (*Sender, error) {
 	if got, want := len(addr), 3; got != want {
 		return nil, fmt.Errorf("unexpected address length: got %d, want %d", got, want)
 	}
-	return &Sender{
-		Gateway: gw,
-		Addr:    addr,
-	}, nil
+	s := &Sender{
+		Gateway:        gw,
+		Addr:           addr,
+		ReplyTimeout:   DefaultReplyTimeout,
+		Attempts:       DefaultAttempts,
+		RetryBackoff:   DefaultRetryBackoff,
+		LowCredits:     DefaultLowCredits,
+		CreditWait:     DefaultCreditWait,
+		CreditInterval: DefaultCreditInterval,
+		keys:           []Key{DefaultKey},
+		done:           make(chan struct{}),
+	}
+	go s.readLoop()
+	return s, nil
 }
 
-func (s *Sender) ReadPacket() (*Packet, error) {
+func (s *Sender) readPacket() (*Packet, error) {
 	// 17 byte BidCoS maximum observed payload + 12 bytes fixed BidCoS overhead
 	var buf [17 + 12]byte
 	n, err := s.Gateway.Read(buf[:])
@@ -178,12 +367,311 @@ func (s *Sender) ReadPacket() (*Packet, error) {
 	return Decode(buf[:n])
 }
 
+func (s *Sender) readLoop() {
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, ch := range s.subscribers {
+			close(ch)
+		}
+		s.subscribers = nil
+		close(s.done)
+	}()
+	for {
+		pkt, err := s.readPacket()
+		if err != nil {
+			// Decoding errors only affect a single packet.
+			if _, ok := err.(*decodeError); ok {
+				log.Printf("skipping invalid bidcos packet: %v", err)
+				continue
+			}
+			s.readErr = err
+			return
+		}
+		s.dispatch(pkt)
+	}
+}
+
+func (s *Sender) dispatch(pkt *Packet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// The most recently registered Receiver takes precedence, so that
+	// e.g. Send can wait for the first response to a request while the
+	// caller waits for the subsequent ones.
+	for i := len(s.receivers) - 1; i >= 0; i-- {
+		r := s.receivers[i]
+		if !r.match(pkt) {
+			continue
+		}
+		select {
+		case r.ch <- pkt:
+		default:
+			log.Printf("receiver buffer full, dropping BidCoS packet %+v", pkt)
+		}
+		return
+	}
+	for _, ch := range s.subscribers {
+		select {
+		case ch <- pkt:
+		default:
+			log.Printf("subscriber buffer full, dropping BidCoS packet %+v", pkt)
+		}
+	}
+}
+
+// Err returns the error which made the reader goroutine exit, if any.
+func (s *Sender) Err() error {
+	select {
+	case <-s.done:
+		return s.readErr
+	default:
+		return nil
+	}
+}
+
+// Subscribe returns a channel on which all packets are delivered which
+// no Receiver is waiting for, e.g. unsolicited device events. The
+// channel is closed when reading from the gateway fails, see Err.
+func (s *Sender) Subscribe() <-chan *Packet {
+	ch := make(chan *Packet, 64)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.done:
+		close(ch)
+	default:
+		s.subscribers = append(s.subscribers, ch)
+	}
+	return ch
+}
+
+// Receiver receives the packets which match a function, e.g. the
+// responses to a request sent to a specific device.
+type Receiver struct {
+	s     *Sender
+	match func(*Packet) bool
+	ch    chan *Packet
+}
+
+// Receive returns a Receiver for all packets for which match returns
+// true, until the Receiver is closed. To not miss any responses, call
+// Receive before sending the request. When multiple Receivers match a
+// packet, the most recently created one receives it.
+func (s *Sender) Receive(match func(*Packet) bool) *Receiver {
+	r := &Receiver{
+		s:     s,
+		match: match,
+		ch:    make(chan *Packet, 16),
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.receivers = append(s.receivers, r)
+	return r
+}
+
+// Next blocks until the next matching packet is received or ctx is
+// done.
+func (r *Receiver) Next(ctx context.Context) (*Packet, error) {
+	select {
+	case pkt := <-r.ch:
+		return pkt, nil
+	case <-r.s.done:
+		return nil, r.s.readErr
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close stops delivering packets to r.
+func (r *Receiver) Close() {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	for i, other := range r.s.receivers {
+		if other == r {
+			r.s.receivers = append(r.s.receivers[:i], r.s.receivers[i+1:]...)
+			break
+		}
+	}
+}
+
+// From returns a match function (see Receive) for packets from
+// source with one of the specified commands.
+func From(source [3]byte, cmds ...byte) func(*Packet) bool {
+	return func(pkt *Packet) bool {
+		if pkt.Source != source {
+			return false
+		}
+		for _, cmd := range cmds {
+			if pkt.Cmd == cmd {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// channelBusyAttempts is how often WritePacket tries to send a packet
+// while the gateway reports ErrChannelBusy.
+const channelBusyAttempts = 3
+
+// throttle blocks while the gateway’s duty cycle budget is low. The
+// caller must hold writeMu, so that all other packets queue up.
+func (s *Sender) throttle() {
+	cg, ok := s.Gateway.(CreditGateway)
+	if !ok {
+		return
+	}
+	for {
+		if s.creditsChecked.IsZero() || time.Since(s.creditsChecked) >= s.CreditInterval {
+			credits, err := cg.Credits()
+			if err != nil {
+				log.Printf("querying gateway credits: %v", err)
+				return
+			}
+			s.credits, s.creditsChecked = credits, time.Now()
+		}
+		if s.credits >= s.LowCredits {
+			return
+		}
+		log.Printf("gateway duty cycle budget low (%.1f%% remaining), waiting %v", s.credits, s.CreditWait)
+		time.Sleep(s.CreditWait)
+		s.creditsChecked = time.Time{} // query again after waiting
+	}
+}
+
+// WritePacket sends pkt via the gateway. Transmissions are delayed
+// while the gateway is low on credits or the radio channel is busy, and
+// repeated once when the gateway was reset while sending.
 func (s *Sender) WritePacket(pkt *Packet) error {
 	pkt.Source = s.Addr
 	//log.Printf("writing bidcos packet %+v", pkt)
-	_, err := s.Gateway.Write(pkt.Encode())
-	if err != nil {
-		return err
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	var reset bool
+	for busy := 0; ; {
+		s.throttle()
+		_, err := s.Gateway.Write(pkt.Encode())
+		if err != nil {
+			return err
+		}
+		err = s.Gateway.Confirm()
+		switch {
+		case errors.Is(err, ErrNoCredits):
+			log.Printf("gateway out of credits, retrying in %v", s.CreditWait)
+			time.Sleep(s.CreditWait)
+			s.creditsChecked = time.Time{}
+		case errors.Is(err, ErrChannelBusy) && busy < channelBusyAttempts-1:
+			busy++
+			time.Sleep(time.Duration(busy) * 100 * time.Millisecond)
+		case errors.Is(err, ErrGatewayReset) && !reset:
+			// The gateway only accepts the packet once it was
+			// re-initialized.
+			log.Printf("gateway reset while sending, retrying")
+			reset = true
+		default:
+			return err
+		}
+	}
+}
+
+// Defaults for the corresponding Sender fields. Like the CCU2, we
+// send each command up to 3 times.
+const (
+	DefaultReplyTimeout   = 2 * time.Second
+	DefaultAttempts       = 3
+	DefaultRetryBackoff   = 500 * time.Millisecond
+	DefaultLowCredits     = 10
+	DefaultCreditWait     = 30 * time.Second
+	DefaultCreditInterval = 1 * time.Minute
+)
+
+// NoReplyError is returned by Send when the destination device did not
+// reply to any attempt.
+type NoReplyError struct {
+	Dest     [3]byte
+	Msgcnt   uint8
+	Attempts int
+}
+
+func (e *NoReplyError) Error() string {
+	return fmt.Sprintf("no reply from [BidCoS:%x] to message %d after %d attempts", e.Dest, e.Msgcnt, e.Attempts)
+}
+
+// Send sends pkt and returns the destination device’s reply, i.e. the
+// Ack (or Nack, see Packet.Nack) or Info packet with the same message
+// counter. Packets without the BiDi flag are sent once and Send returns
+// a nil reply.
+//
+// When the device replies with an AES challenge, Send signs pkt using
+// the requested key (see SetKeys) and returns the device’s reply to the
+// signature.
+//
+// When no reply arrives within s.ReplyTimeout, Send retransmits pkt
+// unchanged, waiting s.RetryBackoff (doubled after
+// every attempt) before each retransmission. The same applies when the
+// gateway reports that the device did not acknowledge pkt (ErrNoAck).
+// After s.Attempts attempts, Send returns a *NoReplyError.
+func (s *Sender) Send(ctx context.Context, pkt *Packet) (*Packet, error) {
+	if pkt.Msgcnt == 0 {
+		pkt.Msgcnt = nextMessageCounter()
+	}
+	if pkt.Flags&BiDi == 0 {
+		return nil, s.WritePacket(pkt)
+	}
+	r := s.Receive(func(reply *Packet) bool {
+		return reply.Source == pkt.Dest &&
+			reply.Msgcnt == pkt.Msgcnt &&
+			(reply.Cmd == Ack || reply.Cmd == Info)
+	})
+	defer r.Close()
+
+	attempts := s.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	backoff := s.RetryBackoff
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			retransmissions.With(prometheus.Labels{"address": fmt.Sprintf("%x", pkt.Dest)}).Inc()
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			backoff *= 2
+			// The device may have missed our packet or we may have
+			// missed its reply, so we keep the message counter.
+		}
+
+		if err := s.WritePacket(pkt); err != nil {
+			if errors.Is(err, ErrNoAck) {
+				// The gateway already waited for the device’s reply.
+				continue
+			}
+			return nil, err
+		}
+
+		attemptCtx, cancel := context.WithTimeout(ctx, s.ReplyTimeout)
+		reply, err := r.Next(attemptCtx)
+		cancel()
+		if err == nil && reply.isChallenge() {
+			if err := s.answerChallenge(pkt, reply); err != nil {
+				return nil, err
+			}
+			attemptCtx, cancel := context.WithTimeout(ctx, s.ReplyTimeout)
+			reply, err = r.Next(attemptCtx)
+			cancel()
+		}
+		if err == nil {
+			return reply, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if !errors.Is(err, context.DeadlineExceeded) {
+			return nil, err
+		}
 	}
-	return s.Gateway.Confirm()
+	sendFailures.With(prometheus.Labels{"address": fmt.Sprintf("%x", pkt.Dest)}).Inc()
+	return nil, &NoReplyError{Dest: pkt.Dest, Msgcnt: pkt.Msgcnt, Attempts: attempts}
 }
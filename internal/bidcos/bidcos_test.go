@@ -0,0 +1,450 @@
+package bidcos_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stapelberg/hmgo/internal/bidcos"
+)
+
+// testGateway delivers the packets written to incoming via Read.
+type testGateway struct {
+	incoming chan []byte
+	written  chan []byte
+}
+
+func newTestGateway() *testGateway {
+	return &testGateway{
+		incoming: make(chan []byte),
+		written:  make(chan []byte, 16),
+	}
+}
+
+func (t *testGateway) Read(p []byte) (n int, err error) {
+	b, ok := <-t.incoming
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(p, b), nil
+}
+
+func (t *testGateway) Write(p []byte) (n int, err error) {
+	t.written <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func (t *testGateway) Confirm() error {
+	return nil
+}
+
+var (
+	hmid     = [3]byte{0xfd, 0xee, 0xdd}
+	thermal  = [3]byte{0x39, 0x06, 0xeb}
+	thermal2 = [3]byte{0x39, 0x0f, 0x17}
+)
+
+func packet(src [3]byte, cmd byte, payload ...byte) *bidcos.Packet {
+	return &bidcos.Packet{
+		Msgcnt:  0x42,
+		Flags:   bidcos.DefaultFlags,
+		Cmd:     cmd,
+		Source:  src,
+		Dest:    hmid,
+		Payload: payload,
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	gw := newTestGateway()
+	bcs, err := bidcos.NewSender(gw, hmid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := bcs.Subscribe()
+
+	r := bcs.Receive(bidcos.From(thermal, bidcos.Info))
+	defer r.Close()
+
+	// A weather event of the device we are waiting for, a config
+	// response from a different device and the response we are
+	// waiting for.
+	gw.incoming <- packet(thermal, bidcos.WeatherEvent, 0, 253, 57).Encode()
+	gw.incoming <- packet(thermal2, bidcos.Info, bidcos.InfoPeerList, 0, 0, 0, 0).Encode()
+	gw.incoming <- packet(thermal, bidcos.Info, bidcos.InfoPeerList, 0, 0, 0, 0).Encode()
+
+	pkt, err := r.Next(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := pkt.Source, thermal; got != want {
+		t.Fatalf("unexpected source: got %x, want %x", got, want)
+	}
+
+	for _, want := range []struct {
+		src [3]byte
+		cmd byte
+	}{
+		{thermal, bidcos.WeatherEvent},
+		{thermal2, bidcos.Info},
+	} {
+		pkt := <-events
+		if pkt.Source != want.src || pkt.Cmd != want.cmd {
+			t.Fatalf("unexpected event: got %x from %x, want %x from %x", pkt.Cmd, pkt.Source, want.cmd, want.src)
+		}
+	}
+
+	close(gw.incoming)
+	if _, ok := <-events; ok {
+		t.Fatalf("events channel unexpectedly not closed")
+	}
+	if got, want := fmt.Sprint(bcs.Err()), io.EOF.Error(); got != want {
+		t.Fatalf("unexpected error: got %v, want %v", got, want)
+	}
+	if _, err := r.Next(context.Background()); err != io.EOF {
+		t.Fatalf("unexpected error: got %v, want %v", err, io.EOF)
+	}
+}
+
+func TestSend(t *testing.T) {
+	gw := newTestGateway()
+	bcs, err := bidcos.NewSender(gw, hmid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(gw.incoming)
+	events := bcs.Subscribe()
+
+	type result struct {
+		pkt *bidcos.Packet
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		pkt, err := bcs.Send(context.Background(), &bidcos.Packet{
+			Msgcnt:  0x42,
+			Flags:   bidcos.DefaultFlags,
+			Cmd:     bidcos.Config,
+			Dest:    thermal,
+			Payload: []byte{0x00, bidcos.ConfigPeerListReq},
+		})
+		done <- result{pkt, err}
+	}()
+	<-gw.written
+
+	// An Ack with a different message counter (e.g. for a previous
+	// request) must not be mistaken for the reply.
+	stale := packet(thermal, bidcos.Ack, bidcos.AckOK)
+	stale.Msgcnt = 0x41
+	gw.incoming <- stale.Encode()
+	gw.incoming <- packet(thermal, bidcos.Info, bidcos.InfoPeerList, 0, 0, 0, 0).Encode()
+
+	res := <-done
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if got, want := res.pkt.Cmd, byte(bidcos.Info); got != want {
+		t.Fatalf("unexpected reply: got cmd %x, want %x", got, want)
+	}
+	if pkt := <-events; pkt.Msgcnt != stale.Msgcnt {
+		t.Fatalf("unexpected event: got msgcnt %x, want %x", pkt.Msgcnt, stale.Msgcnt)
+	}
+}
+
+func TestSendRetransmit(t *testing.T) {
+	gw := newTestGateway()
+	bcs, err := bidcos.NewSender(gw, hmid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(gw.incoming)
+	bcs.ReplyTimeout = 10 * time.Millisecond
+	bcs.RetryBackoff = time.Millisecond
+
+	done := make(chan error)
+	go func() {
+		_, err := bcs.Send(context.Background(), &bidcos.Packet{
+			Msgcnt: 0x42,
+			Flags:  bidcos.DefaultFlags,
+			Cmd:    bidcos.Config,
+			Dest:   thermal,
+		})
+		done <- err
+	}()
+
+	// Ignore the first attempt, reply to the second one.
+	for attempt := 1; attempt <= 2; attempt++ {
+		pkt, err := bidcos.Decode(<-gw.written)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := pkt.Msgcnt, uint8(0x42); got != want {
+			t.Fatalf("attempt %d: unexpected msgcnt: got %x, want %x", attempt, got, want)
+		}
+		if got, want := pkt.Flags, bidcos.DefaultFlags; got != want {
+			t.Fatalf("attempt %d: unexpected flags: got %x, want %x", attempt, got, want)
+		}
+	}
+	gw.incoming <- packet(thermal, bidcos.Ack, bidcos.AckOK).Encode()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSendNoReply(t *testing.T) {
+	gw := newTestGateway()
+	bcs, err := bidcos.NewSender(gw, hmid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(gw.incoming)
+	bcs.ReplyTimeout = 10 * time.Millisecond
+	bcs.RetryBackoff = time.Millisecond
+
+	_, err = bcs.Send(context.Background(), &bidcos.Packet{
+		Msgcnt: 0x42,
+		Flags:  bidcos.DefaultFlags,
+		Cmd:    bidcos.Config,
+		Dest:   thermal,
+	})
+	var nre *bidcos.NoReplyError
+	if !errors.As(err, &nre) {
+		t.Fatalf("unexpected error: got %v, want *bidcos.NoReplyError", err)
+	}
+	if nre.Dest != thermal || nre.Msgcnt != 0x42 || nre.Attempts != bidcos.DefaultAttempts {
+		t.Fatalf("unexpected error contents: got %+v", nre)
+	}
+	if got, want := len(gw.written), bidcos.DefaultAttempts; got != want {
+		t.Fatalf("unexpected number of transmissions: got %d, want %d", got, want)
+	}
+}
+
+// creditGateway is a testGateway which reports the specified credits
+// and confirm errors, in order.
+type creditGateway struct {
+	*testGateway
+	credits  []float64
+	confirms []error
+	queries  int
+}
+
+func (c *creditGateway) Credits() (float64, error) {
+	c.queries++
+	credits := c.credits[0]
+	if len(c.credits) > 1 {
+		c.credits = c.credits[1:]
+	}
+	return credits, nil
+}
+
+func (c *creditGateway) Confirm() error {
+	if len(c.confirms) == 0 {
+		return nil
+	}
+	err := c.confirms[0]
+	c.confirms = c.confirms[1:]
+	return err
+}
+
+func TestWritePacketThrottle(t *testing.T) {
+	gw := &creditGateway{
+		testGateway: newTestGateway(),
+		credits:     []float64{5, 50},
+		confirms:    []error{fmt.Errorf("wrapped: %w", bidcos.ErrNoCredits)},
+	}
+	defer close(gw.incoming)
+	bcs, err := bidcos.NewSender(gw, hmid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcs.CreditWait = time.Millisecond
+
+	if err := bcs.WritePacket(packet(thermal, bidcos.Config)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(gw.written), 2; got != want {
+		t.Fatalf("unexpected number of transmissions: got %d, want %d", got, want)
+	}
+	if got := len(gw.credits); got != 1 {
+		t.Fatalf("WritePacket did not wait for credits to recover")
+	}
+}
+
+func TestWritePacketCachesCredits(t *testing.T) {
+	gw := &creditGateway{
+		testGateway: newTestGateway(),
+		credits:     []float64{50},
+	}
+	defer close(gw.incoming)
+	bcs, err := bidcos.NewSender(gw, hmid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := bcs.WritePacket(packet(thermal, bidcos.Config)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := gw.queries, 1; got != want {
+		t.Fatalf("unexpected number of credit queries: got %d, want %d", got, want)
+	}
+
+	bcs.CreditInterval = 0
+	if err := bcs.WritePacket(packet(thermal, bidcos.Config)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := gw.queries, 2; got != want {
+		t.Fatalf("credits not queried again after CreditInterval: got %d queries, want %d", got, want)
+	}
+}
+
+func TestSendNoAck(t *testing.T) {
+	gw := &creditGateway{
+		testGateway: newTestGateway(),
+		credits:     []float64{100},
+		confirms: []error{
+			fmt.Errorf("wrapped: %w", bidcos.ErrNoAck),
+			fmt.Errorf("wrapped: %w", bidcos.ErrNoAck),
+			fmt.Errorf("wrapped: %w", bidcos.ErrNoAck),
+		},
+	}
+	defer close(gw.incoming)
+	bcs, err := bidcos.NewSender(gw, hmid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcs.RetryBackoff = time.Millisecond
+
+	// Send must neither wait for a reply after the gateway reported that
+	// the device did not acknowledge the packet, nor give up right away.
+	bcs.ReplyTimeout = time.Hour
+	_, err = bcs.Send(context.Background(), &bidcos.Packet{
+		Msgcnt: 0x42,
+		Flags:  bidcos.DefaultFlags,
+		Cmd:    bidcos.Config,
+		Dest:   thermal,
+	})
+	var nre *bidcos.NoReplyError
+	if !errors.As(err, &nre) {
+		t.Fatalf("unexpected error: got %v, want *bidcos.NoReplyError", err)
+	}
+	if got, want := len(gw.written), bidcos.DefaultAttempts; got != want {
+		t.Fatalf("unexpected number of transmissions: got %d, want %d", got, want)
+	}
+}
+
+func TestWritePacketGatewayReset(t *testing.T) {
+	gw := &creditGateway{
+		testGateway: newTestGateway(),
+		credits:     []float64{100},
+		confirms: []error{
+			fmt.Errorf("wrapped: %w", bidcos.ErrGatewayReset),
+			fmt.Errorf("wrapped: %w", bidcos.ErrGatewayReset),
+		},
+	}
+	defer close(gw.incoming)
+	bcs, err := bidcos.NewSender(gw, hmid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The packet is repeated once, then the error is returned.
+	if err := bcs.WritePacket(packet(thermal, bidcos.Config)); !errors.Is(err, bidcos.ErrGatewayReset) {
+		t.Fatalf("unexpected error: got %v, want %v", err, bidcos.ErrGatewayReset)
+	}
+	if got, want := len(gw.written), 2; got != want {
+		t.Fatalf("unexpected number of transmissions: got %d, want %d", got, want)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	for _, tt := range []struct {
+		name         string
+		b            []byte
+		wantRSSI     int
+		wantAES      bool
+		wantWrongKey bool
+		wantRepeated bool
+	}{
+		{
+			name:     "Plain",
+			b:        []byte{0x00, 0x00, 0x3c, 0x42, 0x86, 0x70, 0x39, 0x06, 0xeb, 0x00, 0x00, 0x00, 0x00, 0xfd, 0x39},
+			wantRSSI: -60,
+		},
+		{
+			name:         "RepeatedAES",
+			b:            []byte{0x01, 0x00, 0x8a, 0x42, 0xc6, 0x70, 0x39, 0x06, 0xeb, 0x00, 0x00, 0x00, 0x00, 0xfd, 0x39},
+			wantRSSI:     -138,
+			wantAES:      true,
+			wantRepeated: true,
+		},
+		{
+			name:         "WrongKey",
+			b:            []byte{0x02, 0x00, 0x0b, 0x42, 0x86, 0x70, 0x39, 0x06, 0xeb, 0x00, 0x00, 0x00, 0x00, 0xfd, 0x39},
+			wantRSSI:     -11,
+			wantWrongKey: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			pkt, err := bidcos.Decode(tt.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := pkt.RSSI, tt.wantRSSI; got != want {
+				t.Errorf("RSSI: got %d, want %d", got, want)
+			}
+			if got, want := pkt.AES(), tt.wantAES; got != want {
+				t.Errorf("AES: got %v, want %v", got, want)
+			}
+			if got, want := pkt.WrongKey(), tt.wantWrongKey; got != want {
+				t.Errorf("WrongKey: got %v, want %v", got, want)
+			}
+			if got, want := pkt.IsRepeated(), tt.wantRepeated; got != want {
+				t.Errorf("IsRepeated: got %v, want %v", got, want)
+			}
+			if got, want := pkt.Cmd, byte(bidcos.WeatherEvent); got != want {
+				t.Errorf("Cmd: got %x, want %x", got, want)
+			}
+		})
+	}
+}
+
+func TestSendPicksMsgcnt(t *testing.T) {
+	gw := newTestGateway()
+	bcs, err := bidcos.NewSender(gw, hmid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(gw.incoming)
+
+	// The message counter advances by 9, so it wraps around to 0 within
+	// 256 packets. 0 must be skipped: Send would wait for a reply to
+	// message 0 while the packet is sent with the next counter.
+	for i := 0; i < 257; i++ {
+		done := make(chan error)
+		go func() {
+			_, err := bcs.Send(context.Background(), &bidcos.Packet{
+				Flags: bidcos.DefaultFlags,
+				Cmd:   bidcos.Config,
+				Dest:  thermal,
+			})
+			done <- err
+		}()
+		sent, err := bidcos.Decode(<-gw.written)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sent.Msgcnt == 0 {
+			t.Fatalf("packet %d sent with message counter 0", i)
+		}
+		ack := packet(thermal, bidcos.Ack, bidcos.AckOK)
+		ack.Msgcnt = sent.Msgcnt
+		gw.incoming <- ack.Encode()
+		if err := <-done; err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+	}
+}
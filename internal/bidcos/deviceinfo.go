@@ -0,0 +1,67 @@
+package bidcos
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// DeviceInfoFrame is the payload of a DeviceInfo packet, which devices
+// send when their pairing button is pressed.
+//
+// c.f. https://github.com/Homegear/Homegear-HomeMaticBidCoS/blob/5255288954f3da42e12fa72a06963b99089d323f/src/HomeMaticCentral.cpp#L2997
+type DeviceInfoFrame struct {
+	Firmware byte   // e.g. 0x12 for version 1.2
+	Model    uint16 // e.g. 0x00ad for HM-TC-IT-WM-W-EU
+	Serial   string // e.g. MEQ0089016
+
+	// Class is the device class, e.g. 0x58 for climate control
+	// devices such as the HM-CC-RT-DN.
+	Class byte
+
+	// PeerChannels are the numbers of channels which can be peered,
+	// as two 4 bit counts per byte.
+	PeerChannels [2]byte
+
+	// Descriptor contains the remaining bytes, whose meaning depends on
+	// the model.
+	Descriptor []byte
+}
+
+// deviceInfoLen is the length of a DeviceInfo payload without
+// Descriptor.
+const deviceInfoLen = 1 + 2 + 10 + 1 + 2
+
+// DecodeDeviceInfo decodes the payload of a DeviceInfo packet.
+func DecodeDeviceInfo(payload []byte) (*DeviceInfoFrame, error) {
+	if got, want := len(payload), deviceInfoLen; got < want {
+		return nil, fmt.Errorf("unexpectedly short DeviceInfo payload: got %d, want >= %d", got, want)
+	}
+	f := &DeviceInfoFrame{
+		Firmware:     payload[0],
+		Model:        binary.BigEndian.Uint16(payload[1 : 1+2]),
+		Serial:       string(payload[3 : 3+10]),
+		Class:        payload[13],
+		PeerChannels: [2]byte{payload[14], payload[15]},
+	}
+	if rest := payload[deviceInfoLen:]; len(rest) > 0 {
+		f.Descriptor = append([]byte(nil), rest...)
+	}
+	return f, nil
+}
+
+// Encode returns the DeviceInfo packet payload for f.
+func (f *DeviceInfoFrame) Encode() []byte {
+	b := make([]byte, deviceInfoLen, deviceInfoLen+len(f.Descriptor))
+	b[0] = f.Firmware
+	binary.BigEndian.PutUint16(b[1:1+2], f.Model)
+	copy(b[3:3+10], f.Serial)
+	b[13] = f.Class
+	b[14] = f.PeerChannels[0]
+	b[15] = f.PeerChannels[1]
+	return append(b, f.Descriptor...)
+}
+
+// FirmwareVersion returns the firmware version, e.g. 1.2.
+func (f *DeviceInfoFrame) FirmwareVersion() string {
+	return fmt.Sprintf("%d.%d", f.Firmware>>4, f.Firmware&0x0f)
+}
@@ -0,0 +1,92 @@
+package bidcos_test
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+
+	"github.com/stapelberg/hmgo/internal/bidcos"
+)
+
+func TestDecodeDeviceInfo(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		payload string
+		want    *bidcos.DeviceInfoFrame
+		wantFW  string
+	}{
+		{
+			// c.f. the “peer request (fw 18, typ 173, serial MEQ0089016)”
+			// log message in ccu.go
+			name:    "HM-TC-IT-WM-W-EU",
+			payload: "1200ad4d455130303839303136" + "10" + "0103" + "00",
+			want: &bidcos.DeviceInfoFrame{
+				Firmware:     0x12,
+				Model:        0x00ad,
+				Serial:       "MEQ0089016",
+				Class:        0x10,
+				PeerChannels: [2]byte{0x01, 0x03},
+				Descriptor:   []byte{0x00},
+			},
+			wantFW: "1.2",
+		},
+
+		{
+			name:    "HM-CC-RT-DN",
+			payload: "1400954d455130303539393232" + "58" + "0300" + "00",
+			want: &bidcos.DeviceInfoFrame{
+				Firmware:     0x14,
+				Model:        0x0095,
+				Serial:       "MEQ0059922",
+				Class:        0x58,
+				PeerChannels: [2]byte{0x03, 0x00},
+				Descriptor:   []byte{0x00},
+			},
+			wantFW: "1.4",
+		},
+
+		{
+			name:    "NoDescriptor",
+			payload: "1300ac4d455131323334353637" + "10" + "0100",
+			want: &bidcos.DeviceInfoFrame{
+				Firmware:     0x13,
+				Model:        0x00ac,
+				Serial:       "MEQ1234567",
+				Class:        0x10,
+				PeerChannels: [2]byte{0x01, 0x00},
+			},
+			wantFW: "1.3",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := hex.DecodeString(tt.payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := bidcos.DecodeDeviceInfo(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("unexpected DecodeDeviceInfo result: got %+v, want %+v", got, tt.want)
+			}
+			if got, want := got.FirmwareVersion(), tt.wantFW; got != want {
+				t.Errorf("unexpected firmware version: got %q, want %q", got, want)
+			}
+			if got, want := got.Encode(), payload; !reflect.DeepEqual(got, want) {
+				t.Errorf("unexpected Encode result: got %x, want %x", got, want)
+			}
+		})
+	}
+}
+
+func TestDecodeDeviceInfoShort(t *testing.T) {
+	// Only firmware, model and serial.
+	payload, err := hex.DecodeString("1200ad4d455130303839303136")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bidcos.DecodeDeviceInfo(payload); err == nil {
+		t.Fatalf("DecodeDeviceInfo unexpectedly succeeded")
+	}
+}
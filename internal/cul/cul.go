@@ -0,0 +1,380 @@
+// Package cul talks to a CUL (or nanoCUL) USB radio stick running
+// culfw, which sends and receives BidCoS packets in its “AskSin” mode.
+//
+// culfw is controlled with ASCII lines. The relevant commands are:
+//
+//	V                        version, e.g. “V 1.67 CUL868”
+//	X21                      report received packets including RSSI
+//	Ar                       enable AskSin (BidCoS) receive mode
+//	As0A42A001FDB02C3906EB00  send a packet (length, then the packet)
+//
+// Received packets are reported as “A” lines, followed by the length,
+// the packet and the RSSI byte, e.g. A0C4286703906EB00000000FD3938.
+// When culfw exceeds its duty cycle budget, it reports LOVF instead of
+// sending.
+//
+// Unlike the HM-MOD-RPI-PCB, culfw neither acknowledges packets of
+// peers nor reports whether the destination acknowledged a sent
+// packet, so CUL does both itself. culfw does not handle AES either:
+// CUL rejects AES devices, see AddPeerAES.
+//
+// c.f. http://culfw.de/commandref.html
+package cul
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stapelberg/hmgo/internal/bidcos"
+)
+
+// ConfirmTimeout is how long Confirm waits for culfw to report that it
+// could not send a packet.
+var ConfirmTimeout = 50 * time.Millisecond
+
+// AckTimeout is how long Confirm waits for the destination of a BiDi
+// packet to reply.
+var AckTimeout = 1 * time.Second
+
+// CUL is a CUL stick. It implements bidcos.Gateway.
+type CUL struct {
+	w  io.Writer
+	br *bufio.Reader
+
+	// HMID is the BidCoS address of the central.
+	HMID [3]byte
+
+	// Version is the culfw version as reported by the stick.
+	Version string
+
+	// writeMu serializes writing lines.
+	writeMu sync.Mutex
+
+	mu sync.Mutex
+	// peers contains the addresses of the devices whose packets are
+	// acknowledged, see AddPeer.
+	peers map[[3]byte]bool
+	// sent is the packet of the most recent Write call, whose reply
+	// Confirm waits for if it is a BiDi packet.
+	sent sentPacket
+
+	// acked receives a value when the destination of the sent packet
+	// replies.
+	acked chan struct{}
+
+	// received receives the packets of A lines, encoded like
+	// bidcos.Packet.Encode.
+	received chan []byte
+
+	// lovf receives a value when culfw reports LOVF.
+	lovf chan struct{}
+
+	// done is closed when the reader goroutine exits, after setting
+	// readErr.
+	done    chan struct{}
+	readErr error
+}
+
+// sentPacket identifies a packet sent by Write.
+type sentPacket struct {
+	dest   [3]byte
+	msgcnt byte
+	bidi   bool
+}
+
+// NewCUL switches the CUL connected via port to BidCoS mode. It starts
+// a goroutine which reads from port until reading fails.
+func NewCUL(port io.ReadWriter, HMID [3]byte) (*CUL, error) {
+	c := &CUL{
+		w:        port,
+		br:       bufio.NewReader(port),
+		HMID:     HMID,
+		peers:    make(map[[3]byte]bool),
+		received: make(chan []byte, 64),
+		lovf:     make(chan struct{}, 1),
+		acked:    make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+func (c *CUL) init() error {
+	if err := c.writeLine("V"); err != nil {
+		return err
+	}
+	// Skip any lines which were received before, e.g. in a different
+	// mode.
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(line, "V ") {
+			c.Version = strings.TrimPrefix(line, "V ")
+			break
+		}
+	}
+	for _, line := range []string{"X21", "Ar"} {
+		if err := c.writeLine(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *CUL) readLine() (string, error) {
+	line, err := c.br.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (c *CUL) writeLine(line string) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := io.WriteString(c.w, line+"\r\n")
+	return err
+}
+
+// DecodeRSSI converts the RSSI byte of culfw (the CC1101 register
+// value) to dBm.
+func DecodeRSSI(raw byte) int {
+	// c.f. CUL_HM_parseCommon / CUL_RSSI in FHEM 10_CUL_HM.pm
+	if raw >= 128 {
+		return (int(raw)-256)/2 - 74
+	}
+	return int(raw)/2 - 74
+}
+
+// decodePacket decodes an A line into a packet encoded like
+// bidcos.Packet.Encode.
+func decodePacket(line string) ([]byte, error) {
+	b, err := hex.DecodeString(line[1:])
+	if err != nil {
+		return nil, err
+	}
+	if got, want := len(b), 1+9+1; got < want {
+		return nil, fmt.Errorf("too short: got %d bytes, want >= %d", got, want)
+	}
+	length := int(b[0])
+	if got, want := len(b), 1+length+1; got != want {
+		return nil, fmt.Errorf("length mismatch: got %d bytes, want %d", got, want)
+	}
+	rssi := -DecodeRSSI(b[len(b)-1])
+	if rssi < 0 || rssi > 255 {
+		rssi = 0
+	}
+	return append([]byte{0x00, 0x00, byte(rssi)}, b[1:1+length]...), nil
+}
+
+func (c *CUL) readLoop() {
+	defer close(c.done)
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			c.readErr = err
+			return
+		}
+		switch {
+		case line == "":
+
+		case line == "LOVF":
+			select {
+			case c.lovf <- struct{}{}:
+			default:
+			}
+
+		case strings.HasPrefix(line, "A"):
+			b, err := decodePacket(line)
+			if err != nil {
+				log.Printf("skipping invalid culfw line %q: %v", line, err)
+				continue
+			}
+			c.acknowledge(b)
+			c.trackReply(b)
+			select {
+			case c.received <- b:
+			default:
+				log.Printf("CUL receive buffer full, dropping packet %x", b)
+			}
+
+		default:
+			log.Printf("ignoring culfw line %q", line)
+		}
+	}
+}
+
+// acknowledge sends an Ack for the packet b if it was sent to us by a
+// peer which expects one, like the HM-MOD-RPI-PCB does.
+func (c *CUL) acknowledge(b []byte) {
+	pkt, err := bidcos.Decode(b)
+	if err != nil {
+		return
+	}
+	if pkt.Dest != c.HMID || pkt.Flags&bidcos.BiDi == 0 {
+		return
+	}
+	switch pkt.Cmd {
+	case bidcos.Ack, bidcos.AESReply:
+		// Replies to our own packets are not acknowledged.
+		return
+	}
+	c.mu.Lock()
+	peer := c.peers[pkt.Source]
+	c.mu.Unlock()
+	if !peer {
+		return
+	}
+	ack := &bidcos.Packet{
+		Msgcnt:  pkt.Msgcnt,
+		Flags:   bidcos.RepeatEnable,
+		Cmd:     bidcos.Ack,
+		Source:  c.HMID,
+		Dest:    pkt.Source,
+		Payload: []byte{bidcos.AckOK},
+	}
+	if err := c.send(ack.Encode()[3:]); err != nil {
+		log.Printf("acknowledging packet from %x: %v", pkt.Source, err)
+	}
+}
+
+// trackReply notes whether the packet b is the reply to the most
+// recently sent BiDi packet, see Confirm.
+func (c *CUL) trackReply(b []byte) {
+	pkt, err := bidcos.Decode(b)
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	sent := c.sent
+	c.mu.Unlock()
+	if !sent.bidi || pkt.Source != sent.dest || pkt.Dest != c.HMID || pkt.Msgcnt != sent.msgcnt {
+		return
+	}
+	select {
+	case c.acked <- struct{}{}:
+	default:
+	}
+}
+
+// Read implements io.Reader so that a CUL can be used by the bidcos
+// package.
+func (c *CUL) Read(p []byte) (n int, err error) {
+	select {
+	case b := <-c.received:
+		return copy(p, b), nil
+	case <-c.done:
+		return 0, c.readErr
+	}
+}
+
+// Write sends the BidCoS packet p, encoded by bidcos.Packet.Encode.
+func (c *CUL) Write(p []byte) (n int, err error) {
+	if got, want := len(p), 12; got < want {
+		return 0, fmt.Errorf("too short for a bidcos packet: got %d, want >= %d", got, want)
+	}
+	// Discard an LOVF or reply which was reported for a previous
+	// packet.
+	select {
+	case <-c.lovf:
+	default:
+	}
+	select {
+	case <-c.acked:
+	default:
+	}
+	c.mu.Lock()
+	c.sent = sentPacket{
+		dest:   [3]byte{p[9], p[10], p[11]},
+		msgcnt: p[3],
+		bidi:   p[4]&bidcos.BiDi != 0,
+	}
+	c.mu.Unlock()
+	// Skip status, info and burst: culfw determines whether to send a
+	// burst from the flags.
+	if err := c.send(p[3:]); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// send sends the BidCoS packet msg, starting with the message counter.
+func (c *CUL) send(msg []byte) error {
+	return c.writeLine(fmt.Sprintf("As%02X%X", len(msg), msg))
+}
+
+// Confirm implements bidcos.Gateway. culfw does not confirm sending a
+// packet, but reports LOVF right away when its duty cycle budget is
+// exhausted. For a BiDi packet, Confirm waits for the destination’s
+// reply like the HM-MOD-RPI-PCB does, and returns bidcos.ErrNoAck if
+// none arrives.
+func (c *CUL) Confirm() error {
+	c.mu.Lock()
+	bidi := c.sent.bidi
+	c.mu.Unlock()
+	if !bidi {
+		select {
+		case <-c.lovf:
+			return bidcos.ErrNoCredits
+		case <-time.After(ConfirmTimeout):
+			return nil
+		}
+	}
+	select {
+	case <-c.lovf:
+		return bidcos.ErrNoCredits
+	case <-c.acked:
+		return nil
+	case <-time.After(AckTimeout):
+		return fmt.Errorf("CUL: %w", bidcos.ErrNoAck)
+	case <-c.done:
+		return c.readErr
+	}
+}
+
+// AddPeer makes the CUL acknowledge packets of the device with BidCoS
+// address addr.
+func (c *CUL) AddPeer(addr []byte, channels int) error {
+	if got, want := len(addr), 3; got != want {
+		return fmt.Errorf("unexpected address length: got %d, want %d", got, want)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.peers[[3]byte{addr[0], addr[1], addr[2]}] = true
+	return nil
+}
+
+// AddPeerAES returns an error: culfw does not verify AES signatures of
+// received packets.
+func (c *CUL) AddPeerAES(addr []byte, channels int) error {
+	return fmt.Errorf("AES devices are not supported with a CUL")
+}
+
+// RemovePeer stops acknowledging packets of the device with BidCoS
+// address addr.
+func (c *CUL) RemovePeer(addr [3]byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.peers, addr)
+	return nil
+}
+
+// SetTime is a no-op: culfw does not keep time.
+func (c *CUL) SetTime(now time.Time) error { return nil }
+
+// SetCurrentKey, SetPreviousKey and SetTempKey are no-ops: CUL
+// rejects AES devices, see AddPeerAES.
+func (c *CUL) SetCurrentKey(k bidcos.Key) error  { return nil }
+func (c *CUL) SetPreviousKey(k bidcos.Key) error { return nil }
+func (c *CUL) SetTempKey(k bidcos.Key) error     { return nil }
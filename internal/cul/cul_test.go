@@ -0,0 +1,188 @@
+package cul_test
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stapelberg/hmgo/internal/bidcos"
+	"github.com/stapelberg/hmgo/internal/cul"
+)
+
+var (
+	hmid    = [3]byte{0xfd, 0xb0, 0x2c}
+	thermal = [3]byte{0x39, 0x06, 0xeb}
+)
+
+// port connects a CUL to a simulated culfw.
+type port struct {
+	io.Reader
+	io.Writer
+}
+
+// fakeCulfw returns a port for NewCUL, the writer on which the
+// simulated culfw sends its lines and a reader of the lines it
+// receives.
+func fakeCulfw() (*port, io.Writer, *bufio.Reader) {
+	toCUL, fromCulfw := io.Pipe()
+	toCulfw, fromCUL := io.Pipe()
+	return &port{Reader: toCUL, Writer: fromCUL}, fromCulfw, bufio.NewReader(toCulfw)
+}
+
+func readLine(t *testing.T, br *bufio.Reader) string {
+	t.Helper()
+	line, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimRight(line, "\r\n")
+}
+
+func TestMain(m *testing.M) {
+	// Leave the simulated culfw enough time to report LOVF.
+	cul.ConfirmTimeout = 200 * time.Millisecond
+	cul.AckTimeout = 200 * time.Millisecond
+	os.Exit(m.Run())
+}
+
+func TestCUL(t *testing.T) {
+	p, culfw, lines := fakeCulfw()
+
+	done := make(chan *cul.CUL)
+	go func() {
+		c, err := cul.NewCUL(p, hmid)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- c
+	}()
+
+	if got, want := readLine(t, lines), "V"; got != want {
+		t.Fatalf("unexpected line: got %q, want %q", got, want)
+	}
+	// A packet received before the stick was switched to BidCoS mode
+	// is skipped.
+	io.WriteString(culfw, "p 1 2 3\r\nV 1.67 CUL868\r\n")
+	for _, want := range []string{"X21", "Ar"} {
+		if got := readLine(t, lines); got != want {
+			t.Fatalf("unexpected line: got %q, want %q", got, want)
+		}
+	}
+	c := <-done
+	if c == nil {
+		t.FailNow()
+	}
+	if got, want := c.Version, "1.67 CUL868"; got != want {
+		t.Fatalf("unexpected version: got %q, want %q", got, want)
+	}
+
+	bcs, err := bidcos.NewSender(c, hmid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := bcs.Subscribe()
+	if err := c.AddPeer(thermal[:], 2); err != nil {
+		t.Fatal(err)
+	}
+
+	// A weather event with BiDi flag from a peer must be acknowledged.
+	io.WriteString(culfw, "A0C42A6703906EBFDB02C00FD3938\r\n")
+	if got, want := readLine(t, lines), "As0A428002FDB02C3906EB00"; got != want {
+		t.Fatalf("unexpected ack: got %q, want %q", got, want)
+	}
+	pkt := <-events
+	if got, want := pkt.Cmd, byte(bidcos.WeatherEvent); got != want {
+		t.Fatalf("unexpected cmd: got %x, want %x", got, want)
+	}
+	if got, want := pkt.RSSI, -46; got != want {
+		t.Fatalf("unexpected RSSI: got %d, want %d", got, want)
+	}
+
+	// culfw reports LOVF in response to a packet.
+	bcs.CreditWait = 0
+	writeErr := make(chan error)
+	go func() {
+		writeErr <- bcs.WritePacket(&bidcos.Packet{
+			Msgcnt:  0x43,
+			Flags:   bidcos.DefaultFlags,
+			Cmd:     bidcos.Config,
+			Dest:    thermal,
+			Payload: []byte{0x00, 0x03},
+		})
+	}()
+	if got, want := readLine(t, lines), "As0B43A001FDB02C3906EB0003"; got != want {
+		t.Fatalf("unexpected line: got %q, want %q", got, want)
+	}
+	io.WriteString(culfw, "LOVF\r\n")
+	// WritePacket retries after an exhausted duty cycle budget.
+	if got, want := readLine(t, lines), "As0B43A001FDB02C3906EB0003"; got != want {
+		t.Fatalf("unexpected line: got %q, want %q", got, want)
+	}
+	// The device acknowledges the packet.
+	io.WriteString(culfw, "A0A4380023906EBFDB02C0038\r\n")
+	if err := <-writeErr; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfirmNoAck(t *testing.T) {
+	p, culfw, lines := fakeCulfw()
+	go func() {
+		lines.ReadString('\n')
+		io.WriteString(culfw, "V 1.67 CUL868\r\n")
+		io.Copy(io.Discard, lines)
+	}()
+	c, err := cul.NewCUL(p, hmid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt := &bidcos.Packet{Msgcnt: 1, Flags: bidcos.DefaultFlags, Cmd: bidcos.Config, Source: hmid, Dest: thermal}
+	if _, err := c.Write(pkt.Encode()); err != nil {
+		t.Fatal(err)
+	}
+	// A reply to a different message is not an acknowledgement.
+	io.WriteString(culfw, "A0A0280023906EBFDB02C0038\r\n")
+	if err := c.Confirm(); !errors.Is(err, bidcos.ErrNoAck) {
+		t.Fatalf("unexpected error: got %v, want %v", err, bidcos.ErrNoAck)
+	}
+}
+
+func TestConfirmNoCredits(t *testing.T) {
+	p, culfw, lines := fakeCulfw()
+	go func() {
+		lines.ReadString('\n')
+		io.WriteString(culfw, "V 1.67 CUL868\r\n")
+		io.Copy(io.Discard, lines)
+	}()
+	c, err := cul.NewCUL(p, hmid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write((&bidcos.Packet{Msgcnt: 1, Cmd: bidcos.Config, Source: hmid, Dest: thermal}).Encode()); err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(culfw, "LOVF\r\n")
+	if err := c.Confirm(); !errors.Is(err, bidcos.ErrNoCredits) {
+		t.Fatalf("unexpected error: got %v, want %v", err, bidcos.ErrNoCredits)
+	}
+}
+
+func TestDecodeRSSI(t *testing.T) {
+	for _, tt := range []struct {
+		raw  byte
+		want int
+	}{
+		{0x00, -74},
+		{0x38, -46},
+		{0x80, -138},
+		{0xff, -74},
+	} {
+		if got := cul.DecodeRSSI(tt.raw); got != tt.want {
+			t.Errorf("DecodeRSSI(%#x) = %d, want %d", tt.raw, got, tt.want)
+		}
+	}
+}
@@ -28,6 +28,14 @@ func NewThermostat(sd hm.StandardDevice) *Thermostat {
 	return &Thermostat{StandardDevice: sd}
 }
 
+func init() {
+	hm.RegisterModel(&hm.Model{
+		ID:   0x0095,
+		Name: "HM-CC-RT-DN",
+		New:  func(sd hm.StandardDevice) hm.Device { return NewThermostat(sd) },
+	})
+}
+
 func (t *Thermostat) MostRecentEvents() []hm.Event {
 	var result []hm.Event
 	t.latestMu.RLock()
@@ -30,7 +30,7 @@ func TestDecodeInfoEvent(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	ts := heating.NewThermostat(hm.StandardDevice{BCS: bcs, Addr: [3]byte{0xaa, 0xbb, 0xcc}})
+	ts := heating.NewThermostat(hm.NewStandardDevice(bcs, [3]byte{0xaa, 0xbb, 0xcc}, ""))
 	ie, err := ts.DecodeInfoEvent([]byte{0x0a, 0xb0, 0xe2, 0x08, 0x00, 0x00})
 	if err != nil {
 		t.Fatal(err)
@@ -2,6 +2,7 @@ package hm
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"html/template"
 	"log"
@@ -24,6 +25,7 @@ const (
 type Device interface {
 	Channels() int
 	Pair() error
+	Unpair(factoryReset bool) error
 	MostRecentEvents() []Event
 	AddrHex() string
 	Name() string
@@ -42,21 +44,45 @@ type FullyQualifiedChannel struct {
 }
 
 // StandardDevice encapsulates behavior shared by all HomeMatic
-// devices.
+// devices. Use NewStandardDevice to create one.
 type StandardDevice struct {
 	BCS       *bidcos.Sender
 	Addr      [3]byte
-	addrHex   string
 	HumanName string
 
-	once sync.Once
-
-	// msgcnt is incremented and accessed via count()
-	msgcnt byte
+	// state is shared by all copies of the StandardDevice: the device
+	// types embed the copy passed to their constructor.
+	state *deviceState
 
 	NumChannels int
 }
 
+// deviceState is the mutable state of a StandardDevice. Packets are
+// sent to the device from the main loop, the reconciler and HTTP
+// handlers.
+type deviceState struct {
+	// msgcnt is incremented and accessed via count(), guarded by
+	// msgcntMu.
+	msgcntMu sync.Mutex
+	msgcnt   byte
+
+	// session serializes multi-packet exchanges with the device, e.g.
+	// ConfigStart/ConfigWriteIndex/ConfigEnd: the device writes to
+	// the paramlist of the most recent ConfigStart.
+	session sync.Mutex
+}
+
+// NewStandardDevice returns a StandardDevice for the device with BidCoS
+// address addr, e.g. for thermal.NewThermalControl.
+func NewStandardDevice(bcs *bidcos.Sender, addr [3]byte, name string) StandardDevice {
+	return StandardDevice{
+		BCS:       bcs,
+		Addr:      addr,
+		HumanName: name,
+		state:     &deviceState{},
+	}
+}
+
 func (sd *StandardDevice) Name() string {
 	return sd.HumanName
 }
@@ -66,24 +92,42 @@ func (sd *StandardDevice) Channels() int {
 }
 
 func (sd *StandardDevice) count() byte {
-	result := sd.msgcnt
-	sd.msgcnt += 9
+	st := sd.state
+	st.msgcntMu.Lock()
+	defer st.msgcntMu.Unlock()
+	// 0 would make bidcos.Sender.Send pick a message counter, skip it
+	// so that the packets of each device are deterministic.
+	if st.msgcnt == 0 {
+		st.msgcnt += 9
+	}
+	result := st.msgcnt
+	st.msgcnt += 9
 	return result
 }
 
 func (sd *StandardDevice) AddrHex() string {
-	sd.once.Do(func() {
-		sd.addrHex = fmt.Sprintf("%x", sd.Addr)
-	})
-	return sd.addrHex
+	return fmt.Sprintf("%x", sd.Addr)
 }
 
 func (sd *StandardDevice) String() string {
 	return fmt.Sprintf("[BidCoS:%s]", sd.AddrHex())
 }
 
+// send sends pkt and returns an error unless the device acknowledges
+// it.
+func (sd *StandardDevice) send(pkt *bidcos.Packet) error {
+	reply, err := sd.BCS.Send(context.Background(), pkt)
+	if err != nil {
+		return err
+	}
+	if reply.Cmd != bidcos.Ack || reply.Nack() {
+		return fmt.Errorf("%v did not acknowledge command %x: got %x %x", sd, pkt.Payload, reply.Cmd, reply.Payload)
+	}
+	return nil
+}
+
 func (sd *StandardDevice) ConfigStart(channel, paramlist byte) error {
-	return sd.BCS.WritePacket(&bidcos.Packet{
+	return sd.send(&bidcos.Packet{
 		Msgcnt: sd.count(),
 		Flags:  bidcos.DefaultFlags,
 		Cmd:    bidcos.Config,
@@ -99,7 +143,7 @@ func (sd *StandardDevice) ConfigStart(channel, paramlist byte) error {
 }
 
 func (sd *StandardDevice) ConfigWriteIndex(channel byte, kv []byte) error {
-	return sd.BCS.WritePacket(&bidcos.Packet{
+	return sd.send(&bidcos.Packet{
 		Msgcnt: sd.count(),
 		Flags:  bidcos.DefaultFlags,
 		Cmd:    bidcos.Config,
@@ -112,7 +156,7 @@ func (sd *StandardDevice) ConfigWriteIndex(channel byte, kv []byte) error {
 }
 
 func (sd *StandardDevice) ConfigEnd(channel byte) error {
-	return sd.BCS.WritePacket(&bidcos.Packet{
+	return sd.send(&bidcos.Packet{
 		Msgcnt: sd.count(),
 		Flags:  bidcos.DefaultFlags,
 		Cmd:    bidcos.Config,
@@ -125,6 +169,8 @@ func (sd *StandardDevice) ConfigEnd(channel byte) error {
 }
 
 func (sd *StandardDevice) Pair() error {
+	sd.state.session.Lock()
+	defer sd.state.session.Unlock()
 	if err := sd.ConfigStart(0, 0); err != nil {
 		return err
 	}
@@ -139,8 +185,11 @@ func (sd *StandardDevice) Pair() error {
 	return sd.ConfigEnd(0)
 }
 
-func (sd *StandardDevice) ConfigParamReq(channel, paramlist byte) error {
-	return sd.BCS.WritePacket(&bidcos.Packet{
+// ConfigParamReq requests the parameters in paramlist of channel. It
+// returns the first response, further responses need to be received
+// using a bidcos.Receiver.
+func (sd *StandardDevice) ConfigParamReq(channel, paramlist byte) (*bidcos.Packet, error) {
+	return sd.BCS.Send(context.Background(), &bidcos.Packet{
 		Msgcnt: sd.count(),
 		Flags:  bidcos.DefaultFlags | bidcos.Burst,
 		Cmd:    bidcos.Config,
@@ -155,8 +204,11 @@ func (sd *StandardDevice) ConfigParamReq(channel, paramlist byte) error {
 	})
 }
 
-func (sd *StandardDevice) ConfigPeerListReq(channel byte) error {
-	return sd.BCS.WritePacket(&bidcos.Packet{
+// ConfigPeerListReq requests the peers of channel. It returns the
+// first response, further responses need to be received using a
+// bidcos.Receiver.
+func (sd *StandardDevice) ConfigPeerListReq(channel byte) (*bidcos.Packet, error) {
+	return sd.BCS.Send(context.Background(), &bidcos.Packet{
 		Msgcnt: sd.count(),
 		Flags:  bidcos.DefaultFlags | bidcos.Burst,
 		Cmd:    bidcos.Config,
@@ -169,7 +221,7 @@ func (sd *StandardDevice) ConfigPeerListReq(channel byte) error {
 }
 
 func (sd *StandardDevice) ConfigPeerAdd(channel byte, peerAddr [3]byte, peerChannel byte) error {
-	return sd.BCS.WritePacket(&bidcos.Packet{
+	return sd.send(&bidcos.Packet{
 		Msgcnt: sd.count(),
 		Flags:  bidcos.DefaultFlags | bidcos.Burst,
 		Cmd:    bidcos.Config,
@@ -185,7 +237,7 @@ func (sd *StandardDevice) ConfigPeerAdd(channel byte, peerAddr [3]byte, peerChan
 }
 
 func (sd *StandardDevice) ConfigPeerRemove(channel byte, peerAddr [3]byte, peerChannel byte) error {
-	return sd.BCS.WritePacket(&bidcos.Packet{
+	return sd.send(&bidcos.Packet{
 		Msgcnt: sd.count(),
 		Flags:  bidcos.DefaultFlags | bidcos.Burst,
 		Cmd:    bidcos.Config,
@@ -200,36 +252,47 @@ func (sd *StandardDevice) ConfigPeerRemove(channel byte, peerAddr [3]byte, peerC
 	})
 }
 
+// info returns a match function (see bidcos.Sender.Receive) for Info
+// packets of sd with one of the specified subcommands.
+func (sd *StandardDevice) info(subcmds ...byte) func(*bidcos.Packet) bool {
+	from := bidcos.From(sd.Addr, bidcos.Info)
+	return func(pkt *bidcos.Packet) bool {
+		if !from(pkt) || len(pkt.Payload) == 0 {
+			return false
+		}
+		return bytes.IndexByte(subcmds, pkt.Payload[0]) > -1
+	}
+}
+
 // LoadConfig is a convenience function to load the device parameters
 // in paramlist of channel into mem.
 func (sd *StandardDevice) LoadConfig(mem []byte, channel, paramlist byte) error {
-	if err := sd.ConfigParamReq(channel, paramlist); err != nil {
+	sd.state.session.Lock()
+	defer sd.state.session.Unlock()
+	r := sd.BCS.Receive(sd.info(bidcos.InfoParamResponsePairs, bidcos.InfoParamResponseSeq))
+	defer r.Close()
+	pkt, err := sd.ConfigParamReq(channel, paramlist)
+	if err != nil {
 		return err
 	}
-ReadConfig:
 	for {
-		pkt, err := sd.BCS.ReadPacket()
-		if err != nil {
-			return err
-		}
-		if !bytes.Equal(pkt.Source[:], sd.Addr[:]) {
-			log.Printf("dropping BidCoS packet from different device: %+v", pkt)
-			continue
-		}
 		p := pkt.Payload // for convenience
+		if pkt.Cmd != bidcos.Info || len(p) < 2 {
+			return fmt.Errorf("unexpected ConfigParamReq reply: %x %x", pkt.Cmd, p)
+		}
 		switch p[0] {
 		case bidcos.InfoParamResponsePairs:
 			if bytes.Equal(p[1:], []byte{0x00, 0x00}) {
-				break ReadConfig
+				return nil
 			}
 			// idx/val byte pairs
-			for i := 1; i < len(p); i += 2 {
+			for i := 1; i+1 < len(p); i += 2 {
 				mem[p[i]] = p[i+1]
 			}
 
 		case bidcos.InfoParamResponseSeq:
 			if p[1] == 0x00 {
-				break ReadConfig
+				return nil
 			}
 			for i := 0; i < len(p)-2; i++ {
 				mem[p[1]+byte(i)] = p[2+i]
@@ -238,23 +301,31 @@ ReadConfig:
 		default:
 			return fmt.Errorf("unexpected ConfigParamReq reply: %x", p)
 		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), sd.BCS.ReplyTimeout)
+		pkt, err = r.Next(ctx)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("%v: reading ConfigParamReq reply: %v", sd, err)
+		}
 	}
-	return nil
 }
 
-// EnsureConfigured is a convenience function.
-func (sd *StandardDevice) EnsureConfigured(channel, paramlist byte, cb func([]byte) error) error {
+// ConfigDiff loads the device parameters in paramlist of channel and
+// calls cb with a copy to modify into the desired state. It returns
+// the index/value pairs which differ, see WriteConfig.
+func (sd *StandardDevice) ConfigDiff(channel, paramlist byte, cb func([]byte) error) ([]byte, error) {
 	// config memory is indexed using a byte, i.e. capped at 256
 	devmem := make([]byte, 256)
 	if err := sd.LoadConfig(devmem, channel, paramlist); err != nil {
-		return err
+		return nil, err
 	}
 
 	target := make([]byte, len(devmem))
 	copy(target, devmem)
 
 	if err := cb(target); err != nil {
-		return err
+		return nil, err
 	}
 
 	var pairs []byte
@@ -263,11 +334,11 @@ func (sd *StandardDevice) EnsureConfigured(channel, paramlist byte, cb func([]by
 			pairs = append(pairs, byte(i), target[i])
 		}
 	}
+	return pairs, nil
+}
 
-	if len(pairs) == 0 {
-		return nil
-	}
-
+// WriteConfig writes the index/value pairs into paramlist of channel.
+func (sd *StandardDevice) WriteConfig(channel, paramlist byte, pairs []byte) error {
 	// BidCoS frames have a maximum length of 16 bytes. A
 	// ConfigWriteIndex packet has 2 bytes overhead, so we send
 	// key/value pairs in blocks of 14 bytes each.
@@ -278,6 +349,8 @@ func (sd *StandardDevice) EnsureConfigured(channel, paramlist byte, cb func([]by
 
 	log.Printf("need to update: %x", pairs)
 
+	sd.state.session.Lock()
+	defer sd.state.session.Unlock()
 	if err := sd.ConfigStart(channel, paramlist); err != nil {
 		return err
 	}
@@ -299,95 +372,180 @@ func (sd *StandardDevice) EnsureConfigured(channel, paramlist byte, cb func([]by
 	return nil
 }
 
-var endOfPeerList = []byte{0x00, 0x00, 0x00, 0x00}
-
-func (sd *StandardDevice) EnsurePeeredWith(channel byte, dest FullyQualifiedChannel) error {
-	if err := sd.ConfigPeerListReq(channel); err != nil {
+// EnsureConfigured is a convenience function combining ConfigDiff and
+// WriteConfig.
+func (sd *StandardDevice) EnsureConfigured(channel, paramlist byte, cb func([]byte) error) error {
+	pairs, err := sd.ConfigDiff(channel, paramlist, cb)
+	if err != nil {
 		return err
 	}
+	if len(pairs) == 0 {
+		return nil
+	}
+	return sd.WriteConfig(channel, paramlist, pairs)
+}
 
-	var peers []FullyQualifiedChannel
+var endOfPeerList = []byte{0x00, 0x00, 0x00, 0x00}
 
-ReadPeers:
-	for {
-		pkt, err := sd.BCS.ReadPacket()
-		if err != nil {
-			return err
-		}
+// Peers returns the peers of channel. A channel which cannot be peered
+// (i.e. the device replies with a Nack) has no peers.
+func (sd *StandardDevice) Peers(channel byte) ([]FullyQualifiedChannel, error) {
+	sd.state.session.Lock()
+	defer sd.state.session.Unlock()
+	return sd.peers(channel)
+}
 
-		if !bytes.Equal(pkt.Source[:], sd.Addr[:]) {
-			log.Printf("dropping BidCoS packet from different device: %+v", pkt)
-			continue
-		}
+// peers implements Peers. The caller must hold state.session.
+func (sd *StandardDevice) peers(channel byte) ([]FullyQualifiedChannel, error) {
+	r := sd.BCS.Receive(sd.info(bidcos.InfoPeerList))
+	defer r.Close()
+	pkt, err := sd.ConfigPeerListReq(channel)
+	if err != nil {
+		return nil, err
+	}
+	if pkt.Nack() {
+		return nil, nil
+	}
 
-		if pkt.Payload[0] != 0x01 /* INFO_PEER_LIST */ {
-			return fmt.Errorf("unexpected payload: %x", pkt.Payload[0])
+	var peers []FullyQualifiedChannel
+	for {
+		if pkt.Cmd != bidcos.Info || len(pkt.Payload) < 1 || pkt.Payload[0] != bidcos.InfoPeerList {
+			return nil, fmt.Errorf("unexpected ConfigPeerListReq reply: %x %x", pkt.Cmd, pkt.Payload)
 		}
 
 		list := pkt.Payload[1:]
 		for i := 0; i < len(list)/4; i++ {
 			off := 4 * i
 			if bytes.Equal(list[off:off+4], endOfPeerList) {
-				break ReadPeers
+				return peers, nil
 			}
 			var p FullyQualifiedChannel
 			copy(p.Peer[:], list[off:off+3])
 			p.Channel = list[off+3]
 			peers = append(peers, p)
 		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), sd.BCS.ReplyTimeout)
+		pkt, err = r.Next(ctx)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("%v: reading ConfigPeerListReq reply: %v", sd, err)
+		}
 	}
+}
 
+// PeerDiff returns the peers of channel which need to be removed and
+// added so that dests becomes its exact set of peers, see UpdatePeers.
+func (sd *StandardDevice) PeerDiff(channel byte, dests ...FullyQualifiedChannel) (remove, add []FullyQualifiedChannel, _ error) {
+	peers, err := sd.Peers(channel)
+	if err != nil {
+		return nil, nil, err
+	}
 	log.Printf("%v has existing peers %+v", sd, peers)
-	if len(peers) > 1 {
-		// TODO(later): unpeer everything
-		return fmt.Errorf("unpeering not yet implemented")
-	}
-	if len(peers) == 1 {
-		existing := peers[0]
-		if bytes.Equal(existing.Peer[:], dest.Peer[:]) {
-			return nil
+
+	existing := make(map[FullyQualifiedChannel]bool, len(peers))
+	for _, p := range peers {
+		existing[p] = true
+	}
+	desired := make(map[FullyQualifiedChannel]bool, len(dests))
+	for _, dest := range dests {
+		desired[dest] = true
+	}
+	for _, p := range peers {
+		if !desired[p] {
+			remove = append(remove, p)
+		}
+	}
+	for _, dest := range dests {
+		if !existing[dest] {
+			add = append(add, dest)
+			existing[dest] = true // in case dests contains duplicates
 		}
+	}
+	return remove, add, nil
+}
 
-		log.Printf("removing existing peer %v", existing)
-		if err := sd.ConfigPeerRemove(channel, existing.Peer, existing.Channel); err != nil {
+// UpdatePeers removes and adds peers of channel.
+func (sd *StandardDevice) UpdatePeers(channel byte, remove, add []FullyQualifiedChannel) error {
+	sd.state.session.Lock()
+	defer sd.state.session.Unlock()
+	// Remove peers first: devices can only store a limited number of
+	// peers per channel.
+	for _, p := range remove {
+		log.Printf("removing existing peer %v", p)
+		if err := sd.ConfigPeerRemove(channel, p.Peer, p.Channel); err != nil {
+			return err
+		}
+	}
+	for _, p := range add {
+		log.Printf("adding peer %v", p)
+		if err := sd.ConfigPeerAdd(channel, p.Peer, p.Channel); err != nil {
 			return err
 		}
+	}
+	return nil
+}
+
+// EnsurePeeredWith makes dests the exact set of peers of channel:
+// peers which are not in dests are removed, missing peers are added.
+func (sd *StandardDevice) EnsurePeeredWith(channel byte, dests ...FullyQualifiedChannel) error {
+	remove, add, err := sd.PeerDiff(channel, dests...)
+	if err != nil {
+		return err
+	}
+	return sd.UpdatePeers(channel, remove, add)
+}
+
+// FactoryReset makes the device reset all of its settings (including
+// its peers and the central address, see Pair) to the factory
+// defaults.
+func (sd *StandardDevice) FactoryReset() error {
+	// c.f. CUL_HM_Set “reset” in FHEM’s 10_CUL_HM.pm
+	return sd.send(&bidcos.Packet{
+		Msgcnt:  sd.count(),
+		Flags:   bidcos.DefaultFlags,
+		Cmd:     0x11, // Set
+		Dest:    sd.Addr,
+		Payload: []byte{0x04, 0x00},
+	})
+}
 
-		pkt, err := sd.BCS.ReadPacket()
+// Unpair is the inverse of Pair: it removes all peers of all channels
+// and clears the central address, so that the device can be paired
+// with another central. When factoryReset is true, the device is
+// subsequently reset to its factory defaults, see FactoryReset.
+func (sd *StandardDevice) Unpair(factoryReset bool) error {
+	sd.state.session.Lock()
+	defer sd.state.session.Unlock()
+	for channel := 1; channel <= sd.NumChannels; channel++ {
+		peers, err := sd.peers(byte(channel))
 		if err != nil {
 			return err
 		}
-		if got, want := pkt.Cmd, byte(0x10); got != want {
-			return fmt.Errorf("unexpected response command: got %x, want %x", got, want)
-		}
-		if got, want := len(pkt.Payload), 1; got < want {
-			return fmt.Errorf("unexpected response payload length: got %d, want >= %d", got, want)
-		}
-		if got, want := pkt.Payload[0], byte(0x00); got != want {
-			return fmt.Errorf("unexpected acknowledgement status: got %x, want %x", got, want)
+		for _, p := range peers {
+			log.Printf("%v: removing peer %v of channel %d", sd, p, channel)
+			if err := sd.ConfigPeerRemove(byte(channel), p.Peer, p.Channel); err != nil {
+				return err
+			}
 		}
-
-		// fallthrough to add the peer
 	}
 
-	log.Printf("adding peer %v", dest)
-	if err := sd.ConfigPeerAdd(channel, dest.Peer, dest.Channel); err != nil {
+	if err := sd.ConfigStart(0, 0); err != nil {
 		return err
 	}
-
-	pkt, err := sd.BCS.ReadPacket()
-	if err != nil {
+	if err := sd.ConfigWriteIndex(0, []byte{
+		0x0a, 0x00,
+		0x0b, 0x00,
+		0x0c, 0x00,
+	}); err != nil {
 		return err
 	}
-	if got, want := pkt.Cmd, byte(0x02); got != want {
-		return fmt.Errorf("unexpected response command: got %x, want %x", got, want)
-	}
-	if got, want := len(pkt.Payload), 1; got < want {
-		return fmt.Errorf("unexpected response payload length: got %d, want >= %d", got, want)
-	}
-	if got, want := pkt.Payload[0], byte(0x00); got != want {
-		return fmt.Errorf("unexpected acknowledgement status: got %x, want %x", got, want)
+	if err := sd.ConfigEnd(0); err != nil {
+		return err
 	}
 
+	if factoryReset {
+		return sd.FactoryReset()
+	}
 	return nil
 }
@@ -0,0 +1,32 @@
+package hm
+
+import "fmt"
+
+// Model is a HomeMatic device model, identified by the 16-bit model ID
+// which devices send in DeviceInfo packets (see
+// bidcos.DeviceInfoFrame).
+type Model struct {
+	ID   uint16 // e.g. 0x00ad (173)
+	Name string // e.g. HM-TC-IT-WM-W-EU
+
+	// New returns the Device implementation for the model.
+	New func(StandardDevice) Device
+}
+
+// models maps model IDs to models, see RegisterModel.
+var models = make(map[uint16]*Model)
+
+// RegisterModel makes m available via ModelByID. The packages which
+// implement devices register their models in init.
+func RegisterModel(m *Model) {
+	if other, ok := models[m.ID]; ok {
+		panic(fmt.Sprintf("model %04x already registered as %s", m.ID, other.Name))
+	}
+	models[m.ID] = m
+}
+
+// ModelByID returns the model with the specified ID, or nil if no
+// package implements the model.
+func ModelByID(id uint16) *Model {
+	return models[id]
+}
@@ -0,0 +1,69 @@
+package hm_test
+
+import (
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/stapelberg/hmgo/internal/bidcos"
+	"github.com/stapelberg/hmgo/internal/hm"
+	"github.com/stapelberg/hmgo/internal/hm/heating"
+	"github.com/stapelberg/hmgo/internal/hm/power"
+	"github.com/stapelberg/hmgo/internal/hm/thermal"
+)
+
+func TestModelByID(t *testing.T) {
+	for _, tt := range []struct {
+		payload  string // of the DeviceInfo packet
+		wantName string
+		wantType string // of the Device returned by Model.New
+	}{
+		{
+			payload:  "1200ad4d455130303839303136100103",
+			wantName: "HM-TC-IT-WM-W-EU",
+			wantType: fmt.Sprintf("%T", &thermal.ThermalControl{}),
+		},
+		{
+			payload:  "1400954d455130303539393232580300",
+			wantName: "HM-CC-RT-DN",
+			wantType: fmt.Sprintf("%T", &heating.Thermostat{}),
+		},
+		{
+			payload:  "1300ac4d455131323334353637100100",
+			wantName: "HM-ES-PMSw1-Pl",
+			wantType: fmt.Sprintf("%T", &power.PowerSwitch{}),
+		},
+		{
+			// HM-SEC-SC-2 (door/window contact), not implemented
+			payload: "1800b14d455130303030303031800100",
+		},
+	} {
+		t.Run(tt.payload, func(t *testing.T) {
+			payload, err := hex.DecodeString(tt.payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := bidcos.DecodeDeviceInfo(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := hm.ModelByID(f.Model)
+			if tt.wantName == "" {
+				if m != nil {
+					t.Fatalf("ModelByID(%04x) = %s, want nil", f.Model, m.Name)
+				}
+				return
+			}
+			if m == nil {
+				t.Fatalf("ModelByID(%04x) = nil, want %s", f.Model, tt.wantName)
+			}
+			if got, want := m.Name, tt.wantName; got != want {
+				t.Errorf("unexpected model name: got %q, want %q", got, want)
+			}
+			dev := m.New(hm.NewStandardDevice(nil, [3]byte{0x39, 0x06, 0xeb}, f.Serial))
+			if got, want := fmt.Sprintf("%T", dev), tt.wantType; got != want {
+				t.Errorf("unexpected device type: got %s, want %s", got, want)
+			}
+		})
+	}
+}
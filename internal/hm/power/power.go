@@ -1,6 +1,8 @@
 package power
 
 import (
+	"context"
+	"fmt"
 	"sync"
 
 	"github.com/stapelberg/hmgo/internal/bidcos"
@@ -40,6 +42,14 @@ func NewPowerSwitch(sd hm.StandardDevice) *PowerSwitch {
 	return &PowerSwitch{StandardDevice: sd}
 }
 
+func init() {
+	hm.RegisterModel(&hm.Model{
+		ID:   0x00ac,
+		Name: "HM-ES-PMSw1-Pl",
+		New:  func(sd hm.StandardDevice) hm.Device { return NewPowerSwitch(sd) },
+	})
+}
+
 func (ps *PowerSwitch) MostRecentEvents() []hm.Event {
 	var result []hm.Event
 	ps.latestMu.RLock()
@@ -53,7 +63,7 @@ func (ps *PowerSwitch) MostRecentEvents() []hm.Event {
 }
 
 func (ps *PowerSwitch) LevelSet(channel, state, onTime byte) error {
-	return ps.BCS.WritePacket(&bidcos.Packet{
+	reply, err := ps.BCS.Send(context.Background(), &bidcos.Packet{
 		Flags: bidcos.DefaultFlags,
 		Cmd:   0x11, // LevelSet
 		Dest:  ps.Addr,
@@ -65,4 +75,11 @@ func (ps *PowerSwitch) LevelSet(channel, state, onTime byte) error {
 			onTime,
 		},
 	})
+	if err != nil {
+		return err
+	}
+	if reply.Cmd != bidcos.Ack || reply.Nack() {
+		return fmt.Errorf("%v did not acknowledge LevelSet: got %x %x", ps, reply.Cmd, reply.Payload)
+	}
+	return nil
 }
@@ -30,7 +30,7 @@ func TestDecodePowerEvent(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	ps := power.NewPowerSwitch(hm.StandardDevice{BCS: bcs, Addr: [3]byte{0xaa, 0xbb, 0xcc}})
+	ps := power.NewPowerSwitch(hm.NewStandardDevice(bcs, [3]byte{0xaa, 0xbb, 0xcc}, ""))
 
 	// payload captured measuring a Raspberry Pi 3 :)
 	pe, err := ps.DecodePowerEvent([]byte{128, 3, 138, 0, 0, 187, 0, 16, 9, 8, 255})
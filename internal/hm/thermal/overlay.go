@@ -0,0 +1,136 @@
+package thermal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Date is a calendar date. A zero Year means the date recurs every
+// year.
+type Date struct {
+	Year  int
+	Month time.Month
+	Day   int
+}
+
+// ParseDate parses “MM-DD” (recurring every year) or “YYYY-MM-DD”.
+func ParseDate(s string) (Date, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 && len(parts) != 3 {
+		return Date{}, fmt.Errorf("invalid date %q (want MM-DD or YYYY-MM-DD)", s)
+	}
+	nums := make([]int, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return Date{}, fmt.Errorf("invalid date %q: %v", s, err)
+		}
+		nums[i] = n
+	}
+	var d Date
+	if len(nums) == 3 {
+		d.Year, nums = nums[0], nums[1:]
+	}
+	d.Month, d.Day = time.Month(nums[0]), nums[1]
+	// 2000 is a leap year, i.e. accepts 02-29 for recurring dates.
+	year := d.Year
+	if year == 0 {
+		year = 2000
+	}
+	t := time.Date(year, d.Month, d.Day, 0, 0, 0, 0, time.UTC)
+	if t.Month() != d.Month || t.Day() != d.Day {
+		return Date{}, fmt.Errorf("invalid date %q: no such day", s)
+	}
+	return d, nil
+}
+
+func (d Date) String() string {
+	if d.Year == 0 {
+		return fmt.Sprintf("%02d-%02d", d.Month, d.Day)
+	}
+	return fmt.Sprintf("%04d-%02d-%02d", d.Year, d.Month, d.Day)
+}
+
+// key returns a number which sorts like the date. Recurring dates
+// ignore the year.
+func (d Date) key(withYear bool) int {
+	k := int(d.Month)*100 + d.Day
+	if withYear {
+		k += d.Year * 10000
+	}
+	return k
+}
+
+// Overlay modifies a base heating program while it is active, e.g. to
+// heat more during winter or to save energy during a holiday.
+type Overlay struct {
+	Name string
+
+	// From and To (both inclusive) specify when the overlay is
+	// active. Recurring ranges may wrap around the end of the year,
+	// e.g. 09-01 to 04-30.
+	From, To Date
+
+	// Schedule, if non-nil, replaces the base program on the days it
+	// covers.
+	Schedule []Program
+
+	// If Temperature is non-zero, all program entries ending after
+	// After (in minutes since midnight) are set to Temperature.
+	After       uint64
+	Temperature float64
+}
+
+// Active returns whether the overlay applies on the day of t.
+func (o *Overlay) Active(t time.Time) bool {
+	withYear := o.From.Year != 0
+	day := Date{Year: t.Year(), Month: t.Month(), Day: t.Day()}.key(withYear)
+	from, to := o.From.key(withYear), o.To.key(withYear)
+	if from <= to {
+		return from <= day && day <= to
+	}
+	// The range wraps around the end of the year.
+	return day >= from || day <= to
+}
+
+// Apply returns a copy of programs with the overlay applied.
+func (o *Overlay) Apply(programs []Program) []Program {
+	var result []Program
+	var covered int
+	for _, pg := range o.Schedule {
+		covered |= pg.DayMask
+	}
+	for _, pg := range programs {
+		pg.DayMask &^= covered
+		if pg.DayMask == 0 {
+			continue
+		}
+		if o.Temperature != 0 {
+			for i, entry := range pg.Endtimes {
+				if entry.Endtime > o.After {
+					pg.Endtimes[i].Temperature = o.Temperature
+				}
+			}
+		}
+		result = append(result, pg)
+	}
+	return append(result, o.Schedule...)
+}
+
+// ApplyOverlays applies all overlays which are active at t to
+// programs, in order. It returns the resulting programs and the names
+// of the overlays which were applied.
+func ApplyOverlays(programs []Program, overlays []*Overlay, t time.Time) ([]Program, []string) {
+	result := append([]Program(nil), programs...)
+	var active []string
+	for _, o := range overlays {
+		if !o.Active(t) {
+			continue
+		}
+		result = o.Apply(result)
+		active = append(active, o.Name)
+	}
+	return result, active
+}
@@ -0,0 +1,232 @@
+package thermal
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stapelberg/hmgo/internal/hm"
+)
+
+// maxSwitchPoints is the number of ProgramEntry slots per day in the
+// device memory, see encodeProgramDay.
+const maxSwitchPoints = 13
+
+var weekdays = map[string]time.Weekday{
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+	"sun": time.Sunday,
+}
+
+// parseDay parses an English weekday abbreviation such as “Mon”.
+func parseDay(s string) (time.Weekday, error) {
+	day, ok := weekdays[strings.ToLower(s)]
+	if !ok {
+		return 0, fmt.Errorf("unknown weekday %q (want one of Mon, Tue, Wed, Thu, Fri, Sat, Sun)", s)
+	}
+	return day, nil
+}
+
+// parseDays parses a comma-separated list of weekdays or weekday
+// ranges (e.g. “Mon-Fri,Sun”) into a day mask.
+func parseDays(s string) (int, error) {
+	var mask int
+	for _, part := range strings.Split(s, ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		first, err := parseDay(from)
+		if err != nil {
+			return 0, err
+		}
+		last := first
+		if isRange {
+			if last, err = parseDay(to); err != nil {
+				return 0, err
+			}
+		}
+		// Ranges wrap around the end of the week, e.g. Sat-Sun or
+		// Fri-Mon.
+		for day := first; ; day = (day + 1) % 7 {
+			mask |= 1 << uint(day)
+			if day == last {
+				break
+			}
+		}
+	}
+	return mask, nil
+}
+
+// ParseTime parses “HH:MM” into minutes since midnight. 24:00 is
+// valid and refers to the end of the day.
+func ParseTime(s string) (uint64, error) {
+	hh, mm, ok := strings.Cut(s, ":")
+	if !ok || len(mm) != 2 {
+		return 0, fmt.Errorf("invalid time %q (want HH:MM)", s)
+	}
+	hours, err := strconv.ParseUint(hh, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q: %v", s, err)
+	}
+	minutes, err := strconv.ParseUint(mm, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q: %v", s, err)
+	}
+	if minutes > 59 || hours*60+minutes > 24*60 {
+		return 0, fmt.Errorf("invalid time %q: out of range [00:00, 24:00]", s)
+	}
+	// The device stores end times in units of 5 minutes.
+	if minutes%5 != 0 {
+		return 0, fmt.Errorf("invalid time %q: not on a 5 minute boundary", s)
+	}
+	return hours*60 + minutes, nil
+}
+
+// CheckTemperature returns an error if temp (in degC) cannot be stored
+// in a program entry. The device stores temperatures in 6 bits of half
+// degrees, with 0 meaning “unset”, i.e. valid temperatures are 0.5 to
+// 31.5 in steps of 0.5.
+func CheckTemperature(temp float64) error {
+	half := temp * 2
+	if half != float64(int(half)) {
+		return fmt.Errorf("invalid temperature %v: not a multiple of 0.5", temp)
+	}
+	if half < 1 || half > hm.Mask6Bit {
+		return fmt.Errorf("invalid temperature %v: out of range [0.5, 31.5]", temp)
+	}
+	return nil
+}
+
+// parseTemperature parses a temperature in degC.
+func parseTemperature(s string) (float64, error) {
+	temp, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid temperature %q: %v", s, err)
+	}
+	return temp, CheckTemperature(temp)
+}
+
+type period struct {
+	from, to    uint64
+	temperature float64
+}
+
+// parseRule parses a single schedule rule, e.g.
+// “Mon-Fri 06:00-10:00 22.0, 17:00-23:00 22.0, else 17.0”.
+func parseRule(rule string) (Program, error) {
+	rule = strings.TrimSpace(rule)
+	days, rest, ok := strings.Cut(rule, " ")
+	if !ok {
+		return Program{}, fmt.Errorf("rule %q: missing periods", rule)
+	}
+	mask, err := parseDays(days)
+	if err != nil {
+		return Program{}, fmt.Errorf("rule %q: %v", rule, err)
+	}
+
+	var (
+		periods  []period
+		fallback float64
+	)
+	for _, item := range strings.Split(rest, ",") {
+		fields := strings.Fields(item)
+		if len(fields) != 2 {
+			return Program{}, fmt.Errorf("rule %q: invalid period %q (want HH:MM-HH:MM temperature or else temperature)", rule, item)
+		}
+		temp, err := parseTemperature(fields[1])
+		if err != nil {
+			return Program{}, fmt.Errorf("rule %q: %v", rule, err)
+		}
+		if fields[0] == "else" {
+			if fallback != 0 {
+				return Program{}, fmt.Errorf("rule %q: more than one else", rule)
+			}
+			fallback = temp
+			continue
+		}
+		from, to, ok := strings.Cut(fields[0], "-")
+		if !ok {
+			return Program{}, fmt.Errorf("rule %q: invalid period %q (want HH:MM-HH:MM)", rule, fields[0])
+		}
+		p := period{temperature: temp}
+		if p.from, err = ParseTime(from); err != nil {
+			return Program{}, fmt.Errorf("rule %q: %v", rule, err)
+		}
+		if p.to, err = ParseTime(to); err != nil {
+			return Program{}, fmt.Errorf("rule %q: %v", rule, err)
+		}
+		if p.from >= p.to {
+			return Program{}, fmt.Errorf("rule %q: period %s ends before it starts", rule, fields[0])
+		}
+		periods = append(periods, p)
+	}
+	if fallback == 0 {
+		return Program{}, fmt.Errorf("rule %q: missing else temperature", rule)
+	}
+
+	sort.Slice(periods, func(i, j int) bool { return periods[i].from < periods[j].from })
+
+	// Each entry covers the time from the previous entry’s end time
+	// (or midnight) until its own end time.
+	var entries []ProgramEntry
+	var end uint64
+	for i, p := range periods {
+		if i > 0 && p.from < periods[i-1].to {
+			return Program{}, fmt.Errorf("rule %q: overlapping periods", rule)
+		}
+		if p.from > end {
+			entries = append(entries, ProgramEntry{Endtime: p.from, Temperature: fallback})
+		}
+		entries = append(entries, ProgramEntry{Endtime: p.to, Temperature: p.temperature})
+		end = p.to
+	}
+	if end < 24*60 {
+		entries = append(entries, ProgramEntry{Endtime: 24 * 60, Temperature: fallback})
+	}
+	if got, want := len(entries), maxSwitchPoints; got > want {
+		return Program{}, fmt.Errorf("rule %q: too many switch points: got %d, want <= %d", rule, got, want)
+	}
+
+	pg := Program{DayMask: mask}
+	copy(pg.Endtimes[:], entries)
+	return pg, nil
+}
+
+// ParseSchedule parses a weekly heating schedule into programs which
+// can be passed to SetPrograms. A schedule consists of rules separated
+// by semicolons, e.g.:
+//
+//	Mon-Fri 06:00-10:00 22.0, 17:00-23:00 22.0, else 17.0;
+//	Sat,Sun 06:00-23:00 22.0, else 17.0
+//
+// Each rule starts with the days it applies to, followed by periods
+// and their temperature in degC. The else temperature applies outside
+// of the periods. Days which are not mentioned keep their program.
+func ParseSchedule(schedule string) ([]Program, error) {
+	var (
+		programs []Program
+		seen     int
+	)
+	for _, rule := range strings.Split(schedule, ";") {
+		if strings.TrimSpace(rule) == "" {
+			continue
+		}
+		pg, err := parseRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		if seen&pg.DayMask != 0 {
+			return nil, fmt.Errorf("rule %q: days already covered by a previous rule", strings.TrimSpace(rule))
+		}
+		seen |= pg.DayMask
+		programs = append(programs, pg)
+	}
+	if len(programs) == 0 {
+		return nil, fmt.Errorf("empty schedule")
+	}
+	return programs, nil
+}
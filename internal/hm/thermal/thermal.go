@@ -57,6 +57,14 @@ func NewThermalControl(sd hm.StandardDevice) *ThermalControl {
 	return &ThermalControl{StandardDevice: sd}
 }
 
+func init() {
+	hm.RegisterModel(&hm.Model{
+		ID:   0x00ad,
+		Name: "HM-TC-IT-WM-W-EU",
+		New:  func(sd hm.StandardDevice) hm.Device { return NewThermalControl(sd) },
+	})
+}
+
 func (tc *ThermalControl) MostRecentEvents() []hm.Event {
 	var result []hm.Event
 	tc.latestMu.RLock()
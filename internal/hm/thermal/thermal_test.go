@@ -2,7 +2,10 @@ package thermal_test
 
 import (
 	"fmt"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stapelberg/hmgo/internal/bidcos"
 	"github.com/stapelberg/hmgo/internal/hm"
@@ -30,7 +33,7 @@ func TestDecodeWeatherEvent(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	tc := thermal.NewThermalControl(hm.StandardDevice{BCS: bcs, Addr: [3]byte{0xaa, 0xbb, 0xcc}})
+	tc := thermal.NewThermalControl(hm.NewStandardDevice(bcs, [3]byte{0xaa, 0xbb, 0xcc}, ""))
 	we, err := tc.DecodeWeatherEvent([]byte{0, 253, 57})
 	if err != nil {
 		t.Fatal(err)
@@ -49,7 +52,7 @@ func TestDecodeThermalControlEvent(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	tc := thermal.NewThermalControl(hm.StandardDevice{BCS: bcs, Addr: [3]byte{0xaa, 0xbb, 0xcc}})
+	tc := thermal.NewThermalControl(hm.NewStandardDevice(bcs, [3]byte{0xaa, 0xbb, 0xcc}, ""))
 	tce, err := tc.DecodeThermalControlEvent([]byte{200, 215, 65})
 	if err != nil {
 		t.Fatal(err)
@@ -71,7 +74,7 @@ func TestDecodeInfoEvent(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	tc := thermal.NewThermalControl(hm.StandardDevice{BCS: bcs, Addr: [3]byte{0xaa, 0xbb, 0xcc}})
+	tc := thermal.NewThermalControl(hm.NewStandardDevice(bcs, [3]byte{0xaa, 0xbb, 0xcc}, ""))
 	ie, err := tc.DecodeInfoEvent([]byte{0x0b, 0xb0, 0xdf, 0x0e, 0x00})
 	if err != nil {
 		t.Fatal(err)
@@ -87,3 +90,141 @@ func TestDecodeInfoEvent(t *testing.T) {
 		t.Fatalf("unexpected battery state: got %v, want %v", got, want)
 	}
 }
+
+func TestParseSchedule(t *testing.T) {
+	programs, err := thermal.ParseSchedule("Mon-Fri 06:00-10:00 22.0, 17:00-23:00 22.0, else 17.0; Sat,Sun 06:00-23:00 22, else 17")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []thermal.Program{
+		{
+			DayMask: thermal.WeekdayMask,
+			Endtimes: [13]thermal.ProgramEntry{
+				{Endtime: uint64((6 * time.Hour).Minutes()), Temperature: 17.0},
+				{Endtime: uint64((10 * time.Hour).Minutes()), Temperature: 22.0},
+				{Endtime: uint64((17 * time.Hour).Minutes()), Temperature: 17.0},
+				{Endtime: uint64((23 * time.Hour).Minutes()), Temperature: 22.0},
+				{Endtime: uint64((24 * time.Hour).Minutes()), Temperature: 17.0},
+			},
+		},
+		{
+			DayMask: thermal.WeekendMask,
+			Endtimes: [13]thermal.ProgramEntry{
+				{Endtime: uint64((6 * time.Hour).Minutes()), Temperature: 17.0},
+				{Endtime: uint64((23 * time.Hour).Minutes()), Temperature: 22.0},
+				{Endtime: uint64((24 * time.Hour).Minutes()), Temperature: 17.0},
+			},
+		},
+	}
+	if !reflect.DeepEqual(programs, want) {
+		t.Fatalf("unexpected programs: got %+v, want %+v", programs, want)
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, tt := range []struct {
+		schedule string
+		wantErr  string
+	}{
+		{"Mon-Fri 06:00-10:00 22.0", "missing else temperature"},
+		{"Mon-Fri 06:03-10:00 22.0, else 17.0", "not on a 5 minute boundary"},
+		{"Mon-Fri 06:00-10:00 32.0, else 17.0", "out of range"},
+		{"Mon-Fri 06:00-10:00 22.2, else 17.0", "not a multiple of 0.5"},
+		{"Mon-Fri 06:00-10:00 22.0, 09:00-11:00 21.0, else 17.0", "overlapping periods"},
+		{"Mon-Fri else 17.0; Fri-Sun else 17.0", "already covered"},
+		{"Mon-Frei else 17.0", "unknown weekday"},
+		{"Mon 01:00-02:00 22, 03:00-04:00 22, 05:00-06:00 22, 07:00-08:00 22, 09:00-10:00 22, 11:00-12:00 22, 13:00-14:00 22, else 17", "too many switch points"},
+	} {
+		t.Run(tt.schedule, func(t *testing.T) {
+			_, err := thermal.ParseSchedule(tt.schedule)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("unexpected error: got %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOverlays(t *testing.T) {
+	base, err := thermal.ParseSchedule("Mon-Fri 06:00-10:00 22.0, else 17.0; Sat-Sun 08:00-23:00 22.0, else 17.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from, err := thermal.ParseDate("09-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := thermal.ParseDate("04-30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	winter := &thermal.Overlay{
+		Name:        "winter",
+		From:        from,
+		To:          to,
+		After:       uint64((6 * time.Hour).Minutes()),
+		Temperature: 24.0,
+	}
+	holidaySchedule, err := thermal.ParseSchedule("Mon-Sun else 17.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	holiday := &thermal.Overlay{
+		Name:     "holiday",
+		From:     thermal.Date{Year: 2026, Month: time.December, Day: 24},
+		To:       thermal.Date{Year: 2027, Month: time.January, Day: 6},
+		Schedule: holidaySchedule,
+	}
+	overlays := []*thermal.Overlay{winter, holiday}
+
+	for _, tt := range []struct {
+		date       time.Time
+		wantActive []string
+		wantMonday [13]thermal.ProgramEntry
+	}{
+		{
+			date:       time.Date(2026, time.August, 31, 12, 0, 0, 0, time.UTC),
+			wantActive: nil,
+			wantMonday: base[0].Endtimes,
+		},
+		{
+			date:       time.Date(2026, time.September, 1, 0, 0, 0, 0, time.UTC),
+			wantActive: []string{"winter"},
+			wantMonday: [13]thermal.ProgramEntry{
+				{Endtime: uint64((6 * time.Hour).Minutes()), Temperature: 17.0},
+				{Endtime: uint64((10 * time.Hour).Minutes()), Temperature: 24.0},
+				{Endtime: uint64((24 * time.Hour).Minutes()), Temperature: 24.0},
+			},
+		},
+		{
+			date:       time.Date(2027, time.January, 6, 23, 59, 0, 0, time.UTC),
+			wantActive: []string{"winter", "holiday"},
+			wantMonday: holidaySchedule[0].Endtimes,
+		},
+		{
+			date:       time.Date(2027, time.May, 1, 0, 0, 0, 0, time.UTC),
+			wantActive: nil,
+			wantMonday: base[0].Endtimes,
+		},
+	} {
+		t.Run(tt.date.Format("2006-01-02"), func(t *testing.T) {
+			programs, active := thermal.ApplyOverlays(base, overlays, tt.date)
+			if !reflect.DeepEqual(active, tt.wantActive) {
+				t.Fatalf("unexpected active overlays: got %v, want %v", active, tt.wantActive)
+			}
+			var monday []thermal.ProgramEntry
+			for _, pg := range programs {
+				if pg.DayMask&(1<<uint(time.Monday)) != 0 {
+					monday = append(monday, pg.Endtimes[:]...)
+				}
+			}
+			if !reflect.DeepEqual(monday, tt.wantMonday[:]) {
+				t.Fatalf("unexpected monday program: got %+v, want %+v", monday, tt.wantMonday)
+			}
+		})
+	}
+
+	// The base program must not have been modified.
+	if got, want := base[0].Endtimes[1].Temperature, 22.0; got != want {
+		t.Fatalf("base program modified: got %v, want %v", got, want)
+	}
+}
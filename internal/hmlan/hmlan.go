@@ -0,0 +1,415 @@
+// Package hmlan talks to an eQ-3 HM-CFG-LAN configuration adapter,
+// which sends and receives BidCoS packets on behalf of its client.
+//
+// The HM-CFG-LAN speaks an ASCII protocol over TCP (port 1000). Each
+// line starts with a command character, fields are separated by
+// commas, numbers and packets are hex-encoded:
+//
+//	HHM-LAN-IF,03C4,JEQ0123456,1F9F93,FDB02C,05D22A39,0000  hello (adapter)
+//	AFDB02C                                                 set HMID
+//	C                                                       clear peers
+//	Y01,02,00112233445566778899AABBCCDDEEFF                 set AES key (Y02: previous, Y03: temporary)
+//	T1FFB0300,00,00,00000000                                set time (seconds since 2000)
+//	+3906EB,00,00,                                          add peer (second field: AES)
+//	-3906EB                                                 remove peer
+//	S5D1B7E1C,00,00000000,01,5D1B7E1C,42A0013906EB...       send packet
+//	E3906EB,0000,5D1B7E20,FF,FFC4,42A0103906EBFDB02C...     received packet
+//	R5D1B7E1C,0001,5D1B7E21,FF,FFC3,42800203906EB...        reply to a sent packet
+//	K                                                       keep-alive
+//
+// The adapter closes the connection when it does not receive a line
+// for 30 seconds.
+//
+// c.f. https://svn.fhem.de/trac/browser/trunk/fhem/FHEM/00_HMLAN.pm
+package hmlan
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stapelberg/hmgo/internal/bidcos"
+)
+
+// DefaultPort is the TCP port of the HM-CFG-LAN.
+const DefaultPort = "1000"
+
+// KeepAliveInterval is how often HMLAN sends a keep-alive line.
+var KeepAliveInterval = 25 * time.Second
+
+// ConfirmTimeout is how long Confirm waits for the R line of a packet.
+var ConfirmTimeout = 5 * time.Second
+
+// Bits of the status field of E and R lines.
+//
+// c.f. HMLAN_Parse in https://svn.fhem.de/trac/browser/trunk/fhem/FHEM/00_HMLAN.pm
+const (
+	// statusAck means the destination acknowledged the sent packet.
+	statusAck = 0x0001
+	// statusAESFailed means the AES handshake failed, e.g. because
+	// the device uses a different key.
+	statusAESFailed = 0x0010
+	// statusAES means the adapter verified the packet using AES.
+	statusAES = 0x0020 | 0x0040
+)
+
+// rLine is the result of sending a packet, as reported in an R line.
+type rLine struct {
+	ts     uint32
+	status uint16
+}
+
+// HMLAN is a connection to an HM-CFG-LAN. It implements
+// bidcos.Gateway.
+type HMLAN struct {
+	conn io.ReadWriteCloser
+	br   *bufio.Reader
+
+	// HMID is the BidCoS address of the central.
+	HMID [3]byte
+
+	// SerialNumber and FirmwareVersion are set from the adapter’s
+	// hello line.
+	SerialNumber    string
+	FirmwareVersion string
+
+	// writeMu serializes writing lines.
+	writeMu sync.Mutex
+
+	// received receives the packets of E and R lines, encoded like
+	// bidcos.Packet.Encode.
+	received chan []byte
+
+	// sent receives the status of R lines, see Confirm.
+	sent chan rLine
+
+	// sentTS and sentBiDi describe the packet of the most recent Write
+	// call. bidcos.Sender serializes Write/Confirm pairs.
+	sentTS   uint32
+	sentBiDi bool
+
+	// done is closed when the reader goroutine exits, after setting
+	// readErr.
+	done    chan struct{}
+	readErr error
+}
+
+// Dial connects to the HM-CFG-LAN at addr (host or host:port), see
+// NewHMLAN.
+func Dial(addr string, HMID [3]byte, now time.Time) (*HMLAN, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, DefaultPort)
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	h, err := NewHMLAN(conn, HMID, now)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+// NewHMLAN initializes the HM-CFG-LAN connected via conn. It starts a
+// goroutine which reads from conn until reading fails and one which
+// keeps the connection alive.
+func NewHMLAN(conn io.ReadWriteCloser, HMID [3]byte, now time.Time) (*HMLAN, error) {
+	h := &HMLAN{
+		conn:     conn,
+		br:       bufio.NewReader(conn),
+		HMID:     HMID,
+		received: make(chan []byte, 64),
+		sent:     make(chan rLine, 16),
+		done:     make(chan struct{}),
+	}
+	if err := h.init(now); err != nil {
+		return nil, err
+	}
+	go h.readLoop()
+	go h.keepAlive()
+	return h, nil
+}
+
+func (h *HMLAN) init(now time.Time) error {
+	line, err := h.readLine()
+	if err != nil {
+		return err
+	}
+	fields := strings.Split(line, ",")
+	if !strings.HasPrefix(line, "H") || len(fields) < 3 {
+		return fmt.Errorf("unexpected hello: %q", line)
+	}
+	h.FirmwareVersion = fields[1]
+	h.SerialNumber = fields[2]
+
+	for _, line := range []string{
+		fmt.Sprintf("A%X", h.HMID[:]),
+		"C",
+		// no AES keys until configured, see SetCurrentKey
+		"Y01,00,",
+		"Y02,00,",
+		"Y03,00,",
+	} {
+		if err := h.writeLine(line); err != nil {
+			return err
+		}
+	}
+	return h.SetTime(now)
+}
+
+func (h *HMLAN) readLine() (string, error) {
+	line, err := h.br.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (h *HMLAN) writeLine(line string) error {
+	h.writeMu.Lock()
+	defer h.writeMu.Unlock()
+	_, err := io.WriteString(h.conn, line+"\r\n")
+	return err
+}
+
+func (h *HMLAN) keepAlive() {
+	t := time.NewTicker(KeepAliveInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-h.done:
+			return
+		case <-t.C:
+		}
+		if err := h.writeLine("K"); err != nil {
+			log.Printf("HM-CFG-LAN keep-alive: %v", err)
+			return
+		}
+	}
+}
+
+// parseStatus returns the status field of an E or R line.
+func parseStatus(fields []string) (uint16, error) {
+	status, err := strconv.ParseUint(fields[1], 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid status: %v", err)
+	}
+	return uint16(status), nil
+}
+
+// decodePacket decodes the fields of an E or R line into a packet
+// encoded like bidcos.Packet.Encode, or returns nil if the line does
+// not contain a packet (e.g. an R line for a packet which was not
+// acknowledged).
+func decodePacket(line string) ([]byte, error) {
+	fields := strings.Split(line[1:], ",")
+	if got, want := len(fields), 6; got < want {
+		return nil, fmt.Errorf("too few fields: got %d, want %d", got, want)
+	}
+	status, err := parseStatus(fields)
+	if err != nil {
+		return nil, err
+	}
+	if fields[5] == "" {
+		return nil, nil
+	}
+	msg, err := hex.DecodeString(fields[5])
+	if err != nil {
+		return nil, err
+	}
+	rssi, err := strconv.ParseUint(fields[4], 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RSSI: %v", err)
+	}
+	// The HM-CFG-LAN reports the RSSI in dBm as a signed 16-bit
+	// number, bidcos.DecodeRSSI expects its negation.
+	raw := -int(int16(rssi))
+	if raw < 0 || raw > 255 {
+		raw = 0
+	}
+	var bstatus byte
+	switch {
+	case status&statusAESFailed != 0:
+		bstatus = bidcos.StatusWrongKey
+	case status&statusAES != 0:
+		bstatus = bidcos.StatusAES
+	}
+	return append([]byte{bstatus, 0x00, byte(raw)}, msg...), nil
+}
+
+// parseRLine returns the timestamp and status of an R line.
+func parseRLine(line string) (rLine, error) {
+	fields := strings.Split(line[1:], ",")
+	if got, want := len(fields), 2; got < want {
+		return rLine{}, fmt.Errorf("too few fields: got %d, want %d", got, want)
+	}
+	ts, err := strconv.ParseUint(fields[0], 16, 32)
+	if err != nil {
+		return rLine{}, fmt.Errorf("invalid timestamp: %v", err)
+	}
+	status, err := parseStatus(fields)
+	if err != nil {
+		return rLine{}, err
+	}
+	return rLine{ts: uint32(ts), status: status}, nil
+}
+
+func (h *HMLAN) readLoop() {
+	defer close(h.done)
+	for {
+		line, err := h.readLine()
+		if err != nil {
+			h.readErr = err
+			return
+		}
+		if line == "" {
+			continue
+		}
+		switch line[0] {
+		case 'E', 'R':
+			b, err := decodePacket(line)
+			if err != nil {
+				log.Printf("skipping invalid HM-CFG-LAN line %q: %v", line, err)
+				continue
+			}
+			if b != nil {
+				select {
+				case h.received <- b:
+				default:
+					log.Printf("HM-CFG-LAN receive buffer full, dropping packet %x", b)
+				}
+			}
+			if line[0] != 'R' {
+				continue
+			}
+			// decodePacket verified the fields.
+			r, _ := parseRLine(line)
+			select {
+			case h.sent <- r:
+			default:
+				log.Printf("HM-CFG-LAN confirm buffer full, dropping R line %q", line)
+			}
+
+		case 'H':
+			// The adapter repeats its hello in reply to keep-alives.
+
+		default:
+			log.Printf("ignoring HM-CFG-LAN line %q", line)
+		}
+	}
+}
+
+// Read implements io.Reader so that an HMLAN can be used by the bidcos
+// package.
+func (h *HMLAN) Read(p []byte) (n int, err error) {
+	select {
+	case b := <-h.received:
+		return copy(p, b), nil
+	case <-h.done:
+		return 0, h.readErr
+	}
+}
+
+// Write sends the BidCoS packet p, encoded by bidcos.Packet.Encode.
+func (h *HMLAN) Write(p []byte) (n int, err error) {
+	if got, want := len(p), 12; got < want {
+		return 0, fmt.Errorf("too short for a bidcos packet: got %d, want >= %d", got, want)
+	}
+	// The first timestamp identifies the packet in the R line.
+	ts := uint32(time.Now().UnixNano() / int64(time.Millisecond))
+	// Skip status, info and burst: the adapter determines whether to
+	// send a burst from the flags.
+	if err := h.writeLine(fmt.Sprintf("S%08X,00,00000000,01,%08X,%X", ts, ts, p[3:])); err != nil {
+		return 0, err
+	}
+	h.sentTS = ts
+	h.sentBiDi = p[4]&bidcos.BiDi != 0
+	return len(p), nil
+}
+
+// Confirm implements bidcos.Gateway. The HM-CFG-LAN reports the result
+// of sending a packet in an R line, which also contains the device’s
+// reply (if any). A BiDi packet which the destination did not
+// acknowledge results in bidcos.ErrNoAck.
+func (h *HMLAN) Confirm() error {
+	timeout := time.NewTimer(ConfirmTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case r := <-h.sent:
+			if r.ts != h.sentTS {
+				continue // R line of an earlier packet
+			}
+			if h.sentBiDi && r.status&statusAck == 0 {
+				return fmt.Errorf("HM-CFG-LAN: status %04X: %w", r.status, bidcos.ErrNoAck)
+			}
+			return nil
+		case <-timeout.C:
+			return fmt.Errorf("HM-CFG-LAN: no R line within %v: %w", ConfirmTimeout, bidcos.ErrNoAck)
+		case <-h.done:
+			return h.readErr
+		}
+	}
+}
+
+// Close closes the connection.
+func (h *HMLAN) Close() error {
+	return h.conn.Close()
+}
+
+// SetTime sets the time of the adapter, which devices request e.g. to
+// display it.
+func (h *HMLAN) SetTime(now time.Time) error {
+	epoch := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	_, offset := now.Zone()
+	return h.writeLine(fmt.Sprintf("T%08X,%02X,00,00000000", uint32(now.Sub(epoch)/time.Second), offset/1800))
+}
+
+// AddPeer adds the device with BidCoS address addr to the adapter’s
+// peer table. The adapter only acknowledges packets of peers.
+func (h *HMLAN) AddPeer(addr []byte, channels int) error {
+	if got, want := len(addr), 3; got != want {
+		return fmt.Errorf("unexpected address length: got %d, want %d", got, want)
+	}
+	return h.writeLine(fmt.Sprintf("+%X,00,00,", addr))
+}
+
+// AddPeerAES is like AddPeer, but additionally enables AES signing for
+// the device.
+func (h *HMLAN) AddPeerAES(addr []byte, channels int) error {
+	if got, want := len(addr), 3; got != want {
+		return fmt.Errorf("unexpected address length: got %d, want %d", got, want)
+	}
+	return h.writeLine(fmt.Sprintf("+%X,01,00,", addr))
+}
+
+// RemovePeer removes the device with BidCoS address addr from the
+// adapter’s peer table.
+func (h *HMLAN) RemovePeer(addr [3]byte) error {
+	return h.writeLine(fmt.Sprintf("-%X", addr[:]))
+}
+
+func (h *HMLAN) setKey(slot int, k bidcos.Key) error {
+	return h.writeLine(fmt.Sprintf("Y%02X,%02X,%X", slot, k.Index, k.Key[:]))
+}
+
+// SetCurrentKey makes the adapter sign packets to and verify packets of
+// AES peers (see AddPeerAES) using k.
+func (h *HMLAN) SetCurrentKey(k bidcos.Key) error { return h.setKey(1, k) }
+
+// SetPreviousKey makes the adapter accept k from AES peers which were
+// not yet switched to the current key.
+func (h *HMLAN) SetPreviousKey(k bidcos.Key) error { return h.setKey(2, k) }
+
+// SetTempKey makes the adapter accept k while AES peers are switched to
+// k, see bidcos.Sender.ChangeKey.
+func (h *HMLAN) SetTempKey(k bidcos.Key) error { return h.setKey(3, k) }
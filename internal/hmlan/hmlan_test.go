@@ -0,0 +1,163 @@
+package hmlan_test
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stapelberg/hmgo/internal/bidcos"
+	"github.com/stapelberg/hmgo/internal/hmlan"
+)
+
+var (
+	hmid    = [3]byte{0xfd, 0xb0, 0x2c}
+	thermal = [3]byte{0x39, 0x06, 0xeb}
+)
+
+// fakeHMLAN accepts one connection on l, sends the hello line and
+// returns the connection.
+func fakeHMLAN(t *testing.T, l net.Listener) (net.Conn, *bufio.Reader) {
+	conn, err := l.Accept()
+	if err != nil {
+		t.Error(err)
+		return nil, nil
+	}
+	if _, err := io.WriteString(conn, "HHM-LAN-IF,03C4,JEQ0123456,1F9F93,FDB02C,05D22A39,0000\r\n"); err != nil {
+		t.Error(err)
+	}
+	return conn, bufio.NewReader(conn)
+}
+
+func readLines(t *testing.T, br *bufio.Reader, n int) []string {
+	var lines []string
+	for i := 0; i < n; i++ {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Error(err)
+			return lines
+		}
+		lines = append(lines, strings.TrimRight(line, "\r\n"))
+	}
+	return lines
+}
+
+func TestHMLAN(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	type server struct {
+		conn net.Conn
+		br   *bufio.Reader
+	}
+	accepted := make(chan server)
+	go func() {
+		conn, br := fakeHMLAN(t, l)
+		accepted <- server{conn, br}
+	}()
+
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	h, err := hmlan.Dial(l.Addr().String(), hmid, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	srv := <-accepted
+	defer srv.conn.Close()
+
+	if got, want := h.SerialNumber, "JEQ0123456"; got != want {
+		t.Errorf("unexpected serial number: got %q, want %q", got, want)
+	}
+
+	want := []string{
+		"AFDB02C",
+		"C",
+		"Y01,00,",
+		"Y02,00,",
+		"Y03,00,",
+		"T1FFB0300,00,00,00000000",
+	}
+	if got := readLines(t, srv.br, len(want)); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected init: got %q, want %q", got, want)
+	}
+
+	bcs, err := bidcos.NewSender(h, hmid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AddPeer(thermal[:], 2); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readLines(t, srv.br, 1)[0], "+3906EB,00,00,"; got != want {
+		t.Fatalf("unexpected add peer line: got %q, want %q", got, want)
+	}
+
+	events := bcs.Subscribe()
+	// an unacknowledged R line without packet, then a weather event
+	io.WriteString(srv.conn, "R5D1B7E1C,0002,5D1B7E21,FF,FFC3,\r\n")
+	io.WriteString(srv.conn, "E3906EB,0000,5D1B7E20,FF,FFC4,4286703906EB00000000FD39\r\n")
+	pkt := <-events
+	if got, want := pkt.Cmd, byte(bidcos.WeatherEvent); got != want {
+		t.Fatalf("unexpected cmd: got %x, want %x", got, want)
+	}
+	if got, want := pkt.Source, thermal; got != want {
+		t.Fatalf("unexpected source: got %x, want %x", got, want)
+	}
+	if got, want := pkt.RSSI, -60; got != want {
+		t.Fatalf("unexpected RSSI: got %d, want %d", got, want)
+	}
+	if pkt.AES() || pkt.WrongKey() {
+		t.Fatalf("unexpected AES status of unsigned packet: %x", pkt.Status)
+	}
+
+	for _, tt := range []struct {
+		status        string
+		aes, wrongKey bool
+	}{
+		{status: "0040", aes: true},
+		{status: "0050", wrongKey: true},
+	} {
+		io.WriteString(srv.conn, "E3906EB,"+tt.status+",5D1B7E20,FF,FFC4,4286703906EB00000000FD39\r\n")
+		pkt := <-events
+		if got, want := pkt.AES(), tt.aes; got != want {
+			t.Errorf("status %s: AES() = %v, want %v", tt.status, got, want)
+		}
+		if got, want := pkt.WrongKey(), tt.wrongKey; got != want {
+			t.Errorf("status %s: WrongKey() = %v, want %v", tt.status, got, want)
+		}
+	}
+
+	for _, tt := range []struct {
+		status  string
+		wantErr error
+	}{
+		{status: "0001"},
+		{status: "0008", wantErr: bidcos.ErrNoAck},
+	} {
+		done := make(chan error)
+		go func() {
+			done <- bcs.WritePacket(&bidcos.Packet{
+				Msgcnt:  0x42,
+				Flags:   bidcos.DefaultFlags,
+				Cmd:     bidcos.Config,
+				Dest:    thermal,
+				Payload: []byte{0x00, 0x03},
+			})
+		}()
+		line := readLines(t, srv.br, 1)[0]
+		if got, want := line[strings.LastIndex(line, ",")+1:], "42A001FDB02C3906EB0003"; got != want {
+			t.Fatalf("unexpected send line %q: got packet %s, want %s", line, got, want)
+		}
+		ts := line[1:strings.Index(line, ",")]
+		io.WriteString(srv.conn, "R"+ts+","+tt.status+",5D1B7E21,FF,FFC3,\r\n")
+		if err := <-done; !errors.Is(err, tt.wantErr) {
+			t.Errorf("status %s: WritePacket() = %v, want %v", tt.status, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,555 @@
+// Package inventory loads the list of HomeMatic devices which hmgo
+// talks to from a JSON file.
+/*
+
+An inventory file looks like this:
+
+    {
+      "devices": [
+        {
+          "serial": "MEQ0089016",
+          "address": "3906eb",
+          "name": "Wohnzimmer",
+          "type": "thermal",
+          "peers": ["MEQ0059922"],
+          "schedule": "Mon-Fri 06:00-10:00 22.0, 17:00-23:00 22.0, else 17.0; Sat-Sun 06:00-23:00 22.0, else 17.0"
+        },
+        {
+          "serial": "MEQ0059922",
+          "address": "38f59c",
+          "name": "Wohnzimmer",
+          "type": "heating",
+          "peers": ["MEQ0089016"]
+        }
+      ]
+    }
+
+Each device is identified by its serial number (printed on the device)
+and its BidCoS address (sent in every packet, e.g. visible in the
+“ignoring packet from unknown device” log message). The type selects
+which hm package implements the device:
+
+    thermal  HM-TC-IT-WM-W-EU (wall thermostat)
+    heating  HM-CC-RT-DN (radiator valve drive)
+    power    HM-ES-PMSw1-Pl (power switch)
+
+Devices which are paired while hmgo’s pairing window is open are
+appended to the inventory file with a placeholder name, see Append.
+
+Peers lists the serial numbers of the devices which should be peered
+with this device. A thermal device is peered on its
+ThermalControlTransmit channel, a heating device on its
+ClimateControlReceiver channel. Other peers of that channel (e.g.
+peered by hand) are removed, unless peers is empty.
+
+AES (“"aes": true”) makes the gateway sign commands to and verify
+events of the device using the installation’s AES key (see the
+-aes_key_file flag), as required e.g. by window contacts and door
+locks.
+
+Schedule is the weekly heating program of a thermal device, see
+thermal.ParseSchedule for the format.
+
+Overlays modify the schedule of the thermal devices which list them
+while they are active, e.g.:
+
+    "overlays": [
+      {"name": "winter", "from": "09-01", "to": "04-30", "after": "06:00", "temperature": 24.0},
+      {"name": "holiday", "from": "2026-12-24", "to": "2027-01-06", "schedule": "Mon-Sun else 17.0"}
+    ]
+
+The winter overlay heats to 24 degC after 06:00 every year from
+September until April, the holiday overlay replaces the schedule
+during a specific date range. Active overlays are applied in the
+order in which the device lists them.
+
+*/
+package inventory
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/stapelberg/hmgo/internal/hm/thermal"
+)
+
+// Device types
+const (
+	Thermal = "thermal"
+	Heating = "heating"
+	Power   = "power"
+)
+
+// Device is a HomeMatic device as configured in the inventory file.
+type Device struct {
+	Serial string
+	Addr   [3]byte
+	Name   string
+	Type   string
+	Peers  []string
+
+	// AES is whether packets of the device are signed.
+	AES bool
+
+	// Schedule is the weekly heating schedule of a thermal device as
+	// specified in the inventory file, Programs is its parsed form.
+	Schedule string
+	Programs []thermal.Program
+
+	// Overlays lists the names of the overlays which modify Programs
+	// while they are active.
+	Overlays []string
+
+	// ValveOffset, if non-nil, is written into the valve offset
+	// register of a thermal device.
+	ValveOffset *int
+
+	// Line is the line number at which the device was defined in the
+	// inventory file, for error messages.
+	Line int
+}
+
+// Overlay is a thermal.Overlay as configured in the inventory file.
+type Overlay struct {
+	*thermal.Overlay
+
+	// Line is the line number at which the overlay was defined in the
+	// inventory file, for error messages.
+	Line int
+}
+
+// Inventory is the set of configured devices.
+type Inventory struct {
+	Devices  []*Device
+	Overlays []*Overlay
+}
+
+// Overlay returns the overlay with the specified name, or nil.
+func (i *Inventory) Overlay(name string) *thermal.Overlay {
+	for _, o := range i.Overlays {
+		if o.Name == name {
+			return o.Overlay
+		}
+	}
+	return nil
+}
+
+// OverlaysFor returns the overlays which apply to d, in order.
+func (i *Inventory) OverlaysFor(d *Device) []*thermal.Overlay {
+	result := make([]*thermal.Overlay, 0, len(d.Overlays))
+	for _, name := range d.Overlays {
+		result = append(result, i.Overlay(name))
+	}
+	return result
+}
+
+// BySerial returns the device with the specified serial number, or
+// nil.
+func (i *Inventory) BySerial(serial string) *Device {
+	for _, d := range i.Devices {
+		if d.Serial == serial {
+			return d
+		}
+	}
+	return nil
+}
+
+type deviceJSON struct {
+	Serial      string   `json:"serial"`
+	Address     string   `json:"address"`
+	Name        string   `json:"name"`
+	Type        string   `json:"type"`
+	Peers       []string `json:"peers,omitempty"`
+	AES         bool     `json:"aes,omitempty"`
+	Schedule    string   `json:"schedule,omitempty"`
+	Overlays    []string `json:"overlays,omitempty"`
+	ValveOffset *int     `json:"valve_offset,omitempty"`
+}
+
+type overlayJSON struct {
+	Name        string  `json:"name"`
+	From        string  `json:"from"`
+	To          string  `json:"to"`
+	Schedule    string  `json:"schedule"`
+	After       string  `json:"after"`
+	Temperature float64 `json:"temperature"`
+}
+
+func (oj *overlayJSON) overlay() (*thermal.Overlay, error) {
+	if oj.Name == "" {
+		return nil, fmt.Errorf("overlay has no name")
+	}
+	o := &thermal.Overlay{Name: oj.Name}
+	var err error
+	if o.From, err = thermal.ParseDate(oj.From); err != nil {
+		return nil, fmt.Errorf("overlay %s: %v", oj.Name, err)
+	}
+	if o.To, err = thermal.ParseDate(oj.To); err != nil {
+		return nil, fmt.Errorf("overlay %s: %v", oj.Name, err)
+	}
+	if (o.From.Year == 0) != (o.To.Year == 0) {
+		return nil, fmt.Errorf("overlay %s: from and to must both either specify a year or not", oj.Name)
+	}
+	if o.From.Year != 0 && o.From.String() > o.To.String() {
+		return nil, fmt.Errorf("overlay %s: ends (%v) before it starts (%v)", oj.Name, o.To, o.From)
+	}
+	if oj.Schedule != "" {
+		if o.Schedule, err = thermal.ParseSchedule(oj.Schedule); err != nil {
+			return nil, fmt.Errorf("overlay %s: invalid schedule: %v", oj.Name, err)
+		}
+	}
+	if oj.Temperature != 0 {
+		if err := thermal.CheckTemperature(oj.Temperature); err != nil {
+			return nil, fmt.Errorf("overlay %s: %v", oj.Name, err)
+		}
+		o.Temperature = oj.Temperature
+		if oj.After != "" {
+			if o.After, err = thermal.ParseTime(oj.After); err != nil {
+				return nil, fmt.Errorf("overlay %s: %v", oj.Name, err)
+			}
+		}
+	} else if oj.After != "" {
+		return nil, fmt.Errorf("overlay %s: after requires temperature", oj.Name)
+	}
+	if o.Schedule == nil && o.Temperature == 0 {
+		return nil, fmt.Errorf("overlay %s: neither schedule nor temperature specified", oj.Name)
+	}
+	return o, nil
+}
+
+// Load reads and validates the inventory file at path.
+func Load(path string) (*Inventory, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	inv, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return inv, nil
+}
+
+// lineAt returns the line number of the first token at or after
+// offset in b.
+func lineAt(b []byte, offset int64) int {
+	if offset > int64(len(b)) {
+		offset = int64(len(b))
+	}
+	// Skip the whitespace and separator which the json.Decoder has not
+	// consumed yet.
+	for offset < int64(len(b)) && bytes.IndexByte([]byte(" \t\r\n,"), b[offset]) > -1 {
+		offset++
+	}
+	return 1 + bytes.Count(b[:offset], []byte{'\n'})
+}
+
+// jsonError annotates JSON syntax and type errors with a line number.
+func jsonError(b []byte, err error) error {
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return fmt.Errorf("line %d: %v", lineAt(b, syntaxErr.Offset), err)
+	}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return fmt.Errorf("line %d: %v", lineAt(b, typeErr.Offset), err)
+	}
+	return err
+}
+
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if got, ok := tok.(json.Delim); !ok || got != want {
+		return fmt.Errorf("unexpected token: got %v, want %v", tok, want)
+	}
+	return nil
+}
+
+// decodeArray calls decode for each element of the JSON array which
+// dec is positioned at, passing the line number of the element.
+func decodeArray(dec *json.Decoder, b []byte, decode func(line int) error) error {
+	if err := expectDelim(dec, '['); err != nil {
+		return jsonError(b, err)
+	}
+	for dec.More() {
+		if err := decode(lineAt(b, dec.InputOffset())); err != nil {
+			return err
+		}
+	}
+	if err := expectDelim(dec, ']'); err != nil {
+		return jsonError(b, err)
+	}
+	return nil
+}
+
+// Parse parses and validates an inventory. All validation errors are
+// returned, each prefixed with the line number of the offending
+// device.
+func Parse(b []byte) (*Inventory, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, jsonError(b, err)
+	}
+	var inv Inventory
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, jsonError(b, err)
+		}
+		switch key := tok.(string); key {
+		case "devices":
+			if err := decodeArray(dec, b, func(line int) error {
+				var dj deviceJSON
+				if err := dec.Decode(&dj); err != nil {
+					return jsonError(b, err)
+				}
+				d, err := dj.device()
+				if err != nil {
+					return fmt.Errorf("line %d: %v", line, err)
+				}
+				d.Line = line
+				inv.Devices = append(inv.Devices, d)
+				return nil
+			}); err != nil {
+				return nil, err
+			}
+
+		case "overlays":
+			if err := decodeArray(dec, b, func(line int) error {
+				var oj overlayJSON
+				if err := dec.Decode(&oj); err != nil {
+					return jsonError(b, err)
+				}
+				o, err := oj.overlay()
+				if err != nil {
+					return fmt.Errorf("line %d: %v", line, err)
+				}
+				inv.Overlays = append(inv.Overlays, &Overlay{Overlay: o, Line: line})
+				return nil
+			}); err != nil {
+				return nil, err
+			}
+
+		default:
+			return nil, fmt.Errorf("line %d: unknown key %q", lineAt(b, dec.InputOffset()), key)
+		}
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return nil, jsonError(b, err)
+	}
+	if err := inv.validate(); err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+func (dj *deviceJSON) device() (*Device, error) {
+	addr, err := hex.DecodeString(dj.Address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q: %v", dj.Address, err)
+	}
+	if got, want := len(addr), 3; got != want {
+		return nil, fmt.Errorf("invalid address %q: got %d bytes, want %d", dj.Address, got, want)
+	}
+	var programs []thermal.Program
+	if dj.Schedule != "" {
+		if programs, err = thermal.ParseSchedule(dj.Schedule); err != nil {
+			return nil, fmt.Errorf("invalid schedule: %v", err)
+		}
+	}
+	return &Device{
+		Serial:      dj.Serial,
+		Addr:        [3]byte{addr[0], addr[1], addr[2]},
+		Name:        dj.Name,
+		Type:        dj.Type,
+		Peers:       dj.Peers,
+		AES:         dj.AES,
+		Schedule:    dj.Schedule,
+		Programs:    programs,
+		Overlays:    dj.Overlays,
+		ValveOffset: dj.ValveOffset,
+	}, nil
+}
+
+func (i *Inventory) validate() error {
+	var errs []error
+	fail := func(d *Device, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("line %d: %s", d.Line, fmt.Sprintf(format, args...)))
+	}
+
+	overlays := make(map[string]*Overlay)
+	for _, o := range i.Overlays {
+		if other, ok := overlays[o.Name]; ok {
+			errs = append(errs, fmt.Errorf("line %d: duplicate overlay %s (already configured on line %d)", o.Line, o.Name, other.Line))
+			continue
+		}
+		overlays[o.Name] = o
+	}
+
+	bySerial := make(map[string]*Device)
+	byAddr := make(map[[3]byte]*Device)
+	for _, d := range i.Devices {
+		// BidCoS serial numbers are always 10 characters, see the
+		// DeviceInfo payload.
+		if got, want := len(d.Serial), 10; got != want {
+			fail(d, "invalid serial %q: got %d characters, want %d", d.Serial, got, want)
+		}
+		if d.Name == "" {
+			fail(d, "device %s has no name", d.Serial)
+		}
+		switch d.Type {
+		case Thermal, Heating, Power:
+		default:
+			fail(d, "device %s has unknown type %q (want %q, %q or %q)", d.Serial, d.Type, Thermal, Heating, Power)
+		}
+		if d.Schedule != "" && d.Type != Thermal {
+			fail(d, "schedule is only supported for type %q", Thermal)
+		}
+		for _, name := range d.Overlays {
+			if d.Schedule == "" {
+				fail(d, "overlays require a schedule")
+				break
+			}
+			if i.Overlay(name) == nil {
+				fail(d, "overlay %q not configured", name)
+			}
+		}
+		if d.ValveOffset != nil {
+			if d.Type != Thermal {
+				fail(d, "valve_offset is only supported for type %q", Thermal)
+			}
+			if *d.ValveOffset < 0 || *d.ValveOffset > 127 {
+				fail(d, "valve_offset %d out of range [0, 127]", *d.ValveOffset)
+			}
+		}
+		if other, ok := bySerial[d.Serial]; ok {
+			if other.Addr != d.Addr {
+				fail(d, "serial %s configured with address %x, but line %d configures it with address %x", d.Serial, d.Addr, other.Line, other.Addr)
+			} else {
+				fail(d, "duplicate serial %s (already configured on line %d)", d.Serial, other.Line)
+			}
+		} else {
+			bySerial[d.Serial] = d
+		}
+		if other, ok := byAddr[d.Addr]; ok && other.Serial != d.Serial {
+			fail(d, "duplicate address %x (already used by serial %s on line %d)", d.Addr, other.Serial, other.Line)
+		} else if !ok {
+			byAddr[d.Addr] = d
+		}
+	}
+
+	for _, d := range i.Devices {
+		for _, serial := range d.Peers {
+			peer, ok := bySerial[serial]
+			if !ok {
+				fail(d, "device %s: peer %s not configured", d.Serial, serial)
+				continue
+			}
+			switch {
+			case d.Type == Thermal && peer.Type == Heating,
+				d.Type == Heating && peer.Type == Thermal:
+			default:
+				fail(d, "device %s: cannot peer type %q with type %q", d.Serial, d.Type, peer.Type)
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Append adds d to the devices of the inventory file at path, keeping
+// the rest of the file (e.g. its formatting) as-is. The file is only
+// replaced (atomically) if the resulting inventory is valid.
+func Append(path string, d *Device) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	offset, empty, err := devicesEnd(b)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	dj, err := json.MarshalIndent(&deviceJSON{
+		Serial:      d.Serial,
+		Address:     hex.EncodeToString(d.Addr[:]),
+		Name:        d.Name,
+		Type:        d.Type,
+		Peers:       d.Peers,
+		AES:         d.AES,
+		Schedule:    d.Schedule,
+		Overlays:    d.Overlays,
+		ValveOffset: d.ValveOffset,
+	}, "    ", "  ")
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	buf.Write(b[:offset])
+	if empty {
+		buf.WriteString("\n    ")
+	} else {
+		buf.WriteString(",\n    ")
+	}
+	buf.Write(dj)
+	if empty {
+		buf.WriteString("\n  ")
+	}
+	buf.Write(b[offset:])
+	if _, err := Parse(buf.Bytes()); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".new", buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".new", path)
+}
+
+// devicesEnd returns the offset in b right after the last element of
+// the devices array (or after its opening bracket if the array is
+// empty).
+func devicesEnd(b []byte) (offset int64, empty bool, _ error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if err := expectDelim(dec, '{'); err != nil {
+		return 0, false, jsonError(b, err)
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return 0, false, jsonError(b, err)
+		}
+		if key, _ := tok.(string); key != "devices" {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return 0, false, jsonError(b, err)
+			}
+			continue
+		}
+		if err := expectDelim(dec, '['); err != nil {
+			return 0, false, jsonError(b, err)
+		}
+		empty = true
+		for dec.More() {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return 0, false, jsonError(b, err)
+			}
+			empty = false
+		}
+		// The decoder has already skipped the whitespace before the
+		// closing bracket.
+		offset := dec.InputOffset()
+		for offset > 0 && bytes.IndexByte([]byte(" \t\r\n"), b[offset-1]) > -1 {
+			offset--
+		}
+		return offset, empty, nil
+	}
+	return 0, false, fmt.Errorf("no devices array")
+}
@@ -0,0 +1,239 @@
+package inventory_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stapelberg/hmgo/internal/inventory"
+)
+
+func TestParse(t *testing.T) {
+	inv, err := inventory.Load("../../contrib/inventory/inventory.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(inv.Devices), 9; got != want {
+		t.Fatalf("unexpected number of devices: got %d, want %d", got, want)
+	}
+	bad := inv.BySerial("MEQ0090662")
+	if bad == nil {
+		t.Fatalf("device MEQ0090662 not found")
+	}
+	if got, want := bad.Addr, [3]byte{0x39, 0x0f, 0x17}; got != want {
+		t.Fatalf("unexpected address: got %x, want %x", got, want)
+	}
+	if got, want := bad.Line, 13; got != want {
+		t.Fatalf("unexpected line: got %d, want %d", got, want)
+	}
+	if got, want := len(inv.OverlaysFor(bad)), 1; got != want {
+		t.Fatalf("unexpected number of overlays: got %d, want %d", got, want)
+	}
+	if bad.ValveOffset == nil || *bad.ValveOffset != 100 {
+		t.Fatalf("unexpected valve offset: got %v, want 100", bad.ValveOffset)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		input   string
+		wantErr []string
+	}{
+		{
+			name: "DuplicateAddress",
+			input: `{"devices": [
+{"serial": "MEQ0090662", "address": "390f17", "name": "a", "type": "thermal"},
+{"serial": "MEQ0089016", "address": "390f17", "name": "b", "type": "thermal"}
+]}`,
+			wantErr: []string{"line 3: duplicate address 390f17 (already used by serial MEQ0090662 on line 2)"},
+		},
+
+		{
+			name: "SerialAddressMismatch",
+			input: `{"devices": [
+{"serial": "MEQ0090662", "address": "390f17", "name": "a", "type": "thermal"},
+{"serial": "MEQ0090662", "address": "3906eb", "name": "a", "type": "thermal"}
+]}`,
+			wantErr: []string{"line 3: serial MEQ0090662 configured with address 3906eb, but line 2 configures it with address 390f17"},
+		},
+
+		{
+			name: "UnknownType",
+			input: `{"devices": [
+{"serial": "MEQ0090662", "address": "390f17", "name": "a", "type": "thermal"},
+
+{"serial": "MEQ0089016", "address": "3906eb", "name": "b", "type": "window"}
+]}`,
+			wantErr: []string{`line 4: device MEQ0089016 has unknown type "window"`},
+		},
+
+		{
+			name: "MultipleErrors",
+			input: `{"devices": [
+{"serial": "MEQ0090662", "address": "390f17", "name": "a", "type": "thermal", "peers": ["MEQ1341845"]},
+{"serial": "MEQ1341845", "address": "40c2a8", "name": "", "type": "power"}
+]}`,
+			wantErr: []string{
+				"line 2: device MEQ0090662: cannot peer type \"thermal\" with type \"power\"",
+				"line 3: device MEQ1341845 has no name",
+			},
+		},
+
+		{
+			name: "InvalidAddress",
+			input: `{"devices": [
+{"serial": "MEQ0090662", "address": "390f", "name": "a", "type": "thermal"}
+]}`,
+			wantErr: []string{`line 2: invalid address "390f"`},
+		},
+
+		{
+			name: "InvalidSchedule",
+			input: `{"devices": [
+{"serial": "MEQ0090662", "address": "390f17", "name": "a", "type": "thermal",
+ "schedule": "Mon-Fri 06:00-10:07 22.0, else 17.0"}
+]}`,
+			wantErr: []string{`line 2: invalid schedule: rule "Mon-Fri 06:00-10:07 22.0, else 17.0": invalid time "10:07": not on a 5 minute boundary`},
+		},
+
+		{
+			name: "UnknownOverlay",
+			input: `{"overlays": [
+{"name": "winter", "from": "09-01", "to": "04-30", "temperature": 24.0}
+], "devices": [
+{"serial": "MEQ0090662", "address": "390f17", "name": "a", "type": "thermal",
+ "schedule": "Mon-Sun else 17.0", "overlays": ["summer"]}
+]}`,
+			wantErr: []string{`line 4: overlay "summer" not configured`},
+		},
+
+		{
+			name: "InvalidOverlayDate",
+			input: `{"overlays": [
+{"name": "winter", "from": "09-01", "to": "04-31", "temperature": 24.0}
+]}`,
+			wantErr: []string{`line 2: overlay winter: invalid date "04-31": no such day`},
+		},
+
+		{
+			name: "SyntaxError",
+			input: `{"devices": [
+{"serial": "MEQ0090662", "address": "390f17", "name": "a", "type": "thermal"},
+{"serial": "MEQ0089016" "address": "3906eb"}
+]}`,
+			wantErr: []string{"line 3: "},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := inventory.Parse([]byte(tt.input))
+			if err == nil {
+				t.Fatalf("Parse unexpectedly succeeded")
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("unexpected error: got %q, want it to contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAppend(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name: "Empty",
+			input: `{
+  "devices": []
+}
+`,
+			want: `{
+  "devices": [
+    {
+      "serial": "MEQ1234567",
+      "address": "3e5a01",
+      "name": "new-MEQ1234567",
+      "type": "power"
+    }
+  ]
+}
+`,
+		},
+
+		{
+			name: "AfterDevices",
+			input: `{
+  "devices": [
+    {"serial": "MEQ0090662", "address": "390f17", "name": "a", "type": "thermal"}
+  ],
+  "overlays": []
+}
+`,
+			want: `{
+  "devices": [
+    {"serial": "MEQ0090662", "address": "390f17", "name": "a", "type": "thermal"},
+    {
+      "serial": "MEQ1234567",
+      "address": "3e5a01",
+      "name": "new-MEQ1234567",
+      "type": "power"
+    }
+  ],
+  "overlays": []
+}
+`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "inventory.json")
+			if err := os.WriteFile(path, []byte(tt.input), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := inventory.Append(path, &inventory.Device{
+				Serial: "MEQ1234567",
+				Addr:   [3]byte{0x3e, 0x5a, 0x01},
+				Name:   "new-MEQ1234567",
+				Type:   inventory.Power,
+			}); err != nil {
+				t.Fatal(err)
+			}
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := string(b), tt.want; got != want {
+				t.Fatalf("unexpected inventory: got %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestAppendInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "inventory.json")
+	const input = `{"devices": [
+{"serial": "MEQ1234567", "address": "3e5a01", "name": "a", "type": "power"}
+]}`
+	if err := os.WriteFile(path, []byte(input), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := inventory.Append(path, &inventory.Device{
+		Serial: "MEQ1234567",
+		Addr:   [3]byte{0x3e, 0x5a, 0x01},
+		Name:   "b",
+		Type:   inventory.Power,
+	}); err == nil {
+		t.Fatalf("Append of a duplicate serial unexpectedly succeeded")
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), input; got != want {
+		t.Fatalf("inventory unexpectedly modified: got %s, want %s", got, want)
+	}
+}
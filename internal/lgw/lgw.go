@@ -0,0 +1,191 @@
+// Package lgw connects to an eQ-3 HM-LGW-O-TW-W-FS LAN gateway.
+//
+// The HM-LGW contains the same radio module as the HM-MOD-RPI-PCB and
+// forwards its frames over TCP (port 2000), so that uartgw.UARTGW can
+// talk to it once the connection is set up. Before the binary frames
+// start, the LGW and its client exchange ASCII lines:
+//
+//	LGW:    H00,01,eQ3-HM-LGW,1.1.5,KEQ0123456
+//	LGW:    S00,BidCoS-over-LAN,1.0
+//	client: L01,02,00FF,00
+//
+// The first field of each line is a counter, which the client
+// continues. A second connection (port 2001, “SysCom”) must be kept
+// alive by sending K lines at least every 30 seconds, otherwise the LGW
+// closes both connections.
+//
+// Encryption of the LAN connection (the “LAN key”) is not supported, it
+// needs to be disabled in the LGW’s configuration.
+//
+// c.f. https://svn.fhem.de/trac/browser/trunk/fhem/FHEM/00_HMUARTLGW.pm?rev=13367
+package lgw
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default ports of the LGW.
+const (
+	BidCoSPort = "2000"
+	SysComPort = "2001"
+)
+
+// KeepAliveInterval is how often Conn sends a keep-alive line.
+var KeepAliveInterval = 15 * time.Second
+
+// Conn is a connection to an LGW. Once Dial returns, reading from and
+// writing to Conn transfers UARTGW frames.
+type Conn struct {
+	net.Conn
+	br *bufio.Reader
+
+	syscom net.Conn
+	// cnt is the counter of the SysCom connection, only used by
+	// keepAlive once Dial returns.
+	cnt uint8
+
+	done chan struct{}
+}
+
+// Dial connects to the LGW at host (without port).
+func Dial(host string) (*Conn, error) {
+	return dial(net.JoinHostPort(host, BidCoSPort), net.JoinHostPort(host, SysComPort))
+}
+
+func dial(bidcosAddr, syscomAddr string) (*Conn, error) {
+	bidcos, err := net.Dial("tcp", bidcosAddr)
+	if err != nil {
+		return nil, err
+	}
+	syscom, err := net.Dial("tcp", syscomAddr)
+	if err != nil {
+		bidcos.Close()
+		return nil, err
+	}
+	c, err := newConn(bidcos, syscom)
+	if err != nil {
+		bidcos.Close()
+		syscom.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func newConn(bidcos, syscom net.Conn) (*Conn, error) {
+	c := &Conn{
+		Conn:   bidcos,
+		br:     bufio.NewReader(bidcos),
+		syscom: syscom,
+		done:   make(chan struct{}),
+	}
+	if _, err := handshake(c.br, bidcos, "BidCoS"); err != nil {
+		return nil, fmt.Errorf("BidCoS connection: %v", err)
+	}
+	sbr := bufio.NewReader(syscom)
+	cnt, err := handshake(sbr, syscom, "SysCom")
+	if err != nil {
+		return nil, fmt.Errorf("SysCom connection: %v", err)
+	}
+	c.cnt = cnt
+	go c.discard(sbr)
+	go c.keepAlive()
+	return c, nil
+}
+
+// readLine reads an ASCII line and returns its counter and fields.
+func readLine(br *bufio.Reader) (typ byte, cnt uint8, fields []string, err error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	fields = strings.Split(line, ",")
+	if len(fields[0]) != 3 {
+		return 0, 0, nil, fmt.Errorf("malformed line %q", line)
+	}
+	n, err := strconv.ParseUint(fields[0][1:], 16, 8)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("malformed line %q: %v", line, err)
+	}
+	return fields[0][0], uint8(n), fields[1:], nil
+}
+
+// handshake reads the hello (H) and service (S) lines, verifies the
+// service is want and replies with an L line. It returns the counter
+// of the L line.
+func handshake(br *bufio.Reader, w io.Writer, want string) (uint8, error) {
+	typ, _, fields, err := readLine(br)
+	if err != nil {
+		return 0, err
+	}
+	if typ != 'H' || len(fields) < 4 {
+		return 0, fmt.Errorf("unexpected hello: %c %q", typ, fields)
+	}
+	log.Printf("connected to %s (firmware %s, serial %s)", fields[1], fields[2], fields[3])
+
+	typ, cnt, fields, err := readLine(br)
+	if err != nil {
+		return 0, err
+	}
+	if typ == 'V' {
+		// The LGW sends a challenge for the LAN key instead.
+		return 0, fmt.Errorf("LGW requires LAN key encryption, which is not supported")
+	}
+	if typ != 'S' || len(fields) < 1 {
+		return 0, fmt.Errorf("unexpected service line: %c %q", typ, fields)
+	}
+	if service, _, _ := strings.Cut(fields[0], "-"); service != want {
+		return 0, fmt.Errorf("unexpected service: got %q, want %s", fields[0], want)
+	}
+	cnt++
+	if _, err := fmt.Fprintf(w, "L%02X,02,00FF,00\r\n", cnt); err != nil {
+		return 0, err
+	}
+	return cnt, nil
+}
+
+// discard reads (and ignores) the LGW’s keep-alive replies.
+func (c *Conn) discard(br *bufio.Reader) {
+	for {
+		if _, err := br.ReadString('\n'); err != nil {
+			return
+		}
+	}
+}
+
+func (c *Conn) keepAlive() {
+	t := time.NewTicker(KeepAliveInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+		}
+		c.cnt++
+		if _, err := fmt.Fprintf(c.syscom, "K%02X\r\n", c.cnt); err != nil {
+			log.Printf("LGW keep-alive: %v", err)
+			return
+		}
+	}
+}
+
+// Read reads UARTGW frames, which may already have been buffered
+// during the handshake.
+func (c *Conn) Read(p []byte) (int, error) {
+	return c.br.Read(p)
+}
+
+// Close closes both connections.
+func (c *Conn) Close() error {
+	close(c.done)
+	c.syscom.Close()
+	return c.Conn.Close()
+}
@@ -0,0 +1,133 @@
+package lgw
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeLGW accepts one connection on l, performs the handshake for
+// service and returns the connection and the client’s lines.
+func fakeLGW(t *testing.T, l net.Listener, service string) (net.Conn, *bufio.Reader) {
+	conn, err := l.Accept()
+	if err != nil {
+		t.Error(err)
+		return nil, nil
+	}
+	if _, err := io.WriteString(conn, "H00,01,eQ3-HM-LGW,1.1.5,KEQ0123456\r\nS00,"+service+"\r\n"); err != nil {
+		t.Error(err)
+	}
+	return conn, bufio.NewReader(conn)
+}
+
+func listen(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestDial(t *testing.T) {
+	oldInterval := KeepAliveInterval
+	KeepAliveInterval = 10 * time.Millisecond
+	defer func() { KeepAliveInterval = oldInterval }()
+
+	bl, sl := listen(t), listen(t)
+	defer bl.Close()
+	defer sl.Close()
+
+	// An OSGetApp frame, sent right after the handshake so that it
+	// arrives in the same TCP segment.
+	frame := []byte{0xfd, 0x00, 0x0d, 0x00, 0x00, 0x00, 'C', 'o', '_', 'C', 'P', 'U', '_', 'A', 'p', 'p'}
+
+	type result struct {
+		lines []string
+		err   error
+	}
+	done := make(chan result)
+	go func() {
+		var res result
+		bidcos, br := fakeLGW(t, bl, "BidCoS-over-LAN,1.0")
+		if bidcos == nil {
+			done <- res
+			return
+		}
+		defer bidcos.Close()
+		line, err := br.ReadString('\n')
+		if err != nil {
+			res.err = err
+			done <- res
+			return
+		}
+		res.lines = append(res.lines, line)
+		bidcos.Write(frame)
+
+		syscom, sbr := fakeLGW(t, sl, "SysCom-1.0")
+		if syscom == nil {
+			done <- res
+			return
+		}
+		defer syscom.Close()
+		// handshake reply and two keep-alives
+		for i := 0; i < 3; i++ {
+			line, err := sbr.ReadString('\n')
+			if err != nil {
+				res.err = err
+				break
+			}
+			res.lines = append(res.lines, line)
+		}
+		done <- res
+	}()
+
+	c, err := dial(bl.Addr().String(), sl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	got := make([]byte, len(frame))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, frame) {
+		t.Fatalf("unexpected frame: got %x, want %x", got, frame)
+	}
+
+	res := <-done
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	want := []string{
+		"L01,02,00FF,00\r\n",
+		"L01,02,00FF,00\r\n",
+		"K02\r\n",
+		"K03\r\n",
+	}
+	if got := strings.Join(res.lines, ""); got != strings.Join(want, "") {
+		t.Fatalf("unexpected lines: got %q, want %q", res.lines, want)
+	}
+}
+
+func TestDialEncrypted(t *testing.T) {
+	bl, sl := listen(t), listen(t)
+	defer bl.Close()
+	defer sl.Close()
+	go func() {
+		conn, err := bl.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "H00,01,eQ3-HM-LGW,1.1.5,KEQ0123456\r\nV00,0123456789ABCDEF0123456789ABCDEF\r\n")
+		io.Copy(io.Discard, conn)
+	}()
+	if _, err := dial(bl.Addr().String(), sl.Addr().String()); err == nil || !strings.Contains(err.Error(), "LAN key") {
+		t.Fatalf("unexpected error: got %v, want LAN key error", err)
+	}
+}
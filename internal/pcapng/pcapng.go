@@ -0,0 +1,114 @@
+// Package pcapng writes packet captures in the pcapng format, which
+// Wireshark can read.
+//
+// c.f. https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-01.html
+package pcapng
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// LinkTypeUser15 is LINKTYPE_USER15 (DLT_USER15), on which
+// contrib/wireshark/homematic.lua registers its HM-UARTGW dissector.
+const LinkTypeUser15 = 162
+
+// Direction is the direction of a packet, stored in the epb_flags
+// option.
+type Direction uint32
+
+const (
+	Unknown  Direction = 0
+	Inbound  Direction = 1
+	Outbound Direction = 2
+)
+
+// block types
+const (
+	sectionHeader    = 0x0a0d0d0a
+	interfaceDesc    = 0x00000001
+	enhancedPacket   = 0x00000006
+	byteOrderMagic   = 0x1a2b3c4d
+	optEndOfOpt      = 0
+	optIfTsresol     = 9
+	optEpbFlags      = 2
+	tsresolNanosec   = 9
+	maxSnapLen       = 0 // no limit
+	sectionLenAbsent = 0xffffffffffffffff
+)
+
+var le = binary.LittleEndian
+
+// Writer writes a section with a single interface.
+type Writer struct {
+	w io.Writer
+}
+
+// NewWriter writes a section header and an interface description for
+// linkType to w. Appending another section to an existing file results
+// in a valid pcapng file.
+func NewWriter(w io.Writer, linkType uint16) (*Writer, error) {
+	var shb []byte
+	shb = le.AppendUint32(shb, byteOrderMagic)
+	shb = le.AppendUint16(shb, 1) // major version
+	shb = le.AppendUint16(shb, 0) // minor version
+	shb = le.AppendUint64(shb, sectionLenAbsent)
+	if err := writeBlock(w, sectionHeader, shb); err != nil {
+		return nil, err
+	}
+
+	var idb []byte
+	idb = le.AppendUint16(idb, linkType)
+	idb = le.AppendUint16(idb, 0) // reserved
+	idb = le.AppendUint32(idb, maxSnapLen)
+	idb = appendOption(idb, optIfTsresol, []byte{tsresolNanosec})
+	idb = appendOption(idb, optEndOfOpt, nil)
+	if err := writeBlock(w, interfaceDesc, idb); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w}, nil
+}
+
+// WritePacket writes data, captured at t, as an enhanced packet block.
+func (w *Writer) WritePacket(t time.Time, dir Direction, data []byte) error {
+	ts := uint64(t.UnixNano())
+	var epb []byte
+	epb = le.AppendUint32(epb, 0) // interface id
+	epb = le.AppendUint32(epb, uint32(ts>>32))
+	epb = le.AppendUint32(epb, uint32(ts))
+	epb = le.AppendUint32(epb, uint32(len(data))) // captured length
+	epb = le.AppendUint32(epb, uint32(len(data))) // original length
+	epb = append(epb, pad(data)...)
+	if dir != Unknown {
+		epb = appendOption(epb, optEpbFlags, le.AppendUint32(nil, uint32(dir)))
+		epb = appendOption(epb, optEndOfOpt, nil)
+	}
+	return writeBlock(w.w, enhancedPacket, epb)
+}
+
+// pad pads b to a multiple of 4 bytes.
+func pad(b []byte) []byte {
+	if rem := len(b) % 4; rem != 0 {
+		return append(b[:len(b):len(b)], make([]byte, 4-rem)...)
+	}
+	return b
+}
+
+func appendOption(b []byte, code uint16, value []byte) []byte {
+	b = le.AppendUint16(b, code)
+	b = le.AppendUint16(b, uint16(len(value)))
+	return append(b, pad(value)...)
+}
+
+// writeBlock writes a block with a single Write call.
+func writeBlock(w io.Writer, typ uint32, body []byte) error {
+	length := uint32(4 + 4 + len(body) + 4)
+	var b []byte
+	b = le.AppendUint32(b, typ)
+	b = le.AppendUint32(b, length)
+	b = append(b, body...)
+	b = le.AppendUint32(b, length)
+	_, err := w.Write(b)
+	return err
+}
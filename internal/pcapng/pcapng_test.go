@@ -0,0 +1,60 @@
+package pcapng_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stapelberg/hmgo/internal/pcapng"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := pcapng.NewWriter(&buf, pcapng.LinkTypeUser15)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WritePacket(time.Unix(1, 2), pcapng.Inbound, []byte{0xfd, 0x00, 0x03, 0x01, 0x00, 0x05, 0x12, 0x34}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WritePacket(time.Unix(0, 0), pcapng.Unknown, []byte{0x42}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := unhex(t, `
+0a0d0d0a 1c000000 4d3c2b1a 0100 0000 ffffffffffffffff 1c000000
+
+01000000 20000000 a200 0000 00000000
+0900 0100 09000000
+0000 0000
+20000000
+
+06000000 34000000 00000000
+00000000 02ca9a3b
+08000000 08000000
+fd000301 00051234
+0200 0400 01000000
+0000 0000
+34000000
+
+06000000 24000000 00000000
+00000000 00000000
+01000000 01000000
+42000000
+24000000
+`)
+	if got := buf.Bytes(); !bytes.Equal(got, want) {
+		t.Fatalf("unexpected capture:\ngot  %x\nwant %x", got, want)
+	}
+}
@@ -0,0 +1,235 @@
+// Package recording records the bytes exchanged with a serial port
+// (e.g. the HM-MOD-RPI-PCB) and replays them in tests.
+//
+// A recording is a text file with one event per line:
+//
+//	<seconds since start> <r|w> <hex bytes>
+//
+// e.g. “0.004211 r fd000c000000436f5f4350555f424c7251”. r events were
+// read from the serial port, w events were written to it. Empty lines
+// and lines starting with # are ignored.
+package recording
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Recorder logs all bytes read from and written to a serial port.
+type Recorder struct {
+	rw    io.ReadWriter
+	start time.Time
+
+	mu  sync.Mutex
+	log io.Writer
+}
+
+// NewRecorder returns an io.ReadWriter which reads from and writes to
+// rw, logging all bytes to log.
+func NewRecorder(rw io.ReadWriter, log io.Writer) *Recorder {
+	return &Recorder{
+		rw:    rw,
+		start: time.Now(),
+		log:   log,
+	}
+}
+
+func (r *Recorder) record(dir byte, p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Errors are deliberately ignored: a failing recording must not
+	// interrupt talking to the serial port.
+	fmt.Fprintf(r.log, "%.6f %c %x\n", time.Since(r.start).Seconds(), dir, p)
+}
+
+func (r *Recorder) Read(p []byte) (n int, err error) {
+	n, err = r.rw.Read(p)
+	r.record('r', p[:n])
+	return n, err
+}
+
+func (r *Recorder) Write(p []byte) (n int, err error) {
+	n, err = r.rw.Write(p)
+	r.record('w', p[:n])
+	return n, err
+}
+
+// SetReadDeadline passes through to the serial port, so that
+// uartgw.UARTGW.Watchdog keeps working while recording.
+func (r *Recorder) SetReadDeadline(t time.Time) error {
+	d, ok := r.rw.(interface{ SetReadDeadline(time.Time) error })
+	if !ok {
+		return fmt.Errorf("%T does not support read deadlines", r.rw)
+	}
+	return d.SetReadDeadline(t)
+}
+
+type event struct {
+	line int
+	dir  byte
+	data []byte
+}
+
+// parse reads a recording.
+func parse(r io.Reader) ([]event, error) {
+	var events []event
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if got, want := len(fields), 3; got != want {
+			return nil, fmt.Errorf("line %d: unexpected number of fields: got %d, want %d", line, got, want)
+		}
+		if _, err := strconv.ParseFloat(fields[0], 64); err != nil {
+			return nil, fmt.Errorf("line %d: invalid time: %v", line, err)
+		}
+		if fields[1] != "r" && fields[1] != "w" {
+			return nil, fmt.Errorf("line %d: unexpected direction %q, want r or w", line, fields[1])
+		}
+		data, err := hex.DecodeString(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		events = append(events, event{line: line, dir: fields[1][0], data: data})
+	}
+	return events, scanner.Err()
+}
+
+// Replayer is an io.ReadWriter which replays a recording: Read returns
+// the recorded bytes once all bytes which were written before them
+// were written, Write fails unless the bytes match the recording.
+// Timestamps are ignored.
+type Replayer struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	events []event
+	pos    int // index of the current event
+	off    int // offset into the data of the current event
+	err    error
+	closed bool
+}
+
+// NewReplayer returns a Replayer for the recording read from r.
+func NewReplayer(r io.Reader) (*Replayer, error) {
+	events, err := parse(r)
+	if err != nil {
+		return nil, err
+	}
+	rp := &Replayer{events: events}
+	rp.cond = sync.NewCond(&rp.mu)
+	return rp, nil
+}
+
+// advance moves past n bytes of the current event. The caller must
+// hold mu.
+func (rp *Replayer) advance(n int) {
+	rp.off += n
+	if rp.off == len(rp.events[rp.pos].data) {
+		rp.pos++
+		rp.off = 0
+	}
+	rp.cond.Broadcast()
+}
+
+// Read blocks until the next event is a read event and returns its
+// bytes. Once the recording is exhausted, Read blocks until Close is
+// called and then returns io.EOF.
+func (rp *Replayer) Read(p []byte) (n int, err error) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	for {
+		if rp.err != nil {
+			return 0, rp.err
+		}
+		if rp.closed {
+			return 0, io.EOF
+		}
+		if rp.pos < len(rp.events) && rp.events[rp.pos].dir == 'r' {
+			break
+		}
+		rp.cond.Wait()
+	}
+	n = copy(p, rp.events[rp.pos].data[rp.off:])
+	rp.advance(n)
+	return n, nil
+}
+
+// Write verifies that p matches the next write events. Write blocks
+// until all bytes recorded before them were read.
+func (rp *Replayer) Write(p []byte) (n int, err error) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if rp.err != nil {
+		return 0, rp.err
+	}
+	for n < len(p) {
+		if rp.pos == len(rp.events) {
+			rp.err = fmt.Errorf("unexpected write %x after the end of the recording", p[n:])
+			break
+		}
+		ev := rp.events[rp.pos]
+		if ev.dir != 'w' {
+			// Frames which the device sent before this write (e.g.
+			// unsolicited BidCoS packets) need to be read first.
+			if rp.closed {
+				rp.err = fmt.Errorf("line %d: unexpected write %x, want read of %x", ev.line, p[n:], ev.data[rp.off:])
+				break
+			}
+			rp.cond.Wait()
+			continue
+		}
+		want := ev.data[rp.off:]
+		got := p[n:]
+		if len(got) > len(want) {
+			got = got[:len(want)]
+		}
+		if !bytes.HasPrefix(want, got) {
+			rp.err = fmt.Errorf("line %d: unexpected write: got %x, want %x", ev.line, p[n:], want)
+			break
+		}
+		n += len(got)
+		rp.advance(len(got))
+	}
+	if rp.err != nil {
+		rp.cond.Broadcast()
+		return n, rp.err
+	}
+	return n, nil
+}
+
+// Close makes pending and future Read calls return io.EOF.
+func (rp *Replayer) Close() error {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	rp.closed = true
+	rp.cond.Broadcast()
+	return nil
+}
+
+// Err returns the first mismatch between the written bytes and the
+// recording, or an error if not all of the recording was replayed.
+func (rp *Replayer) Err() error {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if rp.err != nil {
+		return rp.err
+	}
+	if rp.pos < len(rp.events) {
+		ev := rp.events[rp.pos]
+		return fmt.Errorf("line %d: recording not fully replayed, next event: %c %x", ev.line, ev.dir, ev.data[rp.off:])
+	}
+	return nil
+}
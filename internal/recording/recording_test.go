@@ -0,0 +1,94 @@
+package recording_test
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stapelberg/hmgo/internal/recording"
+)
+
+// port is a serial port which has rx to read.
+type port struct {
+	rx *bytes.Reader
+	tx bytes.Buffer
+}
+
+func (p *port) Read(b []byte) (int, error)  { return p.rx.Read(b) }
+func (p *port) Write(b []byte) (int, error) { return p.tx.Write(b) }
+
+func TestRecordReplay(t *testing.T) {
+	var log bytes.Buffer
+	p := &port{rx: bytes.NewReader([]byte{0xfd, 0x00, 0x01})}
+	rec := recording.NewRecorder(p, &log)
+	rec.Write([]byte{0x01, 0x02})
+	rec.Write([]byte{0x03})
+	buf := make([]byte, 16)
+	n, _ := rec.Read(buf)
+	if got, want := buf[:n], []byte{0xfd, 0x00, 0x01}; !bytes.Equal(got, want) {
+		t.Fatalf("unexpected read: got %x, want %x", got, want)
+	}
+	rec.Write([]byte{0x04})
+
+	lines := strings.Split(strings.TrimSpace(log.String()), "\n")
+	var events []string
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		events = append(events, strings.Join(fields[1:], " "))
+	}
+	if got, want := strings.Join(events, ","), "w 0102,w 03,r fd0001,w 04"; got != want {
+		t.Fatalf("unexpected recording: got %q, want %q", got, want)
+	}
+
+	rp, err := recording.NewReplayer(&log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Writes may be split differently than recorded.
+	if _, err := rp.Write([]byte{0x01}); err != nil {
+		t.Fatal(err)
+	}
+	read := make(chan []byte)
+	go func() {
+		buf := make([]byte, 2)
+		n, _ := rp.Read(buf)
+		read <- buf[:n]
+	}()
+	if _, err := rp.Write([]byte{0x02, 0x03}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := <-read, []byte{0xfd, 0x00}; !bytes.Equal(got, want) {
+		t.Fatalf("unexpected read: got %x, want %x", got, want)
+	}
+	if err := rp.Err(); err == nil {
+		t.Fatal("Err unexpectedly returned nil before the recording was replayed")
+	}
+	if n, _ := rp.Read(buf); n != 1 || buf[0] != 0x01 {
+		t.Fatalf("unexpected read: got %x, want 01", buf[:n])
+	}
+	if _, err := rp.Write([]byte{0x05}); err == nil {
+		t.Fatal("Write of unexpected bytes unexpectedly succeeded")
+	}
+	if err := rp.Err(); err == nil {
+		t.Fatal("Err unexpectedly returned nil after a mismatch")
+	}
+}
+
+func TestReplayEOF(t *testing.T) {
+	rp, err := recording.NewReplayer(strings.NewReader("# comment\n\n0.000000 r 42\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	if n, err := rp.Read(buf); err != nil || n != 1 {
+		t.Fatalf("Read = %d, %v, want 1, nil", n, err)
+	}
+	if err := rp.Err(); err != nil {
+		t.Fatal(err)
+	}
+	rp.Close()
+	if _, err := rp.Read(buf); err != io.EOF {
+		t.Fatalf("Read after Close: got %v, want %v", err, io.EOF)
+	}
+}
@@ -11,6 +11,12 @@ import (
 
 // Configure configures fd as a 115200 baud 8N1 serial port.
 func Configure(fd uintptr) error {
+	return ConfigureSpeed(fd, syscall.B115200)
+}
+
+// ConfigureSpeed configures fd as an 8N1 serial port with the specified
+// speed, e.g. syscall.B38400.
+func ConfigureSpeed(fd uintptr, speed uint32) error {
 	var termios syscall.Termios
 	if _, _, err := syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(syscall.TCGETS), uintptr(unsafe.Pointer(&termios))); err != 0 {
 		return err
@@ -19,9 +25,9 @@ func Configure(fd uintptr) error {
 	termios.Iflag = 0
 	termios.Oflag = 0
 	termios.Lflag = 0
-	termios.Ispeed = syscall.B115200
-	termios.Ospeed = syscall.B115200
-	termios.Cflag = syscall.B115200 | syscall.CS8 | syscall.CREAD
+	termios.Ispeed = speed
+	termios.Ospeed = speed
+	termios.Cflag = speed | syscall.CS8 | syscall.CREAD
 
 	// Block on a zero read (instead of returning EOF)
 	termios.Cc[syscall.VMIN] = 1
@@ -0,0 +1,199 @@
+// Package share makes the frames of a UARTGW available to other
+// programs (e.g. a sniffer, a test harness or FHEM) while hmgo remains
+// the only user of the serial port.
+//
+// Clients connect to a stream socket (TCP or Unix). The server sends
+// one record for every frame read from or written to the UARTGW, and
+// one for every packet injected by the client:
+//
+//	uint8   type: 'r' (frame read from the UARTGW),
+//	              'w' (frame written to the UARTGW) or
+//	              's' (status of an injected packet)
+//	int64   time in nanoseconds since the UNIX epoch (big endian)
+//	uint16  length of data (big endian)
+//	[]byte  data
+//
+// The data of 'r' and 'w' records is the unescaped frame between
+// length and checksum, i.e. destination, message counter, command and
+// payload. The data of 's' records is empty when the packet was sent,
+// or an error message otherwise.
+//
+// Clients inject BidCoS packets by sending:
+//
+//	uint16  length of packet (big endian)
+//	[]byte  packet as sent by AppSend: status, info, burst, message
+//	        counter, flags, command, source, destination, payload
+//	        (see bidcos.Packet.Encode)
+//
+// Injected packets are sent in order, each one is answered with an 's'
+// record after the gateway acknowledged it. 'r' and 'w' records are
+// dropped while a client is too slow to receive them, 's' records are
+// not.
+package share
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/stapelberg/hmgo/internal/uartgw"
+)
+
+// Record types.
+const (
+	Read   = 'r'
+	Write  = 'w'
+	Status = 's'
+)
+
+// Record is a record as sent to clients.
+type Record struct {
+	Type byte
+	Time time.Time
+	Data []byte
+}
+
+// WriteTo writes r to w in the format described in the package
+// documentation.
+func (r *Record) WriteTo(w io.Writer) (int64, error) {
+	if len(r.Data) > 0xffff {
+		return 0, fmt.Errorf("record too long: %d bytes", len(r.Data))
+	}
+	b := make([]byte, 1+8+2, 1+8+2+len(r.Data))
+	b[0] = r.Type
+	binary.BigEndian.PutUint64(b[1:], uint64(r.Time.UnixNano()))
+	binary.BigEndian.PutUint16(b[9:], uint16(len(r.Data)))
+	b = append(b, r.Data...)
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+// ReadRecord reads a record in the format described in the package
+// documentation.
+func ReadRecord(r io.Reader) (*Record, error) {
+	var hdr [1 + 8 + 2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	rec := &Record{
+		Type: hdr[0],
+		Time: time.Unix(0, int64(binary.BigEndian.Uint64(hdr[1:]))),
+		Data: make([]byte, binary.BigEndian.Uint16(hdr[9:])),
+	}
+	if _, err := io.ReadFull(r, rec.Data); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// WritePacket injects the BidCoS packet pkt, see the package
+// documentation.
+func WritePacket(w io.Writer, pkt []byte) error {
+	if len(pkt) > 0xffff {
+		return fmt.Errorf("packet too long: %d bytes", len(pkt))
+	}
+	b := make([]byte, 2, 2+len(pkt))
+	binary.BigEndian.PutUint16(b, uint16(len(pkt)))
+	_, err := w.Write(append(b, pkt...))
+	return err
+}
+
+// Gateway is implemented by *uartgw.UARTGW.
+type Gateway interface {
+	Observe(f func(uartgw.Frame)) (cancel func())
+	AppSend(payload []byte) error
+}
+
+// queueLen is how many records are queued for a client before further
+// 'r' and 'w' records are dropped.
+const queueLen = 256
+
+// Serve accepts connections on ln and serves them until ln is closed.
+func Serve(ln net.Listener, gw Gateway) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go serveConn(conn, gw)
+	}
+}
+
+func serveConn(conn net.Conn, gw Gateway) {
+	defer conn.Close()
+	log.Printf("share: client %v connected", conn.RemoteAddr())
+	defer log.Printf("share: client %v disconnected", conn.RemoteAddr())
+
+	records := make(chan *Record, queueLen)
+	done := make(chan struct{})
+	defer close(done)
+	// written is closed when the writer goroutine exits.
+	written := make(chan struct{})
+	enqueue := func(r *Record) {
+		select {
+		case records <- r:
+		case <-done:
+		default:
+			log.Printf("share: client %v too slow, dropping record", conn.RemoteAddr())
+		}
+	}
+	cancel := gw.Observe(func(f uartgw.Frame) {
+		typ := byte(Read)
+		if f.Direction == uartgw.Sent {
+			typ = Write
+		}
+		enqueue(&Record{Type: typ, Time: f.Time, Data: f.Data})
+	})
+	defer cancel()
+
+	go func() {
+		defer close(written)
+		bw := bufio.NewWriter(conn)
+		for {
+			select {
+			case <-done:
+				return
+			case r := <-records:
+				if _, err := r.WriteTo(bw); err != nil {
+					conn.Close()
+					return
+				}
+				// Flush once the queue is drained.
+				if len(records) == 0 {
+					if err := bw.Flush(); err != nil {
+						conn.Close()
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	br := bufio.NewReader(conn)
+	for {
+		var length uint16
+		if err := binary.Read(br, binary.BigEndian, &length); err != nil {
+			return
+		}
+		pkt := make([]byte, length)
+		if _, err := io.ReadFull(br, pkt); err != nil {
+			return
+		}
+		status := &Record{Type: Status}
+		if err := gw.AppSend(pkt); err != nil {
+			status.Data = []byte(err.Error())
+		}
+		status.Time = time.Now()
+		// Wait for room instead of dropping the status: the client
+		// waits for it before injecting the next packet.
+		select {
+		case records <- status:
+		case <-written:
+			return
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package share_test
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stapelberg/hmgo/internal/share"
+	"github.com/stapelberg/hmgo/internal/uartgw"
+)
+
+// fakeGateway implements share.Gateway.
+type fakeGateway struct {
+	mu        sync.Mutex
+	observers []func(uartgw.Frame)
+	sent      chan []byte
+	observed  chan struct{}
+}
+
+func (g *fakeGateway) Observe(f func(uartgw.Frame)) (cancel func()) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.observers = append(g.observers, f)
+	close(g.observed)
+	return func() {}
+}
+
+func (g *fakeGateway) AppSend(payload []byte) error {
+	g.sent <- payload
+	if payload[0] == 0xff {
+		return errors.New("invalid packet")
+	}
+	return nil
+}
+
+func (g *fakeGateway) frame(f uartgw.Frame) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, o := range g.observers {
+		o(f)
+	}
+}
+
+func readRecord(t *testing.T, conn net.Conn) *share.Record {
+	t.Helper()
+	r, err := share.ReadRecord(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestServe(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	gw := &fakeGateway{
+		sent:     make(chan []byte, 1),
+		observed: make(chan struct{}),
+	}
+	go share.Serve(ln, gw)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	<-gw.observed
+
+	now := time.Unix(1483228800, 42)
+	gw.frame(uartgw.Frame{Time: now, Direction: uartgw.Received, Data: []byte{0x01, 0x00, 0x05, 0xfd}})
+	gw.frame(uartgw.Frame{Time: now, Direction: uartgw.Sent, Data: []byte{0x01, 0x01, 0x02}})
+
+	for _, want := range []share.Record{
+		{Type: share.Read, Time: now, Data: []byte{0x01, 0x00, 0x05, 0xfd}},
+		{Type: share.Write, Time: now, Data: []byte{0x01, 0x01, 0x02}},
+	} {
+		got := readRecord(t, conn)
+		if got.Type != want.Type || !got.Time.Equal(want.Time) || !bytes.Equal(got.Data, want.Data) {
+			t.Fatalf("unexpected record: got %c %v %x, want %c %v %x", got.Type, got.Time, got.Data, want.Type, want.Time, want.Data)
+		}
+	}
+
+	for _, tt := range []struct {
+		pkt  []byte
+		want string
+	}{
+		{[]byte{0x00, 0x00, 0x00, 0x42, 0xa0, 0x01, 0xfd, 0xb0, 0x2c, 0x39, 0x06, 0xeb}, ""},
+		{[]byte{0xff}, "invalid packet"},
+	} {
+		if err := share.WritePacket(conn, tt.pkt); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-gw.sent; !bytes.Equal(got, tt.pkt) {
+			t.Fatalf("unexpected injected packet: got %x, want %x", got, tt.pkt)
+		}
+		got := readRecord(t, conn)
+		if got.Type != share.Status || string(got.Data) != tt.want {
+			t.Fatalf("unexpected status: got %c %q, want %c %q", got.Type, got.Data, share.Status, tt.want)
+		}
+	}
+}
+
+// pipeListener hands out the server end of in-memory, unbuffered
+// connections, see dial.
+type pipeListener struct {
+	conns chan net.Conn
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	conn, ok := <-l.conns
+	if !ok {
+		return nil, net.ErrClosed
+	}
+	return conn, nil
+}
+
+func (l *pipeListener) Close() error {
+	close(l.conns)
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr { return pipeAddr{} }
+
+func (l *pipeListener) dial() net.Conn {
+	client, server := net.Pipe()
+	l.conns <- server
+	return client
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+func TestServeSlowClient(t *testing.T) {
+	ln := &pipeListener{conns: make(chan net.Conn)}
+	defer ln.Close()
+	gw := &fakeGateway{
+		sent:     make(chan []byte, 1),
+		observed: make(chan struct{}),
+	}
+	go share.Serve(ln, gw)
+
+	conn := ln.dial()
+	defer conn.Close()
+	<-gw.observed
+
+	// The client does not read, so the queue fills up and further 'r'
+	// records are dropped. The records exceed the write buffer.
+	data := make([]byte, 8192)
+	for i := 0; i < 1024; i++ {
+		gw.frame(uartgw.Frame{Time: time.Now(), Direction: uartgw.Received, Data: data})
+	}
+
+	pkt := []byte{0x00, 0x00, 0x00, 0x42, 0xa0, 0x01, 0xfd, 0xb0, 0x2c, 0x39, 0x06, 0xeb}
+	if err := share.WritePacket(conn, pkt); err != nil {
+		t.Fatal(err)
+	}
+	<-gw.sent
+
+	// The status record must not be dropped.
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		r := readRecord(t, conn)
+		if r.Type == share.Status {
+			if len(r.Data) > 0 {
+				t.Fatalf("unexpected status: got %q, want %q", r.Data, "")
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,447 @@
+package simulator
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/stapelberg/hmgo/internal/bidcos"
+	"github.com/stapelberg/hmgo/internal/hm"
+)
+
+// List identifies a parameter list (“paramlist”) of a device channel.
+// Lists which are specific to a peer are not simulated.
+type List struct {
+	Channel byte
+	List    byte
+}
+
+// Model describes a simulated device model.
+type Model struct {
+	// Name is the eQ-3 model name, e.g. HM-CC-RT-DN.
+	Name string
+
+	// Type, Firmware, Class and PeerChannels are sent in DeviceInfo
+	// packets (see bidcos.DeviceInfoFrame and Simulator.SendDeviceInfo).
+	Type         uint16
+	Firmware     byte
+	Class        byte
+	PeerChannels [2]byte
+
+	// Lists returns the registers (and their factory defaults) of all
+	// lists of the model. Registers which are not listed are ignored
+	// when written, like the firmware does.
+	Lists func() map[List]map[byte]byte
+
+	// events returns the packets which the device sends periodically.
+	events func(d *Device, v Values) []*bidcos.Packet
+}
+
+// deviceList contains the registers of list 0 (the device list) which
+// all models share: the visibility of internal keys (0x02) and the
+// address of the central (0x0a–0x0c, see hm.StandardDevice.Pair).
+func deviceList() map[byte]byte {
+	return map[byte]byte{
+		0x02: 0x00,
+		0x0a: 0x00,
+		0x0b: 0x00,
+		0x0c: 0x00,
+	}
+}
+
+// climateList returns list 7 of the HM-TC-IT-WM-W-EU and HM-CC-RT-DN:
+// settings in registers 1–19, followed by the weekly program. Each day
+// consists of 13 entries of 2 bytes (see thermal.ThermalControl),
+// which default to 17°C until 24:00.
+func climateList() map[byte]byte {
+	l := make(map[byte]byte)
+	for reg := byte(1); reg < 20; reg++ {
+		l[reg] = 0x00
+	}
+	l[12] = 100 // valve maximum in percent
+	for reg := 20; reg < 20+7*13*2; reg += 2 {
+		endtime := uint16(1440 / 5)
+		temperature := uint16(17.0 * 2)
+		l[byte(reg)] = byte(endtime>>8&0x01 | (temperature&hm.Mask6Bit)<<1)
+		l[byte(reg+1)] = byte(endtime)
+	}
+	return l
+}
+
+// Simulated models.
+var (
+	// ThermalControl is a HM-TC-IT-WM-W-EU wall thermostat, see
+	// thermal.ThermalControl.
+	ThermalControl = &Model{
+		Name:         "HM-TC-IT-WM-W-EU",
+		Type:         0x00ad,
+		Firmware:     0x12,
+		Class:        0x10,
+		PeerChannels: [2]byte{0x01, 0x03},
+		Lists: func() map[List]map[byte]byte {
+			return map[List]map[byte]byte{
+				{Channel: 0, List: 0}: deviceList(),
+				{Channel: 0, List: 7}: climateList(),
+			}
+		},
+		events: thermalControlEvents,
+	}
+
+	// Thermostat is a HM-CC-RT-DN radiator thermostat, see
+	// heating.Thermostat.
+	Thermostat = &Model{
+		Name:         "HM-CC-RT-DN",
+		Type:         0x0095,
+		Firmware:     0x14,
+		Class:        0x58,
+		PeerChannels: [2]byte{0x03, 0x00},
+		Lists: func() map[List]map[byte]byte {
+			return map[List]map[byte]byte{
+				{Channel: 0, List: 0}: deviceList(),
+				{Channel: 4, List: 7}: climateList(),
+			}
+		},
+		events: thermostatEvents,
+	}
+
+	// PowerSwitch is a HM-ES-PMSw1-Pl switch actuator with power meter,
+	// see power.PowerSwitch.
+	PowerSwitch = &Model{
+		Name:         "HM-ES-PMSw1-Pl",
+		Type:         0x00ac,
+		Firmware:     0x13,
+		Class:        0x10,
+		PeerChannels: [2]byte{0x01, 0x00},
+		Lists: func() map[List]map[byte]byte {
+			return map[List]map[byte]byte{
+				{Channel: 0, List: 0}: deviceList(),
+			}
+		},
+		events: powerSwitchEvents,
+	}
+)
+
+// Device is a simulated device.
+type Device struct {
+	Model  *Model
+	Addr   [3]byte
+	Serial string
+
+	// Interval is how often the device sends its periodic events (see
+	// Simulator.Emit) once added to a Simulator. Zero disables periodic
+	// events.
+	Interval time.Duration
+
+	mu     sync.Mutex
+	values Values
+	lists  map[List]map[byte]byte
+	peers  map[byte][]hm.FullyQualifiedChannel
+	levels map[byte]byte
+	msgcnt byte
+	// session is the list being written between ConfigStart and
+	// ConfigEnd, nil otherwise.
+	session *List
+}
+
+// NewDevice returns a device of model m in its factory state, with
+// DefaultValues.
+func NewDevice(m *Model, addr [3]byte, serial string) *Device {
+	return &Device{
+		Model:  m,
+		Addr:   addr,
+		Serial: serial,
+		values: DefaultValues,
+		lists:  m.Lists(),
+		peers:  make(map[byte][]hm.FullyQualifiedChannel),
+		levels: make(map[byte]byte),
+	}
+}
+
+// SetValues sets the values which the device reports in its events.
+func (d *Device) SetValues(v Values) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.values = v
+}
+
+// Values returns the values which the device reports in its events.
+func (d *Device) Values() Values {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.values
+}
+
+// Registers returns a copy of the registers of list l, or nil if the
+// device has no such list.
+func (d *Device) Registers(l List) map[byte]byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	regs, ok := d.lists[l]
+	if !ok {
+		return nil
+	}
+	c := make(map[byte]byte, len(regs))
+	for reg, val := range regs {
+		c[reg] = val
+	}
+	return c
+}
+
+// Peers returns the peers of channel.
+func (d *Device) Peers(channel byte) []hm.FullyQualifiedChannel {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]hm.FullyQualifiedChannel(nil), d.peers[channel]...)
+}
+
+// AddPeer peers channel with peer, like pressing the buttons of both
+// devices would.
+func (d *Device) AddPeer(channel byte, peer hm.FullyQualifiedChannel) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.addPeer(channel, peer)
+}
+
+func (d *Device) addPeer(channel byte, peer hm.FullyQualifiedChannel) {
+	for _, p := range d.peers[channel] {
+		if p == peer {
+			return
+		}
+	}
+	d.peers[channel] = append(d.peers[channel], peer)
+}
+
+func (d *Device) removePeer(channel byte, peer hm.FullyQualifiedChannel) {
+	peers := d.peers[channel]
+	for i, p := range peers {
+		if p == peer {
+			d.peers[channel] = append(peers[:i:i], peers[i+1:]...)
+			return
+		}
+	}
+}
+
+// Level returns the level of channel as set by the central, e.g.
+// power.On for the switch channel of a PowerSwitch.
+func (d *Device) Level(channel byte) byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.levels[channel]
+}
+
+// nextMsgcnt returns the message counter for the next packet which is
+// not a reply. The caller must hold mu.
+func (d *Device) nextMsgcnt() byte {
+	d.msgcnt++
+	if d.msgcnt == 0 {
+		d.msgcnt++
+	}
+	return d.msgcnt
+}
+
+func (d *Device) deviceInfo() *bidcos.Packet {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m := d.Model
+	info := &bidcos.DeviceInfoFrame{
+		Firmware:     m.Firmware,
+		Model:        m.Type,
+		Serial:       d.Serial,
+		Class:        m.Class,
+		PeerChannels: m.PeerChannels,
+		Descriptor:   []byte{0x00},
+	}
+	return &bidcos.Packet{
+		Msgcnt:  d.nextMsgcnt(),
+		Flags:   bidcos.RepeatEnable | bidcos.Broadcast,
+		Cmd:     bidcos.DeviceInfo,
+		Source:  d.Addr,
+		Payload: info.Encode(),
+	}
+}
+
+func (d *Device) events(central [3]byte) []*bidcos.Packet {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	pkts := d.Model.events(d, d.values)
+	for _, pkt := range pkts {
+		pkt.Msgcnt = d.nextMsgcnt()
+		pkt.Source = d.Addr
+		pkt.Dest = central
+	}
+	return pkts
+}
+
+// maxPayload is the number of payload bytes which the firmware puts
+// into a single packet.
+const maxPayload = 17
+
+// handle processes pkt like the device firmware and returns the
+// device’s replies.
+func (d *Device) handle(pkt *bidcos.Packet) []*bidcos.Packet {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var replies []*bidcos.Packet
+	// reply queues a reply, the first one using the message counter of
+	// pkt, further ones (e.g. multi-packet parameter responses) using
+	// the device’s own message counter.
+	reply := func(cmd byte, payload ...byte) {
+		msgcnt := pkt.Msgcnt
+		if len(replies) > 0 {
+			msgcnt = d.nextMsgcnt()
+		}
+		replies = append(replies, &bidcos.Packet{
+			Msgcnt:  msgcnt,
+			Flags:   bidcos.RepeatEnable,
+			Cmd:     cmd,
+			Source:  d.Addr,
+			Dest:    pkt.Source,
+			Payload: payload,
+		})
+	}
+	ack := func() { reply(bidcos.Ack, bidcos.AckOK) }
+	nack := func() { reply(bidcos.Ack, bidcos.Nack) }
+
+	switch {
+	case pkt.Cmd == bidcos.Config && len(pkt.Payload) >= 2:
+		d.config(pkt.Payload, reply, ack, nack)
+
+	case pkt.Cmd == 0x11 && len(pkt.Payload) >= 3 && pkt.Payload[0] == 0x02: // LevelSet
+		channel, level := pkt.Payload[1], pkt.Payload[2]
+		d.levels[channel] = level
+		reply(bidcos.Ack, bidcos.AckStatus, channel, level, 0x00, byte(-DefaultDeviceRSSI))
+
+	case pkt.Cmd == 0x11 && len(pkt.Payload) >= 2 && pkt.Payload[0] == 0x04 && pkt.Payload[1] == 0x00: // FactoryReset
+		d.lists = d.Model.Lists()
+		d.peers = make(map[byte][]hm.FullyQualifiedChannel)
+		d.levels = make(map[byte]byte)
+		d.session = nil
+		ack()
+
+	case pkt.Cmd == bidcos.Ack:
+		// e.g. the central acknowledging an Info event
+
+	default:
+		nack()
+	}
+
+	if pkt.Flags&bidcos.BiDi == 0 {
+		return nil
+	}
+	return replies
+}
+
+// DefaultDeviceRSSI is the signal strength in dBm with which devices
+// report having received the central’s packets.
+const DefaultDeviceRSSI = -55
+
+// config handles a Config packet. The caller must hold mu.
+func (d *Device) config(p []byte, reply func(byte, ...byte), ack, nack func()) {
+	channel, subcmd := p[0], p[1]
+	switch subcmd {
+	case bidcos.ConfigPeerAdd, bidcos.ConfigPeerRemove:
+		if len(p) < 7 {
+			nack()
+			return
+		}
+		var peers []hm.FullyQualifiedChannel
+		for _, ch := range p[5:7] {
+			if ch == 0 && len(peers) > 0 {
+				continue // no second peer channel
+			}
+			peers = append(peers, hm.FullyQualifiedChannel{Peer: [3]byte{p[2], p[3], p[4]}, Channel: ch})
+		}
+		for _, peer := range peers {
+			if subcmd == bidcos.ConfigPeerAdd {
+				d.addPeer(channel, peer)
+			} else {
+				d.removePeer(channel, peer)
+			}
+		}
+		ack()
+
+	case bidcos.ConfigPeerListReq:
+		var entries []byte
+		for _, peer := range d.peers[channel] {
+			entries = append(entries, peer.Peer[0], peer.Peer[1], peer.Peer[2], peer.Channel)
+		}
+		entries = append(entries, 0x00, 0x00, 0x00, 0x00) // end of list
+		const perPacket = (maxPayload - 1) / 4 * 4
+		for len(entries) > 0 {
+			n := min(perPacket, len(entries))
+			reply(bidcos.Info, append([]byte{bidcos.InfoPeerList}, entries[:n]...)...)
+			entries = entries[n:]
+		}
+
+	case bidcos.ConfigParamReq:
+		if len(p) < 7 {
+			nack()
+			return
+		}
+		regs := d.lists[List{Channel: channel, List: p[6]}]
+		var pairs []byte
+		for _, reg := range sortedRegisters(regs) {
+			pairs = append(pairs, reg, regs[reg])
+		}
+		const perPacket = (maxPayload - 1) / 2 * 2
+		for len(pairs) > 0 {
+			n := min(perPacket, len(pairs))
+			reply(bidcos.Info, append([]byte{bidcos.InfoParamResponsePairs}, pairs[:n]...)...)
+			pairs = pairs[n:]
+		}
+		reply(bidcos.Info, bidcos.InfoParamResponsePairs, 0x00, 0x00) // end of list
+
+	case bidcos.ConfigStart:
+		if len(p) < 7 {
+			nack()
+			return
+		}
+		l := List{Channel: channel, List: p[6]}
+		if _, ok := d.lists[l]; !ok {
+			nack()
+			return
+		}
+		d.session = &l
+		ack()
+
+	case bidcos.ConfigWriteIndexPairs, bidcos.ConfigWriteIndexSeq:
+		if d.session == nil {
+			nack()
+			return
+		}
+		// Like the firmware, write to the list selected by ConfigStart
+		// regardless of the channel of this packet.
+		regs := d.lists[*d.session]
+		write := func(reg, val byte) {
+			if _, ok := regs[reg]; ok {
+				regs[reg] = val
+			}
+		}
+		if subcmd == bidcos.ConfigWriteIndexPairs {
+			for i := 2; i+1 < len(p); i += 2 {
+				write(p[i], p[i+1])
+			}
+		} else if len(p) > 2 {
+			for i, val := range p[3:] {
+				write(p[2]+byte(i), val)
+			}
+		}
+		ack()
+
+	case bidcos.ConfigEnd:
+		d.session = nil
+		ack()
+
+	default:
+		nack()
+	}
+}
+
+func sortedRegisters(regs map[byte]byte) []byte {
+	sorted := make([]byte, 0, len(regs))
+	for reg := range regs {
+		sorted = append(sorted, reg)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
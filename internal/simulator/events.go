@@ -0,0 +1,110 @@
+package simulator
+
+import (
+	"math"
+
+	"github.com/stapelberg/hmgo/internal/bidcos"
+	"github.com/stapelberg/hmgo/internal/hm"
+)
+
+// Values are the measurements and states which simulated devices
+// report in their events. Each model uses the subset of values which
+// the real device reports.
+type Values struct {
+	Temperature    float64 // in degC
+	Humidity       uint8   // in percent
+	SetTemperature float64 // in degC
+	Battery        float64 // in V
+	ValvePosition  uint8   // in percent
+
+	Boot          bool
+	EnergyCounter float64 // in Wh
+	Power         float64 // in W
+	Current       float64 // in mA
+	Voltage       float64 // in V
+	Frequency     float64 // in Hz
+}
+
+// DefaultValues are the Values of newly created devices.
+var DefaultValues = Values{
+	Temperature:    21.5,
+	Humidity:       50,
+	SetTemperature: 21,
+	Battery:        3.0,
+	ValvePosition:  20,
+	Voltage:        230,
+	Frequency:      50,
+}
+
+// temperatures encodes set and actual temperature like the
+// HM-TC-IT-WM-W-EU and HM-CC-RT-DN: 6 bits of set temperature (in
+// 0.5°C steps) and 10 bits of actual temperature (in 0.1°C steps).
+func temperatures(set, actual float64) (byte, byte) {
+	act := uint16(math.Round(actual * 10))
+	return byte(uint16(set*2)&hm.Mask6Bit)<<2 | byte(act>>8)&hm.Mask2Bit, byte(act)
+}
+
+// battery encodes the battery voltage in 0.1V steps above 1.5V.
+func battery(v float64) byte {
+	return byte(math.Round((v-1.5)*10)) & hm.Mask5Bit
+}
+
+// c.f. <frame id="WEATHER_EVENT">, <frame id="THERMALCONTROL_EVENT"> and
+// <frame id="INFO_LEVEL"> in rftypes/tc.xml
+func thermalControlEvents(d *Device, v Values) []*bidcos.Packet {
+	temp := uint16(math.Round(v.Temperature*10)) & 0x3fff
+	set, act := temperatures(v.SetTemperature, v.Temperature)
+	return []*bidcos.Packet{
+		{
+			Flags:   bidcos.RepeatEnable,
+			Cmd:     bidcos.WeatherEvent,
+			Payload: []byte{byte(temp >> 8), byte(temp), v.Humidity},
+		},
+		{
+			Flags:   bidcos.RepeatEnable,
+			Cmd:     bidcos.ThermalControl,
+			Payload: []byte{set, act, v.Humidity},
+		},
+		{
+			Flags:   bidcos.RepeatEnable | bidcos.BiDi,
+			Cmd:     bidcos.Info,
+			Payload: []byte{0x0b, set, act, battery(v.Battery), 0x00},
+		},
+	}
+}
+
+// c.f. <frame id="INFO_LEVEL"> in rftypes/cc.xml
+func thermostatEvents(d *Device, v Values) []*bidcos.Packet {
+	set, act := temperatures(v.SetTemperature, v.Temperature)
+	return []*bidcos.Packet{
+		{
+			Flags:   bidcos.RepeatEnable | bidcos.BiDi,
+			Cmd:     bidcos.Info,
+			Payload: []byte{bidcos.InfoTemp, set, act, battery(v.Battery), v.ValvePosition & hm.Mask7Bit, 0x00},
+		},
+	}
+}
+
+// c.f. <frame id="POWER_EVENT_CYCLIC"> in rftypes/es2.xml
+func powerSwitchEvents(d *Device, v Values) []*bidcos.Packet {
+	energy := uint32(math.Round(v.EnergyCounter*10)) & 0x7fffff
+	if v.Boot {
+		energy |= 1 << 23
+	}
+	power := uint32(math.Round(v.Power * 100))
+	current := uint16(math.Round(v.Current))
+	voltage := uint16(math.Round(v.Voltage * 10))
+	return []*bidcos.Packet{
+		{
+			Flags: bidcos.RepeatEnable,
+			Cmd:   bidcos.PowerEventCyclic,
+			Payload: []byte{
+				byte(energy >> 16), byte(energy >> 8), byte(energy),
+				byte(power >> 16), byte(power >> 8), byte(power),
+				byte(current >> 8), byte(current),
+				byte(voltage >> 8), byte(voltage),
+				byte(int(math.Round((v.Frequency - 50) * 100))),
+			},
+		},
+	}
+}
@@ -0,0 +1,228 @@
+// Package simulator simulates HomeMatic devices, so that hmgo can be
+// tested (or demonstrated) without radio hardware.
+//
+// A Simulator implements bidcos.Gateway: packets written to it are
+// handled by the simulated device they are addressed to, whose
+// replies (and periodic events) are returned by Read, like a gateway
+// delivers the packets it receives via radio.
+//
+// Simulated devices model their configuration memory (see Model) and
+// answer configuration requests like their firmware does, c.f. FHEM
+// HMConfig.pm and 10_CUL_HM.pm.
+package simulator
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/stapelberg/hmgo/internal/bidcos"
+)
+
+// Simulator simulates the devices added via Add. It implements
+// bidcos.Gateway.
+type Simulator struct {
+	// HMID is the BidCoS address of the central, to which devices send
+	// their events.
+	HMID [3]byte
+
+	// RSSI is the signal strength in dBm with which all packets of
+	// simulated devices are received.
+	RSSI int
+
+	// Airtime is the minimum interval between two packets returned by
+	// Read: like on the radio channel, one packet is transmitted at a
+	// time, so that e.g. multi-packet parameter responses are not
+	// delivered faster than a real device would send them.
+	Airtime time.Duration
+
+	mu      sync.Mutex
+	devices map[[3]byte]*Device
+	peers   map[[3]byte]bool
+
+	// received receives the packets which devices send, encoded like
+	// bidcos.Packet.Encode.
+	received chan []byte
+
+	// lastRead is when Read last returned a packet.
+	lastRead time.Time
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// New returns a Simulator without devices for the central HMID.
+func New(HMID [3]byte) *Simulator {
+	return &Simulator{
+		HMID:     HMID,
+		RSSI:     -60,
+		Airtime:  10 * time.Millisecond,
+		devices:  make(map[[3]byte]*Device),
+		peers:    make(map[[3]byte]bool),
+		received: make(chan []byte, 64),
+		done:     make(chan struct{}),
+	}
+}
+
+// Add adds d to the simulation. When d.Interval is non-zero, d sends
+// its periodic events (see Emit) every d.Interval until Close is called.
+func (s *Simulator) Add(d *Device) {
+	s.mu.Lock()
+	s.devices[d.Addr] = d
+	s.mu.Unlock()
+	if d.Interval == 0 {
+		return
+	}
+	go func() {
+		t := time.NewTicker(d.Interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-t.C:
+				s.Emit(d.Addr)
+			}
+		}
+	}()
+}
+
+// Device returns the simulated device with address addr, or nil.
+func (s *Simulator) Device(addr [3]byte) *Device {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.devices[addr]
+}
+
+// Emit makes the device with address addr send its periodic events
+// right away, e.g. a WeatherEvent, ThermalControl and Info packet for
+// a ThermalControl device. The events reflect the device’s Values.
+func (s *Simulator) Emit(addr [3]byte) error {
+	d := s.Device(addr)
+	if d == nil {
+		return fmt.Errorf("no simulated device with address %x", addr)
+	}
+	for _, pkt := range d.events(s.HMID) {
+		s.receive(pkt)
+	}
+	return nil
+}
+
+// SendDeviceInfo makes the device with address addr send a DeviceInfo
+// packet, like when its pairing button is pressed.
+func (s *Simulator) SendDeviceInfo(addr [3]byte) error {
+	d := s.Device(addr)
+	if d == nil {
+		return fmt.Errorf("no simulated device with address %x", addr)
+	}
+	s.receive(d.deviceInfo())
+	return nil
+}
+
+// receive makes pkt available via Read.
+func (s *Simulator) receive(pkt *bidcos.Packet) {
+	b := pkt.Encode()
+	// The gateway reports the RSSI where Encode puts the burst flag.
+	b[2] = byte(-s.RSSI)
+	select {
+	case s.received <- b:
+	default:
+		log.Printf("simulator receive buffer full, dropping packet %x", b)
+	}
+}
+
+// Read implements io.Reader so that a Simulator can be used by the
+// bidcos package. Read returns io.EOF once the Simulator is closed.
+func (s *Simulator) Read(p []byte) (n int, err error) {
+	select {
+	case b := <-s.received:
+		if wait := s.Airtime - time.Since(s.lastRead); wait > 0 {
+			time.Sleep(wait)
+		}
+		s.lastRead = time.Now()
+		return copy(p, b), nil
+	case <-s.done:
+		return 0, io.EOF
+	}
+}
+
+// Write sends the BidCoS packet p, encoded by bidcos.Packet.Encode, to
+// the simulated device it is addressed to. Packets to unknown devices
+// are dropped, like a gateway sends them without anyone listening.
+func (s *Simulator) Write(p []byte) (n int, err error) {
+	pkt, err := bidcos.Decode(p)
+	if err != nil {
+		return 0, err
+	}
+	if d := s.Device(pkt.Dest); d != nil {
+		for _, reply := range d.handle(pkt) {
+			s.receive(reply)
+		}
+	}
+	return len(p), nil
+}
+
+// Confirm implements bidcos.Gateway. The simulated radio channel is
+// always free.
+func (s *Simulator) Confirm() error {
+	return nil
+}
+
+// Close stops all periodic events and makes Read return io.EOF.
+func (s *Simulator) Close() error {
+	s.closeOnce.Do(func() { close(s.done) })
+	return nil
+}
+
+// AddPeer adds addr to the simulated peer table of the gateway, see
+// Peers.
+func (s *Simulator) AddPeer(addr []byte, channels int) error {
+	var a [3]byte
+	copy(a[:], addr)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peers[a] = true
+	return nil
+}
+
+// AddPeerAES returns an error: simulated devices do not sign their
+// packets.
+func (s *Simulator) AddPeerAES(addr []byte, channels int) error {
+	return fmt.Errorf("AES devices are not supported by the simulator")
+}
+
+// RemovePeer removes addr from the simulated peer table.
+func (s *Simulator) RemovePeer(addr [3]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.peers, addr)
+	return nil
+}
+
+// Peers returns the addresses in the simulated peer table, sorted.
+func (s *Simulator) Peers() ([][3]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peers := make([][3]byte, 0, len(s.peers))
+	for addr := range s.peers {
+		peers = append(peers, addr)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return bytes.Compare(peers[i][:], peers[j][:]) < 0
+	})
+	return peers, nil
+}
+
+// SetTime implements the gateway interface of hmgo. The simulated
+// devices do not use the time.
+func (s *Simulator) SetTime(now time.Time) error { return nil }
+
+// SetCurrentKey, SetPreviousKey and SetTempKey implement the gateway
+// interface of hmgo. Simulated devices do not use AES.
+func (s *Simulator) SetCurrentKey(k bidcos.Key) error  { return nil }
+func (s *Simulator) SetPreviousKey(k bidcos.Key) error { return nil }
+func (s *Simulator) SetTempKey(k bidcos.Key) error     { return nil }
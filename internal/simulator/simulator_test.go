@@ -0,0 +1,355 @@
+package simulator_test
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stapelberg/hmgo/internal/bidcos"
+	"github.com/stapelberg/hmgo/internal/hm"
+	"github.com/stapelberg/hmgo/internal/hm/heating"
+	"github.com/stapelberg/hmgo/internal/hm/power"
+	"github.com/stapelberg/hmgo/internal/hm/thermal"
+	"github.com/stapelberg/hmgo/internal/simulator"
+)
+
+var (
+	hmid        = [3]byte{0xfd, 0xb0, 0x2c}
+	thermalAddr = [3]byte{0x39, 0x06, 0xeb}
+	heatingAddr = [3]byte{0x38, 0xf5, 0x9c}
+	powerAddr   = [3]byte{0x3e, 0x5a, 0x01}
+)
+
+// setup returns a Simulator with one device of each model and a
+// bidcos.Sender using it.
+func setup(t *testing.T) (*simulator.Simulator, *bidcos.Sender) {
+	t.Helper()
+	sim := simulator.New(hmid)
+	t.Cleanup(func() { sim.Close() })
+	sim.Add(simulator.NewDevice(simulator.ThermalControl, thermalAddr, "MEQ0089016"))
+	sim.Add(simulator.NewDevice(simulator.Thermostat, heatingAddr, "MEQ0059922"))
+	sim.Add(simulator.NewDevice(simulator.PowerSwitch, powerAddr, "MEQ1234567"))
+	bcs, err := bidcos.NewSender(sim, hmid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcs.ReplyTimeout = 1 * time.Second
+	bcs.Attempts = 1
+	return sim, bcs
+}
+
+func device(bcs *bidcos.Sender, addr [3]byte) hm.StandardDevice {
+	return hm.NewStandardDevice(bcs, addr, "")
+}
+
+func TestConfigure(t *testing.T) {
+	sim, bcs := setup(t)
+	tc := thermal.NewThermalControl(device(bcs, thermalAddr))
+
+	var valveMax byte
+	if err := tc.EnsureConfigured(0, 7, func(mem []byte) error {
+		valveMax = mem[12]
+		mem[11] = 50 // valve offset
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := valveMax, byte(100); got != want {
+		t.Errorf("unexpected valve max: got %d, want %d", got, want)
+	}
+
+	regs := sim.Device(thermalAddr).Registers(simulator.List{Channel: 0, List: 7})
+	if got, want := regs[11], byte(50); got != want {
+		t.Errorf("unexpected valve offset: got %d, want %d", got, want)
+	}
+
+	// A second run must not find any differences.
+	if err := tc.EnsureConfigured(0, 7, func(mem []byte) error {
+		if got, want := mem[11], byte(50); got != want {
+			t.Errorf("unexpected valve offset: got %d, want %d", got, want)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPair(t *testing.T) {
+	sim, bcs := setup(t)
+	ps := power.NewPowerSwitch(device(bcs, powerAddr))
+	if err := ps.Pair(); err != nil {
+		t.Fatal(err)
+	}
+	regs := sim.Device(powerAddr).Registers(simulator.List{Channel: 0, List: 0})
+	got := []byte{regs[0x0a], regs[0x0b], regs[0x0c]}
+	if want := hmid[:]; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected central address: got %x, want %x", got, want)
+	}
+}
+
+func TestUnpair(t *testing.T) {
+	for _, factoryReset := range []bool{false, true} {
+		t.Run(fmt.Sprintf("FactoryReset=%v", factoryReset), func(t *testing.T) {
+			sim, bcs := setup(t)
+			tc := thermal.NewThermalControl(device(bcs, thermalAddr))
+			if err := tc.Pair(); err != nil {
+				t.Fatal(err)
+			}
+			peer := hm.FullyQualifiedChannel{Peer: heatingAddr, Channel: heating.ClimateControlReceiver}
+			if err := tc.EnsurePeeredWith(thermal.ThermalControlTransmit, peer); err != nil {
+				t.Fatal(err)
+			}
+			if err := tc.EnsureConfigured(0, 7, func(mem []byte) error {
+				mem[11] = 50 // valve offset
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := tc.Unpair(factoryReset); err != nil {
+				t.Fatal(err)
+			}
+			d := sim.Device(thermalAddr)
+			regs := d.Registers(simulator.List{Channel: 0, List: 0})
+			if got, want := [3]byte{regs[0x0a], regs[0x0b], regs[0x0c]}, [3]byte{}; got != want {
+				t.Errorf("unexpected central address: got %x, want %x", got, want)
+			}
+			if got := d.Peers(thermal.ThermalControlTransmit); len(got) > 0 {
+				t.Errorf("unexpected peers: got %+v, want none", got)
+			}
+			want := byte(50)
+			if factoryReset {
+				want = 0
+			}
+			if got := d.Registers(simulator.List{Channel: 0, List: 7})[11]; got != want {
+				t.Errorf("unexpected valve offset: got %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestUndefinedList(t *testing.T) {
+	_, bcs := setup(t)
+	ps := power.NewPowerSwitch(device(bcs, powerAddr))
+	if err := ps.ConfigStart(0, 7); err == nil {
+		t.Fatalf("ConfigStart(0, 7) unexpectedly succeeded")
+	}
+}
+
+func TestPeering(t *testing.T) {
+	sim, bcs := setup(t)
+	tc := thermal.NewThermalControl(device(bcs, thermalAddr))
+	want := []hm.FullyQualifiedChannel{
+		{Peer: heatingAddr, Channel: heating.ClimateControlReceiver},
+	}
+	for i := 0; i < 2; i++ {
+		if err := tc.EnsurePeeredWith(thermal.ThermalControlTransmit, want[0]); err != nil {
+			t.Fatal(err)
+		}
+		got := sim.Device(thermalAddr).Peers(thermal.ThermalControlTransmit)
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected peers: got %+v, want %+v", got, want)
+		}
+	}
+
+	// Replace the peer.
+	other := hm.FullyQualifiedChannel{Peer: [3]byte{0x11, 0x22, 0x33}, Channel: 2}
+	if err := tc.EnsurePeeredWith(thermal.ThermalControlTransmit, other); err != nil {
+		t.Fatal(err)
+	}
+	got := sim.Device(thermalAddr).Peers(thermal.ThermalControlTransmit)
+	if want := []hm.FullyQualifiedChannel{other}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected peers: got %+v, want %+v", got, want)
+	}
+}
+
+func TestPeeringMultiple(t *testing.T) {
+	sim, bcs := setup(t)
+	heating2Addr := [3]byte{0x38, 0xf5, 0x9d}
+	sim.Add(simulator.NewDevice(simulator.Thermostat, heating2Addr, "MEQ0059923"))
+	otherThermal := hm.FullyQualifiedChannel{Peer: [3]byte{0x39, 0x0f, 0x17}, Channel: thermal.ThermalControlTransmit}
+
+	// The valve drive was peered with a second thermostat by hand.
+	cc := heating.NewThermostat(device(bcs, heatingAddr))
+	d := sim.Device(heatingAddr)
+	d.AddPeer(heating.ClimateControlReceiver, hm.FullyQualifiedChannel{Peer: thermalAddr, Channel: thermal.ThermalControlTransmit})
+	d.AddPeer(heating.ClimateControlReceiver, otherThermal)
+	want := []hm.FullyQualifiedChannel{
+		{Peer: thermalAddr, Channel: thermal.ThermalControlTransmit},
+	}
+	if err := cc.EnsurePeeredWith(heating.ClimateControlReceiver, want...); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.Peers(heating.ClimateControlReceiver); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected valve drive peers: got %+v, want %+v", got, want)
+	}
+
+	// One thermostat controls two valve drives.
+	tc := thermal.NewThermalControl(device(bcs, thermalAddr))
+	sim.Device(thermalAddr).AddPeer(thermal.ThermalControlTransmit, otherThermal)
+	want = []hm.FullyQualifiedChannel{
+		{Peer: heatingAddr, Channel: heating.ClimateControlReceiver},
+		{Peer: heating2Addr, Channel: heating.ClimateControlReceiver},
+	}
+	for i := 0; i < 2; i++ {
+		if err := tc.EnsurePeeredWith(thermal.ThermalControlTransmit, want...); err != nil {
+			t.Fatal(err)
+		}
+		if got := sim.Device(thermalAddr).Peers(thermal.ThermalControlTransmit); !reflect.DeepEqual(got, want) {
+			t.Errorf("unexpected thermostat peers: got %+v, want %+v", got, want)
+		}
+	}
+
+	// No desired peers removes all peers.
+	if err := tc.EnsurePeeredWith(thermal.ThermalControlTransmit); err != nil {
+		t.Fatal(err)
+	}
+	if got := sim.Device(thermalAddr).Peers(thermal.ThermalControlTransmit); len(got) > 0 {
+		t.Errorf("unexpected thermostat peers: got %+v, want none", got)
+	}
+}
+
+func TestLevelSet(t *testing.T) {
+	sim, bcs := setup(t)
+	ps := power.NewPowerSwitch(device(bcs, powerAddr))
+	if err := ps.LevelSet(power.ChannelSwitch, power.On, 0x00); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sim.Device(powerAddr).Level(power.ChannelSwitch), byte(power.On); got != want {
+		t.Errorf("unexpected level: got %x, want %x", got, want)
+	}
+}
+
+// next returns the next packet which the devices sent.
+func next(t *testing.T, events <-chan *bidcos.Packet) *bidcos.Packet {
+	t.Helper()
+	select {
+	case pkt := <-events:
+		return pkt
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+	return nil
+}
+
+func TestEvents(t *testing.T) {
+	sim, bcs := setup(t)
+	events := bcs.Subscribe()
+	tc := thermal.NewThermalControl(device(bcs, thermalAddr))
+	cc := heating.NewThermostat(device(bcs, heatingAddr))
+	ps := power.NewPowerSwitch(device(bcs, powerAddr))
+
+	v := simulator.DefaultValues
+	v.Temperature = 19.3
+	v.Humidity = 64
+	v.SetTemperature = 22.5
+	v.Battery = 2.8
+	v.ValvePosition = 42
+	v.EnergyCounter = 90.6
+	v.Power = 1.87
+	v.Current = 16
+	v.Voltage = 231.2
+	v.Frequency = 50.04
+	for _, addr := range [][3]byte{thermalAddr, heatingAddr, powerAddr} {
+		sim.Device(addr).SetValues(v)
+		if err := sim.Emit(addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pkt := next(t, events)
+	if got, want := pkt.Cmd, byte(bidcos.WeatherEvent); got != want {
+		t.Fatalf("unexpected command: got %x, want %x", got, want)
+	}
+	if got, want := pkt.Dest, hmid; got != want {
+		t.Errorf("unexpected destination: got %x, want %x", got, want)
+	}
+	we, err := tc.DecodeWeatherEvent(pkt.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := *we, (thermal.WeatherEvent{Temperature: 19.3, Humidity: 64}); got != want {
+		t.Errorf("unexpected weather event: got %+v, want %+v", got, want)
+	}
+
+	pkt = next(t, events)
+	tce, err := tc.DecodeThermalControlEvent(pkt.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := *tce, (thermal.ThermalControlEvent{
+		SetTemperature:    22.5,
+		ActualTemperature: 19.3,
+		ActualHumidity:    64,
+	}); got != want {
+		t.Errorf("unexpected thermal control event: got %+v, want %+v", got, want)
+	}
+
+	pkt = next(t, events)
+	tie, err := tc.DecodeInfoEvent(pkt.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := *tie, (thermal.InfoEvent{
+		SetTemperature:    22.5,
+		ActualTemperature: 19.3,
+		BatteryState:      2.8,
+	}); got != want {
+		t.Errorf("unexpected thermal info event: got %+v, want %+v", got, want)
+	}
+
+	pkt = next(t, events)
+	hie, err := cc.DecodeInfoEvent(pkt.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := *hie, (heating.InfoEvent{
+		SetTemperature:    22.5,
+		ActualTemperature: 19.3,
+		BatteryState:      2.8,
+		ValveState:        42,
+	}); got != want {
+		t.Errorf("unexpected heating info event: got %+v, want %+v", got, want)
+	}
+
+	pkt = next(t, events)
+	if got, want := pkt.Cmd, byte(bidcos.PowerEventCyclic); got != want {
+		t.Fatalf("unexpected command: got %x, want %x", got, want)
+	}
+	pe, err := ps.DecodePowerEvent(pkt.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := *pe, (power.PowerEvent{
+		EnergyCounter: 90.6,
+		Power:         1.87,
+		Current:       16,
+		Voltage:       231.2,
+		Frequency:     50.04,
+	}); got != want {
+		t.Errorf("unexpected power event: got %+v, want %+v", got, want)
+	}
+}
+
+func TestDeviceInfo(t *testing.T) {
+	sim, bcs := setup(t)
+	events := bcs.Subscribe()
+	if err := sim.SendDeviceInfo(thermalAddr); err != nil {
+		t.Fatal(err)
+	}
+	pkt := next(t, events)
+	if got, want := pkt.Cmd, byte(bidcos.DeviceInfo); got != want {
+		t.Fatalf("unexpected command: got %x, want %x", got, want)
+	}
+	info, err := bidcos.DecodeDeviceInfo(pkt.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.Model, uint16(0x00ad); got != want {
+		t.Errorf("unexpected model: got %x, want %x", got, want)
+	}
+	if got, want := info.Serial, "MEQ0089016"; got != want {
+		t.Errorf("unexpected serial: got %q, want %q", got, want)
+	}
+}
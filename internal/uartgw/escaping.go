@@ -1,6 +1,10 @@
 package uartgw
 
-import "io"
+import (
+	"bufio"
+	"errors"
+	"io"
+)
 
 // escapingWriter escapes 0xfd for the UARTGW
 type escapingWriter struct {
@@ -31,45 +35,56 @@ func (ew *escapingWriter) Write(p []byte) (n int, err error) {
 	return len(p), nil
 }
 
+// errFrameDelimiter is returned by unescapingReader when it encounters
+// a frame delimiter, i.e. the current frame was cut short.
+var errFrameDelimiter = errors.New("unexpected frame delimiter")
+
+// unescapingReader unescapes the contents of a single frame. A frame
+// delimiter is left in the underlying reader so that the next frame
+// can be read.
 type unescapingReader struct {
-	r io.Reader
+	r *bufio.Reader
 }
 
-func (uer *unescapingReader) Read(p []byte) (n int, err error) {
-	if len(p) == 0 {
-		return 0, nil
+func (uer *unescapingReader) readRaw() (byte, error) {
+	b, err := uer.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b == 0xfd {
+		if err := uer.r.UnreadByte(); err != nil {
+			return 0, err
+		}
+		return 0, errFrameDelimiter
 	}
+	return b, nil
+}
 
-	raw := make([]byte, len(p))
-	n, err = uer.r.Read(raw)
+// ReadByte returns the next unescaped byte.
+func (uer *unescapingReader) ReadByte() (byte, error) {
+	b, err := uer.readRaw()
 	if err != nil {
-		return n, err
+		return 0, err
 	}
-	var escapeByte bool
-	idx := 0
-	for _, b := range raw[:n] {
-		if b == 0xfc {
-			escapeByte = true
-			continue
-		}
-		if escapeByte {
-			b |= 0x80
-			escapeByte = false
-		}
-		p[idx] = b
-		idx++
+	if b != 0xfc {
+		return b, nil
 	}
+	b, err = uer.readRaw()
+	if err != nil {
+		return 0, err
+	}
+	return b | 0x80, nil
+}
 
-	// We cannot end on an escaped byte because the escape state would
-	// not be carried over into the next read call. Force a read.
-	if escapeByte {
-		last := make([]byte, 1)
-		n, err = uer.r.Read(last)
+// Read fills p with unescaped bytes.
+func (uer *unescapingReader) Read(p []byte) (n int, err error) {
+	for n < len(p) {
+		b, err := uer.ReadByte()
 		if err != nil {
-			return idx, err
+			return n, err
 		}
-		p[idx] = last[0] | 0x80
-		idx++
+		p[n] = b
+		n++
 	}
-	return idx, nil
+	return n, nil
 }
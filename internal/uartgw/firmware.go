@@ -0,0 +1,166 @@
+package uartgw
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// ParseFirmware parses an eQ-3 firmware image (.eq3 file) for the
+// HM-MOD-RPI-PCB into the blocks which need to be sent to the
+// bootloader. The image is hex-encoded, each block is prefixed with
+// its length:
+//
+//	uint16 length (big endian)
+//	[]byte block
+func ParseFirmware(image io.Reader) ([][]byte, error) {
+	encoded, err := io.ReadAll(image)
+	if err != nil {
+		return nil, err
+	}
+	// Ignore line breaks and other whitespace.
+	b, err := hex.DecodeString(strings.Join(strings.Fields(string(encoded)), ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid firmware image: %v", err)
+	}
+	var blocks [][]byte
+	for off := 0; off < len(b); {
+		if got, want := len(b)-off, 2; got < want {
+			return nil, fmt.Errorf("invalid firmware image: truncated block length at offset %d", off)
+		}
+		length := int(binary.BigEndian.Uint16(b[off:]))
+		off += 2
+		if got, want := len(b)-off, length; got < want {
+			return nil, fmt.Errorf("invalid firmware image: truncated block at offset %d: got %d bytes, want %d", off, got, want)
+		}
+		blocks = append(blocks, b[off:off+length])
+		off += length
+	}
+	if len(blocks) == 0 {
+		return nil, fmt.Errorf("invalid firmware image: no blocks")
+	}
+	return blocks, nil
+}
+
+// NewBootloader returns a UARTGW which is expected to have just been
+// reset, but leaves it in the bootloader, e.g. for UpdateFirmware.
+func NewBootloader(uart io.ReadWriter) (*UARTGW, error) {
+	gw := newUARTGW(uart)
+	go gw.readLoop()
+
+	defer func() {
+		gw.mu.Lock()
+		gw.initializing = false
+		gw.mu.Unlock()
+	}()
+	gw.cmdMu.Lock()
+	defer gw.cmdMu.Unlock()
+	// on the wire: FD000C000000436F5F4350555F424C7251
+	pkt, err := gw.response()
+	if err != nil {
+		return nil, err
+	}
+	if got, want := announcement(pkt), "Co_CPU_BL"; got != want {
+		return nil, fmt.Errorf("unexpected UARTGW announcement: got %q, want %q", got, want)
+	}
+	return gw, nil
+}
+
+// blockAttempts is how often UpdateFirmware sends a block which the
+// bootloader rejects or does not acknowledge.
+const blockAttempts = 3
+
+// defaultBootloaderTimeout is how long bootloaderCommand waits for the
+// bootloader’s acknowledgement.
+const defaultBootloaderTimeout = 2 * time.Second
+
+// bootloaderCommand sends a command to the bootloader and verifies it
+// is acknowledged. The caller must hold cmdMu.
+func (u *UARTGW) bootloaderCommand(cmd uartcmd, payload []byte) error {
+	if err := u.WritePacket(&Packet{Cmd: cmd, Payload: payload}); err != nil {
+		return err
+	}
+	pkt, err := u.responseWithin(u.bootloaderTimeout)
+	if err == errNoResponse {
+		return fmt.Errorf("%v not acknowledged within %v", cmd, u.bootloaderTimeout)
+	}
+	if err != nil {
+		return err
+	}
+	if got, want := pkt.Cmd, OSAck; got != want {
+		return fmt.Errorf("unexpected UARTGW packet cmd: got %v, want %v", got, want)
+	}
+	if len(pkt.Payload) < 1 || pkt.Payload[0] != 0x01 {
+		return fmt.Errorf("%v rejected by bootloader: %x", cmd, pkt.Payload)
+	}
+	return nil
+}
+
+// UpdateFirmware writes the firmware image (see ParseFirmware) to the
+// UARTGW, which must be in the bootloader (see NewBootloader), then
+// starts the new firmware. progress (if non-nil) is called after each
+// block.
+//
+// .eq3 images carry no checksums of their own. Each block is sent in a
+// frame protected by a CRC16 (see bidcosTable), which the bootloader
+// verifies: a block which it rejects (NACK) or which it does not
+// acknowledge, e.g. because the frame was corrupted on the wire, is
+// sent again, up to blockAttempts times.
+func (u *UARTGW) UpdateFirmware(image io.Reader, progress func(done, total int)) error {
+	blocks, err := ParseFirmware(image)
+	if err != nil {
+		return err
+	}
+
+	u.lock()
+	defer u.cmdMu.Unlock()
+
+	if got, want := u.state(), OS; got != want {
+		return fmt.Errorf("UARTGW not in bootloader: got state %v, want %v", got, want)
+	}
+	// Announcements are expected while updating.
+	u.mu.Lock()
+	u.initializing = true
+	u.mu.Unlock()
+	defer func() {
+		u.mu.Lock()
+		u.initializing = false
+		u.mu.Unlock()
+	}()
+
+	if err := u.bootloaderCommand(OSUpdateMode, nil); err != nil {
+		return fmt.Errorf("entering update mode: %v", err)
+	}
+
+	start := time.Now()
+	for i, block := range blocks {
+		for attempt := 1; ; attempt++ {
+			err := u.bootloaderCommand(OSUpdateFirmware, block)
+			if err == nil {
+				break
+			}
+			if attempt == blockAttempts {
+				return fmt.Errorf("writing block %d of %d: %v", i+1, len(blocks), err)
+			}
+			log.Printf("writing block %d of %d (attempt %d): %v", i+1, len(blocks), attempt, err)
+		}
+		if progress != nil {
+			progress(i+1, len(blocks))
+		}
+	}
+	log.Printf("wrote %d firmware blocks in %v", len(blocks), time.Since(start))
+
+	if err := u.switchToApp(); err != nil {
+		return fmt.Errorf("starting firmware: %v", err)
+	}
+
+	if err := u.getFirmwareVersion(); err != nil {
+		return fmt.Errorf("getting firmware version: %v", err)
+	}
+
+	return nil
+}
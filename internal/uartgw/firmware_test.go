@@ -0,0 +1,133 @@
+package uartgw
+
+import (
+	"bufio"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pipeUART connects a UARTGW to a simulated bootloader.
+type pipeUART struct {
+	io.Reader
+	io.Writer
+}
+
+// simulateBootloader answers the commands of an UpdateFirmware
+// conversation like the HM-MOD-RPI-PCB bootloader. The first attempt
+// to write block nackBlock is rejected, the first attempt to write
+// block dropBlock is not acknowledged at all. simulateBootloader
+// returns the blocks which were written.
+func simulateBootloader(t *testing.T, r io.Reader, w io.Writer, nackBlock, dropBlock int) [][]byte {
+	dec := &UARTGW{br: bufio.NewReader(r), devstate: OS, maxFrameErrors: 1}
+	enc := &UARTGW{uart: pipeUART{Writer: w}}
+	reply := func(cmd uartcmd, payload ...byte) {
+		if err := enc.WritePacket(&Packet{Cmd: cmd, Payload: payload}); err != nil {
+			t.Error(err)
+		}
+	}
+	reply(OSGetApp, []byte("Co_CPU_BL")...)
+
+	var (
+		blocks  [][]byte
+		nacked  bool
+		dropped bool
+	)
+	for {
+		pkt, err := dec.ReadPacket()
+		if err != nil {
+			t.Error(err)
+			return blocks
+		}
+		switch pkt.Cmd {
+		case OSUpdateMode:
+			reply(OSAck, 0x01)
+
+		case OSUpdateFirmware:
+			if len(blocks) == nackBlock && !nacked {
+				nacked = true
+				reply(OSAck, 0x00)
+				continue
+			}
+			if len(blocks) == dropBlock && !dropped {
+				dropped = true
+				continue
+			}
+			blocks = append(blocks, pkt.Payload)
+			reply(OSAck, 0x01)
+
+		case OSChangeApp:
+			reply(OSAck, 0x01)
+			reply(OSGetApp, []byte("Co_CPU_App")...)
+			dec.devstate = App
+
+		case AppSend: // OSGetFirmware while in application state
+			reply(AppAck, 0x02, 0x01, 0x00, 0x03, 0x01, 0x02, 0x01)
+			return blocks
+
+		default:
+			t.Errorf("unexpected command %v", pkt.Cmd)
+			return blocks
+		}
+	}
+}
+
+func TestUpdateFirmware(t *testing.T) {
+	toGW, fromBL := io.Pipe()
+	toBL, fromGW := io.Pipe()
+	defer fromBL.Close()
+
+	done := make(chan [][]byte)
+	go func() {
+		done <- simulateBootloader(t, toBL, fromBL, 1, 2)
+	}()
+
+	gw, err := NewBootloader(pipeUART{Reader: toGW, Writer: fromGW})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gw.initializing {
+		t.Fatalf("UARTGW still initializing after NewBootloader")
+	}
+	gw.bootloaderTimeout = 50 * time.Millisecond
+
+	const image = "0003aabbcc\n0002fdfc\n0001ee\n"
+	var progress []int
+	if err := gw.UpdateFirmware(strings.NewReader(image), func(done, total int) {
+		if total != 3 {
+			t.Errorf("unexpected total: got %d, want 3", total)
+		}
+		progress = append(progress, done)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]byte{{0xaa, 0xbb, 0xcc}, {0xfd, 0xfc}, {0xee}}
+	if got := <-done; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected blocks: got %x, want %x", got, want)
+	}
+	if got, want := progress, []int{1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected progress: got %v, want %v", got, want)
+	}
+	if got, want := gw.FirmwareVersion(), "1.2.1"; got != want {
+		t.Fatalf("unexpected firmware version: got %q, want %q", got, want)
+	}
+	if got, want := gw.state(), uartdest(App); got != want {
+		t.Fatalf("unexpected state: got %v, want %v", got, want)
+	}
+}
+
+func TestParseFirmwareErrors(t *testing.T) {
+	for _, image := range []string{
+		"",
+		"0003aabb",
+		"00",
+		"zz",
+	} {
+		if _, err := ParseFirmware(strings.NewReader(image)); err == nil {
+			t.Errorf("ParseFirmware(%q) unexpectedly succeeded", image)
+		}
+	}
+}
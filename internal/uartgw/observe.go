@@ -0,0 +1,90 @@
+package uartgw
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"github.com/sigurn/crc16"
+)
+
+// Direction is the direction in which a frame was transferred.
+type Direction uint8
+
+const (
+	// Received frames were read from the UARTGW.
+	Received Direction = iota
+	// Sent frames were written to the UARTGW.
+	Sent
+)
+
+func (d Direction) String() string {
+	if d == Sent {
+		return "sent"
+	}
+	return "received"
+}
+
+// Frame is a frame as passed to observers, see Observe.
+type Frame struct {
+	Time      time.Time
+	Direction Direction
+
+	// Data is the unescaped frame between length and checksum, i.e.
+	// destination, message counter, command and payload.
+	Data []byte
+}
+
+// Bytes returns the unescaped frame including frame delimiter, length
+// and checksum, as dissected by contrib/wireshark/homematic.lua.
+func (f Frame) Bytes() []byte {
+	var b bytes.Buffer
+	b.WriteByte(0xfd)
+	binary.Write(&b, binary.BigEndian, uint16(len(f.Data)))
+	b.Write(f.Data)
+	binary.Write(&b, binary.BigEndian, crc16.Checksum(b.Bytes(), bidcosTable))
+	return b.Bytes()
+}
+
+// Observe makes the UARTGW call f for every frame with a valid checksum
+// which is read from or written to the UARTGW (including frames with an
+// unknown command), until cancel is called. f is called
+// synchronously by the reading or writing goroutine and must not
+// block.
+func (u *UARTGW) Observe(f func(Frame)) (cancel func()) {
+	o := &observer{f: f}
+	u.observersMu.Lock()
+	defer u.observersMu.Unlock()
+	u.observers = append(u.observers, o)
+	return func() {
+		u.observersMu.Lock()
+		defer u.observersMu.Unlock()
+		for i, other := range u.observers {
+			if other == o {
+				u.observers = append(u.observers[:i], u.observers[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+type observer struct {
+	f func(Frame)
+}
+
+// observe passes the frame data to all observers.
+func (u *UARTGW) observe(dir Direction, data []byte) {
+	u.observersMu.Lock()
+	defer u.observersMu.Unlock()
+	if len(u.observers) == 0 {
+		return
+	}
+	f := Frame{
+		Time:      time.Now(),
+		Direction: dir,
+		Data:      append([]byte(nil), data...),
+	}
+	for _, o := range u.observers {
+		o.f(f)
+	}
+}
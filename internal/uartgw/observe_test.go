@@ -0,0 +1,68 @@
+package uartgw
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestObserve(t *testing.T) {
+	wire := frame(t, &Packet{Dst: App, Cmd: AppRecv, Payload: []byte{0xfd, 0x42}})
+	u := newTestUARTGW(wire)
+	var written bytes.Buffer
+	u.uart = &written
+
+	var frames []Frame
+	cancel := u.Observe(func(f Frame) { frames = append(frames, f) })
+
+	if _, err := u.ReadPacket(); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.WritePacket(&Packet{Dst: App, Cmd: AppSend, Payload: []byte{0x01}}); err != nil {
+		t.Fatal(err)
+	}
+	// The frame contains no bytes which need to be escaped.
+	if got, want := frames[len(frames)-1].Bytes(), written.Bytes(); !bytes.Equal(got, want) {
+		t.Errorf("Frame.Bytes() = %x, want %x", got, want)
+	}
+	cancel()
+	if err := u.WritePacket(&Packet{Dst: App, Cmd: AppSend, Payload: []byte{0x02}}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		dir  Direction
+		data []byte
+	}{
+		// destination, message counter, command, payload
+		{Received, []byte{0x01, 0x00, 0x05, 0xfd, 0x42}},
+		{Sent, []byte{0x01, 0x00, 0x02, 0x01}},
+	}
+	if got, want := len(frames), len(want); got != want {
+		t.Fatalf("unexpected number of frames: got %d, want %d", got, want)
+	}
+	for i, w := range want {
+		if got := frames[i]; got.Direction != w.dir || !bytes.Equal(got.Data, w.data) {
+			t.Errorf("frame %d: got %v %x, want %v %x", i, got.Direction, got.Data, w.dir, w.data)
+		}
+	}
+}
+
+func TestObserveUnknownCommand(t *testing.T) {
+	// destination, message counter, unknown command
+	unknown := Frame{Data: []byte{0x01, 0x00, 0x42}}.Bytes()
+	wire := append(unknown, frame(t, &Packet{Dst: App, Cmd: AppRecv, Payload: []byte{0x01}})...)
+	u := newTestUARTGW(wire)
+
+	var frames []Frame
+	u.Observe(func(f Frame) { frames = append(frames, f) })
+
+	if _, err := u.ReadPacket(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(frames), 2; got != want {
+		t.Fatalf("unexpected number of frames: got %d, want %d", got, want)
+	}
+	if got, want := frames[0].Data, unknown[3:len(unknown)-2]; !bytes.Equal(got, want) {
+		t.Errorf("frame 0: got %x, want %x", got, want)
+	}
+}
@@ -31,43 +31,413 @@ Note that command values depend on the state of the UARTGW, i.e. the
 same value means something different in bootloader state
 vs. application code state.
 
+A single goroutine reads all frames from the serial port. AppRecv
+frames (BidCoS packets received via radio) are delivered via Read, all
+other frames are responses to the command which is currently in
+flight.
+
 */
 package uartgw
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"os"
+	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sigurn/crc16"
+	"github.com/stapelberg/hmgo/internal/bidcos"
+)
+
+// prometheus metrics
+var (
+	frameErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "hm",
+			Name:      "UARTGWFrameErrors",
+			Help:      "number of invalid frames received from the UARTGW, by kind of error",
+		},
+		[]string{"kind"})
+
+	credits = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "hm",
+			Name:      "UARTGWCredits",
+			Help:      "remaining 1% duty cycle budget of the UARTGW in percent",
+		})
 )
 
+func init() {
+	prometheus.MustRegister(frameErrors)
+	prometheus.MustRegister(credits)
+}
+
 type deviceState uint8
 
 type UARTGW struct {
-	FirmwareVersion string
-	SerialNumber    string
-
 	// HMID is the HomeMatic ID of the UARTGW and must not be changed.
 	HMID [3]byte
 
-	uart     io.ReadWriter
-	msgcnt   uint8
+	uart   io.ReadWriter
+	br     *bufio.Reader
+	msgcnt uint8
+
+	// frameErrors counts consecutive invalid frames and is only
+	// accessed by the reader goroutine.
+	frameErrors int
+
+	// cmdMu serializes commands, i.e. writing a command frame and
+	// reading its response(s).
+	cmdMu sync.Mutex
+
+	// confirmErr is the result of the most recent Write, returned by
+	// Confirm.
+	confirmErr error
+
+	// responses receives all frames but AppRecv from the reader
+	// goroutine, received receives AppRecv frames.
+	responses chan *Packet
+	received  chan *Packet
+
+	// done is closed when the reader goroutine exits, after setting
+	// readErr.
+	done    chan struct{}
+	readErr error
+
+	mu       sync.Mutex
 	devstate uartdest
+	// firmwareVersion and serialNumber are set during setup, which
+	// also runs after a reset, see FirmwareVersion and SerialNumber.
+	firmwareVersion string
+	serialNumber    string
+	// peers maps the address of each peer added via AddPeer or
+	// AddPeerAES to its configuration, so that peers can be re-added
+	// after a reset.
+	peers map[[3]byte]peer
+
+	// currentKey and previousKey (if non-nil) are the AES keys set via
+	// SetCurrentKey and SetPreviousKey, so that they can be set again
+	// after a reset.
+	currentKey  bidcos.Key
+	previousKey *bidcos.Key
+
+	// watchdog and reset are set by Watchdog.
+	watchdog time.Duration
+	reset    func() error
+
+	// initializing is set while init or recoverFrom run, i.e. while
+	// application announcements (see announcement) are expected.
+	initializing bool
+
+	// abort is closed by startRecovery so that the command in flight
+	// (see response) fails instead of holding cmdMu forever, e.g.
+	// because the UARTGW is wedged. recovered is closed once
+	// recoverFrom finished and is nil while no recovery is pending.
+	abort     chan struct{}
+	recovered chan struct{}
+
+	maxFrameErrors int
+
+	// appAckTimeout is how long AppSend waits for each AppAck.
+	appAckTimeout time.Duration
+
+	// bootloaderTimeout is how long UpdateFirmware waits for the
+	// bootloader to acknowledge each command.
+	bootloaderTimeout time.Duration
+
+	// observersMu guards observers, see Observe.
+	observersMu sync.Mutex
+	observers   []*observer
 }
 
-// NewUARTGW initializes a UARTGW which is expected to have just been reset.
+// NewUARTGW initializes a UARTGW which is expected to have just been
+// reset. It starts a goroutine which reads from uart until reading
+// fails.
 func NewUARTGW(uart io.ReadWriter, HMID [3]byte, now time.Time) (*UARTGW, error) {
-	gw := &UARTGW{
-		uart: uart,
-		HMID: HMID,
-	}
+	gw := newUARTGW(uart)
+	gw.HMID = HMID
+	go gw.readLoop()
 	return gw, gw.init(now)
 }
 
+// NewRunningUARTGW is like NewUARTGW, but for a UARTGW which was not
+// just reset, e.g. one behind an HM-LGW-O-TW-W-FS (see package lgw):
+// instead of waiting for the announcement after a reset, it queries
+// which application is running.
+func NewRunningUARTGW(uart io.ReadWriter, HMID [3]byte, now time.Time) (*UARTGW, error) {
+	gw := newUARTGW(uart)
+	gw.HMID = HMID
+	go gw.readLoop()
+	return gw, gw.initRunning(now)
+}
+
+func newUARTGW(uart io.ReadWriter) *UARTGW {
+	return &UARTGW{
+		uart:       uart,
+		br:         bufio.NewReader(uart),
+		responses:  make(chan *Packet, 16),
+		received:   make(chan *Packet, 64),
+		done:       make(chan struct{}),
+		abort:      make(chan struct{}),
+		peers:      make(map[[3]byte]peer),
+		currentKey: bidcos.DefaultKey,
+
+		initializing:   true,
+		maxFrameErrors: DefaultMaxFrameErrors,
+		appAckTimeout:  defaultAppAckTimeout,
+
+		bootloaderTimeout: defaultBootloaderTimeout,
+	}
+}
+
+// deadliner is implemented by *os.File for files which support
+// polling, e.g. serial ports opened with O_NONBLOCK.
+type deadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// SetReadDeadline sets the deadline for reading the next frame from
+// the serial port. It returns an error if the serial port does not
+// support deadlines.
+func (u *UARTGW) SetReadDeadline(t time.Time) error {
+	d, ok := u.uart.(deadliner)
+	if !ok {
+		return fmt.Errorf("%T does not support read deadlines", u.uart)
+	}
+	return d.SetReadDeadline(t)
+}
+
+// Watchdog makes the reader goroutine call reset (e.g. a closure
+// around gpio.ResetUARTGW) and re-initialize the UARTGW when no frame
+// was received for timeout, e.g. because the UARTGW is wedged. The
+// serial port must support read deadlines, see SetReadDeadline.
+func (u *UARTGW) Watchdog(timeout time.Duration, reset func() error) error {
+	if _, ok := u.uart.(deadliner); !ok {
+		return fmt.Errorf("%T does not support read deadlines", u.uart)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.watchdog = timeout
+	u.reset = reset
+	return nil
+}
+
+// recoverFrom re-initializes the UARTGW, then re-adds all peers. If
+// app is empty, recoverFrom first resets the UARTGW (see Watchdog),
+// otherwise app is the application which the UARTGW announced. It runs
+// in its own goroutine because the reader goroutine needs to deliver
+// the responses.
+func (u *UARTGW) recoverFrom(cause error, app string) {
+	// Not calling u.lock(), which waits for recoverFrom to finish.
+	u.cmdMu.Lock()
+	defer u.cmdMu.Unlock()
+	u.dropResponses()
+	defer func() {
+		u.mu.Lock()
+		u.initializing = false
+		close(u.recovered)
+		u.recovered = nil
+		u.mu.Unlock()
+	}()
+
+	u.mu.Lock()
+	// The command which was in flight failed, see startRecovery.
+	u.abort = make(chan struct{})
+	reset := u.reset
+	peers := make(map[[3]byte]peer, len(u.peers))
+	for addr, p := range u.peers {
+		peers[addr] = p
+	}
+	u.mu.Unlock()
+
+	if app == "" {
+		log.Printf("resetting UARTGW: %v", cause)
+		u.mu.Lock()
+		u.devstate = OS
+		u.mu.Unlock()
+		if err := reset(); err != nil {
+			log.Printf("resetting UARTGW: %v", err)
+			return
+		}
+		if err := u.setup(time.Now()); err != nil {
+			log.Printf("re-initializing UARTGW: %v", err)
+			return
+		}
+	} else {
+		log.Printf("re-initializing UARTGW: %v", cause)
+		if err := u.setupFrom(app, time.Now()); err != nil {
+			log.Printf("re-initializing UARTGW: %v", err)
+			return
+		}
+	}
+	for addr, p := range peers {
+		if err := u.addPeer(addr, p); err != nil {
+			log.Printf("re-adding peer %x: %v", addr, err)
+			return
+		}
+	}
+	log.Printf("UARTGW re-initialized")
+}
+
+// startRecovery fails the command in flight (if any) and starts
+// recoverFrom unless the UARTGW is already being initialized. When the
+// watchdog fires during recoverFrom, the failed recoverFrom is retried
+// when it fires the next time.
+func (u *UARTGW) startRecovery(cause error, app string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	select {
+	case <-u.abort:
+	default:
+		close(u.abort)
+	}
+	if u.initializing {
+		return
+	}
+	u.initializing = true
+	u.recovered = make(chan struct{})
+	go u.recoverFrom(cause, app)
+}
+
+// announcement returns the application which the UARTGW announces in
+// pkt, or the empty string if pkt is not an announcement. The UARTGW
+// announces its application after a reset and after switching to the
+// application, but also when the coprocessor unexpectedly drops back
+// into the bootloader.
+func announcement(pkt *Packet) string {
+	if pkt.Cmd != OSGetApp {
+		return ""
+	}
+	switch app := string(pkt.Payload); app {
+	case "Co_CPU_BL", "Co_CPU_App":
+		return app
+	}
+	return ""
+}
+
+// readLoop reads frames from the UARTGW and dispatches them to the
+// responses or received channel.
+func (u *UARTGW) readLoop() {
+	defer close(u.done)
+	for {
+		u.mu.Lock()
+		watchdog := u.watchdog
+		u.mu.Unlock()
+		if watchdog > 0 {
+			if err := u.SetReadDeadline(time.Now().Add(watchdog)); err != nil {
+				u.readErr = err
+				return
+			}
+		}
+		pkt, err := u.ReadPacket()
+		if watchdog > 0 && errors.Is(err, os.ErrDeadlineExceeded) {
+			u.startRecovery(fmt.Errorf("no frame received for %v", watchdog), "")
+			continue
+		}
+		if err != nil {
+			u.readErr = err
+			return
+		}
+		if app := announcement(pkt); app != "" {
+			u.mu.Lock()
+			if app == "Co_CPU_BL" {
+				// Subsequent frames need to be decoded as bootloader
+				// responses.
+				u.devstate = OS
+			}
+			unexpected := !u.initializing
+			u.mu.Unlock()
+			if unexpected {
+				// startRecovery fails the command in flight (if any),
+				// which would otherwise wait for a response which will
+				// never arrive.
+				u.startRecovery(fmt.Errorf("unexpected announcement %q", app), app)
+				continue
+			}
+		}
+		ch := u.responses
+		if pkt.Cmd == AppRecv {
+			ch = u.received
+		}
+		select {
+		case ch <- pkt:
+		default:
+			log.Printf("UARTGW receive buffer full, dropping %+v", pkt)
+		}
+	}
+}
+
+// response returns the next response frame. It returns an error
+// wrapping bidcos.ErrGatewayReset when a recovery starts (see
+// startRecovery) before the response arrives.
+func (u *UARTGW) response() (*Packet, error) {
+	return u.awaitResponse(nil)
+}
+
+// errNoResponse is returned by responseWithin.
+var errNoResponse = errors.New("no response")
+
+// responseWithin is like response, but returns errNoResponse if no
+// response arrives within timeout.
+func (u *UARTGW) responseWithin(timeout time.Duration) (*Packet, error) {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	return u.awaitResponse(t.C)
+}
+
+func (u *UARTGW) awaitResponse(timeout <-chan time.Time) (*Packet, error) {
+	u.mu.Lock()
+	abort := u.abort
+	u.mu.Unlock()
+	select {
+	case pkt := <-u.responses:
+		return pkt, nil
+	case <-abort:
+		return nil, fmt.Errorf("UARTGW: %w", bidcos.ErrGatewayReset)
+	case <-timeout:
+		return nil, errNoResponse
+	case <-u.done:
+		return nil, u.readErr
+	}
+}
+
+// lock waits for a pending recovery (see startRecovery) to finish,
+// then acquires cmdMu and discards stale responses, e.g. unsolicited
+// frames or responses to a previous command which failed half-way.
+func (u *UARTGW) lock() {
+	for {
+		u.mu.Lock()
+		recovered := u.recovered
+		u.mu.Unlock()
+		if recovered == nil {
+			break
+		}
+		<-recovered
+	}
+	u.cmdMu.Lock()
+	u.dropResponses()
+}
+
+// dropResponses discards all responses which were not yet read. The
+// caller must hold cmdMu.
+func (u *UARTGW) dropResponses() {
+	for {
+		select {
+		case pkt := <-u.responses:
+			log.Printf("dropping unexpected UARTGW packet %+v", pkt)
+		default:
+			return
+		}
+	}
+}
+
 type uartdest uint8
 
 const (
@@ -133,8 +503,15 @@ const (
 	DualChangeApp
 )
 
+func (u *UARTGW) state() uartdest {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.devstate
+}
+
 func (u *UARTGW) Command(cmd uint8) (uartcmd, error) {
-	switch u.devstate {
+	devstate := u.state()
+	switch devstate {
 	case OS:
 		switch cmd {
 		case 0x00:
@@ -163,7 +540,7 @@ func (u *UARTGW) Command(cmd uint8) (uartcmd, error) {
 			return OSSetTime, nil
 
 		default:
-			return OSGetApp, fmt.Errorf("unknown command: %v (state %v)", cmd, u.devstate)
+			return OSGetApp, fmt.Errorf("unknown command: %v (state %v)", cmd, devstate)
 		}
 
 	case App:
@@ -202,10 +579,10 @@ func (u *UARTGW) Command(cmd uint8) (uartcmd, error) {
 			return AppDefaultHMID, nil
 
 		default:
-			return OSGetApp, fmt.Errorf("unknown command: %v (state %v)", cmd, u.devstate)
+			return OSGetApp, fmt.Errorf("unknown command: %v (state %v)", cmd, devstate)
 		}
 	}
-	return OSGetApp, fmt.Errorf("unknown device state: %v", u.devstate)
+	return OSGetApp, fmt.Errorf("unknown device state: %v", devstate)
 }
 
 func (c uartcmd) Byte() (byte, error) {
@@ -247,10 +624,18 @@ func (c uartcmd) Byte() (byte, error) {
 		return 0x05, nil
 	case AppAddPeer:
 		return 0x06, nil
+	case AppRemovePeer:
+		return 0x07, nil
 	case AppGetPeers:
 		return 0x08, nil
+	case AppPeerAddAES:
+		return 0x09, nil
 	case AppPeerRemoveAES:
 		return 0x0a, nil
+	case AppSetTempKey:
+		return 0x0b, nil
+	case AppSetPreviousKey:
+		return 0x0f, nil
 	}
 	return 0x00, fmt.Errorf("unknown command: %v", c)
 }
@@ -273,6 +658,8 @@ func (c uartcmd) String() string {
 		return "OSUpdateMode"
 	case OSGetCredits:
 		return "OSGetCredits"
+	case OSEnableCredits:
+		return "OSEnableCredits"
 
 	case AppAck:
 		return "AppAck"
@@ -285,6 +672,73 @@ func (c uartcmd) String() string {
 
 }
 
+// AckStatus is the first payload byte of an AppAck frame.
+type AckStatus uint8
+
+// c.f. https://svn.fhem.de/trac/browser/trunk/fhem/FHEM/00_HMUARTLGW.pm?rev=13367#L59
+const (
+	AckNack              AckStatus = 0x00
+	AckOK                AckStatus = 0x01
+	AckInfo              AckStatus = 0x02
+	AckWithResponse      AckStatus = 0x03
+	AckUnknownError      AckStatus = 0x04
+	AckNoCredits         AckStatus = 0x05
+	AckCSMABusy          AckStatus = 0x06
+	AckWithMultipartData AckStatus = 0x07
+	AckPending           AckStatus = 0x08
+	AckWithResponseAESOK AckStatus = 0x0c
+	AckWithResponseAESKO AckStatus = 0x0d
+)
+
+func (a AckStatus) String() string {
+	switch a {
+	case AckNack:
+		return "NACK"
+	case AckOK:
+		return "ACK"
+	case AckInfo:
+		return "ACK (info)"
+	case AckWithResponse:
+		return "ACK (with response)"
+	case AckUnknownError:
+		return "unknown error"
+	case AckNoCredits:
+		return "no credits"
+	case AckCSMABusy:
+		return "CSMA/CA busy"
+	case AckWithMultipartData:
+		return "ACK (with multipart data)"
+	case AckPending:
+		return "pending"
+	case AckWithResponseAESOK:
+		return "ACK (AES ok)"
+	case AckWithResponseAESKO:
+		return "AES failed"
+	default:
+		return fmt.Sprintf("<invalid ack status (%x)>", uint8(a))
+	}
+}
+
+// Err returns nil if a indicates success, or an error otherwise. The
+// errors for a lack of credits and a busy channel wrap
+// bidcos.ErrNoCredits and bidcos.ErrChannelBusy, respectively. A NACK,
+// with which the UARTGW reports that the destination of a BiDi packet
+// did not reply, wraps bidcos.ErrNoAck.
+func (a AckStatus) Err() error {
+	switch a {
+	case AckOK, AckInfo, AckWithResponse, AckWithMultipartData, AckWithResponseAESOK:
+		return nil
+	case AckNack:
+		return fmt.Errorf("UARTGW: %w", bidcos.ErrNoAck)
+	case AckNoCredits:
+		return fmt.Errorf("UARTGW: %w", bidcos.ErrNoCredits)
+	case AckCSMABusy:
+		return fmt.Errorf("UARTGW: %w", bidcos.ErrChannelBusy)
+	default:
+		return fmt.Errorf("UARTGW: command failed: %v", a)
+	}
+}
+
 // Packet is a package received from the HM-MOD-RPI-PCB serial gateway (“UARTGW”).
 type Packet struct {
 	Dst     uartdest
@@ -293,6 +747,17 @@ type Packet struct {
 	Payload []byte
 }
 
+// AckStatus returns the status of an AppAck packet.
+func (u *Packet) AckStatus() (AckStatus, error) {
+	if got, want := u.Cmd, AppAck; got != want {
+		return 0, fmt.Errorf("unexpected UARTGW packet cmd: got %v, want %v", got, want)
+	}
+	if len(u.Payload) < 1 {
+		return 0, fmt.Errorf("AppAck without status")
+	}
+	return AckStatus(u.Payload[0]), nil
+}
+
 func (u Packet) String() string {
 	return fmt.Sprintf("dest: %s\nmsgcnt: %d\ncmd: %s", u.Dst, u.msgcnt, u.Cmd)
 }
@@ -307,56 +772,120 @@ var bidcosTable = crc16.MakeTable(crc16.Params{
 	Name:   "BidCoS",
 })
 
-func (u *UARTGW) ReadPacket() (*Packet, error) {
-	var fullpkt bytes.Buffer
-	r := io.TeeReader(&unescapingReader{r: u.uart}, &fullpkt)
+// DefaultMaxFrameErrors is the default for SetMaxFrameErrors.
+const DefaultMaxFrameErrors = 10
 
-	for {
-		fullpkt.Reset()
+// SetMaxFrameErrors sets after how many consecutive invalid frames
+// (e.g. with a checksum mismatch) ReadPacket returns an error. Invalid
+// frames are skipped until then.
+func (u *UARTGW) SetMaxFrameErrors(n int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.maxFrameErrors = n
+}
 
-		b := make([]byte, 1)
-		if _, err := r.Read(b); err != nil {
-			return nil, err
-		}
-		if b[0] != 0xfd {
-			log.Printf("skipping non-frame-delimiter byte %x", b[0])
-			continue
-		}
+// frameError is returned by readFrame for invalid frames, which do not
+// affect subsequent frames. kind is used as prometheus label.
+type frameError struct {
+	kind string
+	err  error
+}
 
-		// Get packet length, read payload
-		var length uint16
-		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
-			return nil, err
+func (e *frameError) Error() string { return e.err.Error() }
+
+// ReadPacket reads the next frame from the UARTGW. It must only be
+// called by the reader goroutine, see NewUARTGW.
+//
+// Invalid frames are skipped by re-synchronizing on the next frame
+// delimiter, unless SetMaxFrameErrors consecutive frames are invalid.
+func (u *UARTGW) ReadPacket() (*Packet, error) {
+	for {
+		pkt, err := u.readFrame()
+		if err == nil {
+			u.frameErrors = 0
+			return pkt, nil
 		}
-		var payload bytes.Buffer
-		if _, err := io.CopyN(&payload, r, int64(length)); err != nil {
+		fe, ok := err.(*frameError)
+		if !ok {
 			return nil, err
 		}
+		frameErrors.With(prometheus.Labels{"kind": fe.kind}).Inc()
+		u.frameErrors++
+		u.mu.Lock()
+		max := u.maxFrameErrors
+		u.mu.Unlock()
+		if u.frameErrors >= max {
+			return nil, fmt.Errorf("%d consecutive invalid frames, last: %v", u.frameErrors, err)
+		}
+		log.Printf("skipping invalid UARTGW frame: %v", err)
+	}
+}
 
-		// Calculate and verify checksum
-		want := crc16.Checksum(fullpkt.Bytes(), bidcosTable)
-		var got uint16
-		if err := binary.Read(r, binary.BigEndian, &got); err != nil {
+// readFrame reads a single frame.
+func (u *UARTGW) readFrame() (*Packet, error) {
+	var skipped int
+	for {
+		b, err := u.br.ReadByte()
+		if err != nil {
 			return nil, err
 		}
-		if got != want {
-			return nil, fmt.Errorf("unexpected checksum: got %x, want %x", got, want)
+		if b == 0xfd {
+			break
 		}
+		skipped++
+	}
+	if skipped > 0 {
+		log.Printf("skipped %d non-frame-delimiter bytes", skipped)
+	}
 
-		// Parse packet
-		frame := payload.Bytes()
-		cmd, err := u.Command(frame[2])
-		if err != nil {
-			return nil, err
+	fullpkt := bytes.NewBuffer([]byte{0xfd})
+	r := io.TeeReader(&unescapingReader{r: u.br}, fullpkt)
+	// frameErr turns errors caused by a truncated frame into a
+	// frameError.
+	frameErr := func(err error) error {
+		if err == errFrameDelimiter {
+			return &frameError{kind: "truncated", err: fmt.Errorf("truncated frame %x", fullpkt.Bytes())}
 		}
-		// log.Printf("frame with length = %d, full = %x, content = %x, string = %s", length, fullpkt.Bytes(), frame, string(frame))
-		return &Packet{
-			Dst:     uartdest(frame[0]),
-			msgcnt:  uint8(frame[1]),
-			Cmd:     cmd,
-			Payload: frame[3:],
-		}, nil
+		return err
+	}
+
+	// Get packet length, read payload
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, frameErr(err)
+	}
+	var payload bytes.Buffer
+	if _, err := io.CopyN(&payload, r, int64(length)); err != nil {
+		return nil, frameErr(err)
 	}
+
+	// Calculate and verify checksum
+	want := crc16.Checksum(fullpkt.Bytes(), bidcosTable)
+	var got uint16
+	if err := binary.Read(r, binary.BigEndian, &got); err != nil {
+		return nil, frameErr(err)
+	}
+	if got != want {
+		return nil, &frameError{kind: "checksum", err: fmt.Errorf("unexpected checksum: got %x, want %x", got, want)}
+	}
+
+	// Parse packet
+	frame := payload.Bytes()
+	if got, want := len(frame), 3; got < want {
+		return nil, &frameError{kind: "length", err: fmt.Errorf("frame too short: got %d, want >= %d", got, want)}
+	}
+	u.observe(Received, frame)
+	cmd, err := u.Command(frame[2])
+	if err != nil {
+		return nil, &frameError{kind: "command", err: err}
+	}
+	// log.Printf("frame with length = %d, full = %x, content = %x, string = %s", length, fullpkt.Bytes(), frame, string(frame))
+	return &Packet{
+		Dst:     uartdest(frame[0]),
+		msgcnt:  uint8(frame[1]),
+		Cmd:     cmd,
+		Payload: frame[3:],
+	}, nil
 }
 
 func (u *UARTGW) WritePacket(pkt *Packet) error {
@@ -384,12 +913,73 @@ func (u *UARTGW) WritePacket(pkt *Packet) error {
 		return err
 	}
 	// log.Printf("wrote %x", fullpkt.Bytes())
-	return binary.Write(&esc, binary.BigEndian, crc16.Checksum(fullpkt.Bytes(), bidcosTable))
+	if err := binary.Write(&esc, binary.BigEndian, crc16.Checksum(fullpkt.Bytes(), bidcosTable)); err != nil {
+		return err
+	}
+	// skip delimiter and length
+	u.observe(Sent, fullpkt.Bytes()[3:])
+	return nil
 }
 
 func (u *UARTGW) init(now time.Time) error {
+	defer func() {
+		u.mu.Lock()
+		u.initializing = false
+		u.mu.Unlock()
+	}()
+	// Deliberately not calling u.lock(): the first frame is sent
+	// unsolicited by the UARTGW after a reset.
+	u.cmdMu.Lock()
+	defer u.cmdMu.Unlock()
+	return u.setup(now)
+}
+
+// initRunning implements NewRunningUARTGW.
+func (u *UARTGW) initRunning(now time.Time) error {
+	defer func() {
+		u.mu.Lock()
+		u.initializing = false
+		u.mu.Unlock()
+	}()
+	u.lock()
+	defer u.cmdMu.Unlock()
+	app, err := u.queryApp()
+	if err != nil {
+		return fmt.Errorf("querying application: %v", err)
+	}
+	return u.setupFrom(app, now)
+}
+
+// queryApp returns the application which the UARTGW is running. The
+// caller must hold cmdMu.
+func (u *UARTGW) queryApp() (string, error) {
+	if err := u.WritePacket(&Packet{
+		Dst: OS,
+		Cmd: OSGetApp,
+	}); err != nil {
+		return "", err
+	}
+	pkt, err := u.response()
+	if err != nil {
+		return "", err
+	}
+	if app := announcement(pkt); app != "" {
+		return app, nil
+	}
+	// c.f. https://svn.fhem.de/trac/browser/trunk/fhem/FHEM/00_HMUARTLGW.pm?rev=13367
+	// (HMUARTLGW_STATE_QUERY_APP): an ack with status info, followed by
+	// the application name.
+	if (pkt.Cmd == OSAck || pkt.Cmd == AppAck) && len(pkt.Payload) > 1 && AckStatus(pkt.Payload[0]) == AckInfo {
+		return string(pkt.Payload[1:]), nil
+	}
+	return "", fmt.Errorf("unexpected response: %v %x", pkt.Cmd, pkt.Payload)
+}
+
+// setup initializes the UARTGW after a reset. The caller must hold
+// cmdMu.
+func (u *UARTGW) setup(now time.Time) error {
 	// on the wire: FD000C000000436F5F4350555F424C7251
-	pkt, err := u.ReadPacket()
+	pkt, err := u.response()
 	if err != nil {
 		return err
 	}
@@ -399,9 +989,24 @@ func (u *UARTGW) init(now time.Time) error {
 	if got, want := string(pkt.Payload), "Co_CPU_BL"; got != want {
 		return fmt.Errorf("unexpected UARTGW application: got %q, want %q", got, want)
 	}
+	return u.setupFrom(string(pkt.Payload), now)
+}
 
-	if err := u.switchToApp(); err != nil {
-		return fmt.Errorf("switching from bootloader to application: %v", err)
+// setupFrom initializes the UARTGW, which announced that it is running
+// app (“Co_CPU_BL” for the bootloader or “Co_CPU_App”). The caller must
+// hold cmdMu.
+func (u *UARTGW) setupFrom(app string, now time.Time) error {
+	switch app {
+	case "Co_CPU_BL":
+		if err := u.switchToApp(); err != nil {
+			return fmt.Errorf("switching from bootloader to application: %v", err)
+		}
+	case "Co_CPU_App":
+		u.mu.Lock()
+		u.devstate = App
+		u.mu.Unlock()
+	default:
+		return fmt.Errorf("unexpected UARTGW application: %q", app)
 	}
 
 	if err := u.getFirmwareVersion(); err != nil {
@@ -412,17 +1017,29 @@ func (u *UARTGW) init(now time.Time) error {
 		return fmt.Errorf("enabling CSMA/CA: %v", err)
 	}
 
+	if err := u.enableCredits(); err != nil {
+		return fmt.Errorf("enabling credits: %v", err)
+	}
+
 	if err := u.getSerialNumber(); err != nil {
 		return fmt.Errorf("getting serial number: %v", err)
 	}
 
-	if err := u.SetTime(now); err != nil {
+	if err := u.setTime(now); err != nil {
 		return fmt.Errorf("setting time: %v", err)
 	}
 
-	if err := u.setCurrentKey(); err != nil {
+	u.mu.Lock()
+	current, previous := u.currentKey, u.previousKey
+	u.mu.Unlock()
+	if err := u.setKey(AppSetCurrentKey, current); err != nil {
 		return fmt.Errorf("setting current key: %v", err)
 	}
+	if previous != nil {
+		if err := u.setKey(AppSetPreviousKey, *previous); err != nil {
+			return fmt.Errorf("setting previous key: %v", err)
+		}
+	}
 
 	if err := u.setHMID(); err != nil {
 		return fmt.Errorf("setting HMID: %v", err)
@@ -439,7 +1056,7 @@ func (u *UARTGW) switchToApp() error {
 	}
 
 	// on the wire: FD000400000401993D
-	pkt, err := u.ReadPacket()
+	pkt, err := u.response()
 	if err != nil {
 		return err
 	}
@@ -448,7 +1065,7 @@ func (u *UARTGW) switchToApp() error {
 	}
 
 	// on the wire: FD000D000000436F5F4350555F417070D831
-	pkt, err = u.ReadPacket()
+	pkt, err = u.response()
 	if err != nil {
 		return err
 	}
@@ -461,7 +1078,9 @@ func (u *UARTGW) switchToApp() error {
 		return fmt.Errorf("unexpected UARTGW application: got %q, want %q", got, want)
 	}
 
+	u.mu.Lock()
 	u.devstate = App
+	u.mu.Unlock()
 
 	return nil
 }
@@ -473,7 +1092,7 @@ func (u *UARTGW) getFirmwareVersion() error {
 	}
 
 	// on the wire: FD000A00010402010003010201AA8A
-	pkt, err := u.ReadPacket()
+	pkt, err := u.response()
 	if err != nil {
 		return err
 	}
@@ -483,14 +1102,23 @@ func (u *UARTGW) getFirmwareVersion() error {
 	}
 
 	version := pkt.Payload[4:]
-	u.FirmwareVersion = fmt.Sprintf("%d.%d.%d",
+	u.mu.Lock()
+	u.firmwareVersion = fmt.Sprintf("%d.%d.%d",
 		uint8(version[0]),
 		uint8(version[1]),
 		uint8(version[2]))
+	u.mu.Unlock()
 
 	return nil
 }
 
+// FirmwareVersion returns the firmware version of the UARTGW, e.g. 1.4.1.
+func (u *UARTGW) FirmwareVersion() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.firmwareVersion
+}
+
 // enableCSMACA enables Carrier sense multiple access with collision avoidance
 func (u *UARTGW) enableCSMACA() error {
 	// on the wire: FD000400020A003D10
@@ -501,7 +1129,7 @@ func (u *UARTGW) enableCSMACA() error {
 	}
 
 	// on the wire: FD0004000204011916
-	pkt, err := u.ReadPacket()
+	pkt, err := u.response()
 	if err != nil {
 		return err
 	}
@@ -513,6 +1141,62 @@ func (u *UARTGW) enableCSMACA() error {
 	return nil
 }
 
+// enableCredits makes the UARTGW track its duty cycle budget, see
+// Credits.
+func (u *UARTGW) enableCredits() error {
+	if err := u.WritePacket(&Packet{
+		Cmd:     OSEnableCredits,
+		Payload: []byte{0x01}}); err != nil {
+		return err
+	}
+
+	pkt, err := u.response()
+	if err != nil {
+		return err
+	}
+
+	status, err := pkt.AckStatus()
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
+
+// Credits returns the remaining duty cycle budget in percent: radio
+// regulations allow the UARTGW to transmit for 1% of every hour.
+// Credits implements bidcos.CreditGateway.
+func (u *UARTGW) Credits() (float64, error) {
+	u.lock()
+	defer u.cmdMu.Unlock()
+
+	if err := u.WritePacket(&Packet{Cmd: OSGetCredits}); err != nil {
+		return 0, err
+	}
+
+	pkt, err := u.response()
+	if err != nil {
+		return 0, err
+	}
+	status, err := pkt.AckStatus()
+	if err != nil {
+		return 0, err
+	}
+	if err := status.Err(); err != nil {
+		return 0, err
+	}
+	if got, want := len(pkt.Payload), 2; got < want {
+		return 0, fmt.Errorf("credits response too short: got %d, want >= %d", got, want)
+	}
+	// The UARTGW reports the used budget in units of 0.5%, c.f. FHEM
+	// 00_HMUARTLGW.pm.
+	remaining := 100 - float64(pkt.Payload[1])/2
+	if remaining < 0 {
+		remaining = 0
+	}
+	credits.Set(remaining)
+	return remaining, nil
+}
+
 func (u *UARTGW) getSerialNumber() error {
 	// on the wire: FD000300030B9239
 	if err := u.WritePacket(&Packet{Cmd: OSGetSerial}); err != nil {
@@ -520,7 +1204,7 @@ func (u *UARTGW) getSerialNumber() error {
 	}
 
 	// on the wire: FD000E000304024E4551313333303938306AB9
-	pkt, err := u.ReadPacket()
+	pkt, err := u.response()
 	if err != nil {
 		return err
 	}
@@ -529,12 +1213,28 @@ func (u *UARTGW) getSerialNumber() error {
 		return fmt.Errorf("unexpected UARTGW packet cmd: got %v, want %v", got, want)
 	}
 
-	u.SerialNumber = string(pkt.Payload[1:])
+	u.mu.Lock()
+	u.serialNumber = string(pkt.Payload[1:])
+	u.mu.Unlock()
 
 	return nil
 }
 
+// SerialNumber returns the serial number of the UARTGW, e.g. NEQ1330980.
+func (u *UARTGW) SerialNumber() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.serialNumber
+}
+
+// SetTime sets the time of the UARTGW to now.
 func (u *UARTGW) SetTime(now time.Time) error {
+	u.lock()
+	defer u.cmdMu.Unlock()
+	return u.setTime(now)
+}
+
+func (u *UARTGW) setTime(now time.Time) error {
 	// on the wire: FD000800040E58A7116300548E
 	secsSinceEpoch := uint32(now.Unix())
 	var timePayload bytes.Buffer
@@ -550,7 +1250,7 @@ func (u *UARTGW) SetTime(now time.Time) error {
 	}
 
 	// on the wire: FD000400040401196E
-	pkt, err := u.ReadPacket()
+	pkt, err := u.response()
 	if err != nil {
 		return err
 	}
@@ -562,33 +1262,67 @@ func (u *UARTGW) SetTime(now time.Time) error {
 	return nil
 }
 
-func (u *UARTGW) setCurrentKey() error {
+// setKey sets the AES key k via cmd, which is AppSetCurrentKey,
+// AppSetPreviousKey or AppSetTempKey. The caller must hold cmdMu.
+func (u *UARTGW) setKey(cmd uartcmd, k bidcos.Key) error {
 	// on the wire: FD001401050300112233445566778899AABBCCDDEEFF024C6D
-	keyPayload := []byte{
-		0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xAA, 0xBB, 0xCC, 0xDD, 0xEE, 0xFF,
-		02, // key index
-	}
 	if err := u.WritePacket(&Packet{
 		Dst:     App,
-		Cmd:     AppSetCurrentKey,
-		Payload: keyPayload,
+		Cmd:     cmd,
+		Payload: append(k.Key[:], k.Index),
 	}); err != nil {
 		return err
 	}
 
 	// on the wire: FD0004010504010D7A
-	pkt, err := u.ReadPacket()
+	pkt, err := u.response()
 	if err != nil {
 		return err
 	}
+	status, err := pkt.AckStatus()
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
 
-	if got, want := pkt.Cmd, AppAck; got != want {
-		return fmt.Errorf("unexpected UARTGW packet cmd: got %v, want %v", got, want)
+// SetCurrentKey makes the UARTGW sign packets to and verify packets of
+// AES peers (see AddPeerAES) using k.
+func (u *UARTGW) SetCurrentKey(k bidcos.Key) error {
+	u.lock()
+	defer u.cmdMu.Unlock()
+	if err := u.setKey(AppSetCurrentKey, k); err != nil {
+		return err
 	}
+	u.mu.Lock()
+	u.currentKey = k
+	u.mu.Unlock()
+	return nil
+}
 
+// SetPreviousKey makes the UARTGW accept k from AES peers which were
+// not yet switched to the current key.
+func (u *UARTGW) SetPreviousKey(k bidcos.Key) error {
+	u.lock()
+	defer u.cmdMu.Unlock()
+	if err := u.setKey(AppSetPreviousKey, k); err != nil {
+		return err
+	}
+	u.mu.Lock()
+	u.previousKey = &k
+	u.mu.Unlock()
 	return nil
 }
 
+// SetTempKey makes the UARTGW accept k while AES peers are switched to
+// k, see bidcos.Sender.ChangeKey. Unlike the current and previous key,
+// the temporary key is not set again after a reset.
+func (u *UARTGW) SetTempKey(k bidcos.Key) error {
+	u.lock()
+	defer u.cmdMu.Unlock()
+	return u.setKey(AppSetTempKey, k)
+}
+
 func (u *UARTGW) setHMID() error {
 	// on the wire: FD0006010600FC7DB02CD166
 	if err := u.WritePacket(&Packet{
@@ -600,7 +1334,7 @@ func (u *UARTGW) setHMID() error {
 	}
 
 	// on the wire: FD0004010604010D46
-	pkt, err := u.ReadPacket()
+	pkt, err := u.response()
 	if err != nil {
 		return err
 	}
@@ -612,7 +1346,45 @@ func (u *UARTGW) setHMID() error {
 	return nil
 }
 
+// peer is the configuration of a device in the UARTGW’s peer table.
+type peer struct {
+	channels int
+	// aes is whether the UARTGW signs packets to and verifies packets
+	// of the peer using the current key.
+	aes bool
+}
+
+// AddPeer adds the device with BidCoS address addr to the UARTGW’s
+// peer table. The UARTGW only acknowledges packets of peers.
 func (u *UARTGW) AddPeer(addr []byte, channels int) error {
+	return u.addPeerLocked(addr, peer{channels: channels})
+}
+
+// AddPeerAES is like AddPeer, but additionally enables AES signing for
+// all channels of the device, e.g. for window contacts or door locks.
+func (u *UARTGW) AddPeerAES(addr []byte, channels int) error {
+	return u.addPeerLocked(addr, peer{channels: channels, aes: true})
+}
+
+func (u *UARTGW) addPeerLocked(addr []byte, p peer) error {
+	if got, want := len(addr), 3; got != want {
+		return fmt.Errorf("unexpected address length: got %d, want %d", got, want)
+	}
+	u.lock()
+	defer u.cmdMu.Unlock()
+	a := [3]byte{addr[0], addr[1], addr[2]}
+	if err := u.addPeer(a, p); err != nil {
+		return err
+	}
+	u.mu.Lock()
+	u.peers[a] = p
+	u.mu.Unlock()
+	return nil
+}
+
+// addPeer implements AddPeer and AddPeerAES. The caller must hold
+// cmdMu.
+func (u *UARTGW) addPeer(addr [3]byte, p peer) error {
 	// Repeat the message twice because the CCU2 does that
 	// (cargo-culted from homegear).
 	for i := 0; i < 2; i++ {
@@ -631,7 +1403,7 @@ func (u *UARTGW) AddPeer(addr []byte, channels int) error {
 		}
 
 		// on the wire: FD00100108040701010001FFFFFFFFFFFFFFFFCAAF
-		pkt, err := u.ReadPacket()
+		pkt, err := u.response()
 		if err != nil {
 			return err
 		}
@@ -642,21 +1414,27 @@ func (u *UARTGW) AddPeer(addr []byte, channels int) error {
 	}
 
 	// on the wire: FD000D010A0A40C2A8000102030405068B17
-	removeAESPayload := make([]byte, 0, 3+channels)
-	removeAESPayload = append(removeAESPayload, addr...)
-	for i := 0; i < channels; i++ {
-		removeAESPayload = append(removeAESPayload, byte(i))
+	aesCmd, keyIndex := AppPeerRemoveAES, byte(0x00) // key index 0, i.e. no encryption
+	if p.aes {
+		u.mu.Lock()
+		aesCmd, keyIndex = AppPeerAddAES, u.currentKey.Index
+		u.mu.Unlock()
+	}
+	aesPayload := make([]byte, 0, 3+p.channels)
+	aesPayload = append(aesPayload, addr[:]...)
+	for i := 0; i < p.channels; i++ {
+		aesPayload = append(aesPayload, byte(i))
 	}
 	if err := u.WritePacket(&Packet{
 		Dst:     App,
-		Cmd:     AppPeerRemoveAES,
-		Payload: removeAESPayload,
+		Cmd:     aesCmd,
+		Payload: aesPayload,
 	}); err != nil {
 		return err
 	}
 
 	// on the wire: FD0004010A04010DB6
-	pkt, err := u.ReadPacket()
+	pkt, err := u.response()
 	if err != nil {
 		return err
 	}
@@ -680,7 +1458,7 @@ func (u *UARTGW) AddPeer(addr []byte, channels int) error {
 	}
 
 	// on the wire: FD0010010B040701010001FFFFFFFFFFFFFFFFC9A5
-	pkt, err = u.ReadPacket()
+	pkt, err = u.response()
 	if err != nil {
 		return err
 	}
@@ -693,7 +1471,7 @@ func (u *UARTGW) AddPeer(addr []byte, channels int) error {
 	// on the wire: FD0009010C0640C2A80000004236
 	addPeerPayload = [6]byte{
 		addr[0], addr[1], addr[2],
-		0x00, // key index 0, i.e. no encryption
+		keyIndex,
 		0x00, // don’t wake up
 		0x00,
 	}
@@ -706,7 +1484,7 @@ func (u *UARTGW) AddPeer(addr []byte, channels int) error {
 	}
 
 	// on the wire: FD0010010C040701010001FFFFFFFFFFFFFFFFCEB7
-	pkt, err = u.ReadPacket()
+	pkt, err = u.response()
 	if err != nil {
 		return err
 	}
@@ -718,54 +1496,177 @@ func (u *UARTGW) AddPeer(addr []byte, channels int) error {
 	return nil
 }
 
-func (u *UARTGW) Confirm() error {
-	for {
-		pkt, err := u.ReadPacket()
-		if err != nil {
-			return err
-		}
+// RemovePeer removes the device with BidCoS address addr from the
+// UARTGW’s peer table.
+func (u *UARTGW) RemovePeer(addr [3]byte) error {
+	u.lock()
+	defer u.cmdMu.Unlock()
 
-		//log.Printf("pkt for confirmation: %+v", pkt)
+	if err := u.WritePacket(&Packet{
+		Dst:     App,
+		Cmd:     AppRemovePeer,
+		Payload: addr[:],
+	}); err != nil {
+		return err
+	}
 
-		// TODO(later): verify messagecounter
+	pkt, err := u.response()
+	if err != nil {
+		return err
+	}
+	status, err := pkt.AckStatus()
+	if err != nil {
+		return err
+	}
+	if err := status.Err(); err != nil {
+		return err
+	}
 
-		if pkt.Cmd == AppRecv {
-			log.Printf("dropping pkt=%+v, looking for confirmation", pkt)
-			continue
-		}
+	u.mu.Lock()
+	delete(u.peers, addr)
+	u.mu.Unlock()
+	return nil
+}
 
-		if got, want := pkt.Cmd, AppAck; got != want {
-			return fmt.Errorf("unexpected UARTGW packet cmd: got %v, want %v", got, want)
-		}
+// peersHeaderLen and peerEntryLen describe the AppGetPeers response
+// payload, c.f. FHEM 00_HMUARTLGW.pm:
+//
+//	uint8    status (AckWithMultipartData)
+//	[2]byte  unknown
+//	uint16   number of peers (big endian)
+//	[8]byte  unknown
+//
+// followed by one entry per peer (possibly spread across multiple
+// responses, which then only contain the status byte and entries):
+//
+//	[3]byte  address
+//	[8]byte  AES channel bitmask
+//	uint8    flags
+const (
+	peersHeaderLen = 13
+	peerEntryLen   = 12
+)
 
-		break
+// Peers returns the addresses of the devices in the UARTGW’s peer
+// table.
+func (u *UARTGW) Peers() ([][3]byte, error) {
+	u.lock()
+	defer u.cmdMu.Unlock()
+
+	if err := u.WritePacket(&Packet{
+		Dst: App,
+		Cmd: AppGetPeers,
+	}); err != nil {
+		return nil, err
 	}
-	return nil
+
+	var (
+		peers [][3]byte
+		count = -1
+	)
+	for count == -1 || len(peers) < count {
+		pkt, err := u.response()
+		if err != nil {
+			return nil, err
+		}
+		status, err := pkt.AckStatus()
+		if err != nil {
+			return nil, err
+		}
+		if err := status.Err(); err != nil {
+			return nil, err
+		}
+		entries := pkt.Payload[1:]
+		if count == -1 {
+			if got, want := len(pkt.Payload), peersHeaderLen; got < want {
+				return nil, fmt.Errorf("AppGetPeers response too short: got %d, want >= %d", got, want)
+			}
+			count = int(binary.BigEndian.Uint16(pkt.Payload[3:5]))
+			entries = pkt.Payload[peersHeaderLen:]
+		}
+		if len(entries)%peerEntryLen != 0 {
+			return nil, fmt.Errorf("AppGetPeers response has invalid length: %x", pkt.Payload)
+		}
+		if len(entries) == 0 && len(peers) < count {
+			return nil, fmt.Errorf("AppGetPeers response lists %d peers, got %d", count, len(peers))
+		}
+		for off := 0; off < len(entries); off += peerEntryLen {
+			peers = append(peers, [3]byte{entries[off], entries[off+1], entries[off+2]})
+		}
+	}
+	return peers, nil
 }
 
+// Confirm returns whether the UARTGW acknowledged the packet sent by
+// the most recent Write call.
+func (u *UARTGW) Confirm() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.confirmErr
+}
+
+// defaultAppAckTimeout is how long AppSend waits for each AppAck. It
+// covers waiting for the radio channel to become free and for the
+// reply of the destination of a BiDi packet.
+const defaultAppAckTimeout = 5 * time.Second
+
+// AppSend sends the BidCoS packet payload via radio. When an AppAck
+// (e.g. the final one after AckPending) does not arrive in time, AppSend
+// returns an error wrapping bidcos.ErrNoAck.
 func (u *UARTGW) AppSend(payload []byte) error {
-	return u.WritePacket(&Packet{
+	u.lock()
+	defer u.cmdMu.Unlock()
+	if err := u.WritePacket(&Packet{
 		Dst:     App,
 		Cmd:     AppSend,
 		Payload: payload,
-	})
+	}); err != nil {
+		return err
+	}
+
+	for {
+		pkt, err := u.responseWithin(u.appAckTimeout)
+		if err == errNoResponse {
+			return fmt.Errorf("UARTGW: no AppAck within %v: %w", u.appAckTimeout, bidcos.ErrNoAck)
+		}
+		if err != nil {
+			return err
+		}
+
+		// TODO(later): verify messagecounter
+
+		status, err := pkt.AckStatus()
+		if err != nil {
+			return err
+		}
+		// The UARTGW sends another AppAck once the packet was
+		// sent, e.g. after waiting for the channel to become free.
+		if status == AckPending {
+			continue
+		}
+		return status.Err()
+	}
 }
 
 // Write implements io.Writer so that a UARTGW can be used by the
-// bidcos package.
+// bidcos package. Write returns once the packet was sent, the UARTGW’s
+// acknowledgement is returned by Confirm.
 func (u *UARTGW) Write(p []byte) (n int, err error) {
-	return len(p), u.AppSend(p)
+	err = u.AppSend(p)
+	u.mu.Lock()
+	u.confirmErr = err
+	u.mu.Unlock()
+	return len(p), nil
 }
 
-// Write implements io.Reader so that a UARTGW can be used by the
+// Read implements io.Reader so that a UARTGW can be used by the
 // bidcos package.
 func (u *UARTGW) Read(p []byte) (n int, err error) {
-	pkt, err := u.ReadPacket()
-	if err != nil {
-		return 0, err
-	}
-	if got, want := pkt.Cmd, AppRecv; got != want {
-		return 0, fmt.Errorf("unexpected UARTGW packet cmd: got %v, want %v", got, want)
+	var pkt *Packet
+	select {
+	case pkt = <-u.received:
+	case <-u.done:
+		return 0, u.readErr
 	}
 	if got, want := len(p), len(pkt.Payload); got < want {
 		return 0, fmt.Errorf("buffer too short for packet: got %v, want >= %v", got, want)
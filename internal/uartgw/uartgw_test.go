@@ -0,0 +1,522 @@
+package uartgw
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stapelberg/hmgo/internal/bidcos"
+)
+
+// frame returns pkt as written to the wire by WritePacket.
+func frame(t *testing.T, pkt *Packet) []byte {
+	var buf bytes.Buffer
+	u := &UARTGW{uart: &buf}
+	if err := u.WritePacket(pkt); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func newTestUARTGW(wire []byte) *UARTGW {
+	return &UARTGW{
+		br:             bufio.NewReader(bytes.NewReader(wire)),
+		devstate:       App,
+		maxFrameErrors: DefaultMaxFrameErrors,
+	}
+}
+
+func TestReadPacketResync(t *testing.T) {
+	// 0xfd within the payload must be escaped and round-trip.
+	good := frame(t, &Packet{Dst: App, Cmd: AppRecv, Payload: []byte{0xfd, 0xfc, 0x42}})
+
+	corrupt := append([]byte(nil), good...)
+	corrupt[len(corrupt)-1] ^= 0xff // checksum mismatch
+
+	truncated := good[:len(good)-3]
+
+	var wire []byte
+	wire = append(wire, 0x00, 0x01) // garbage before the first frame
+	wire = append(wire, corrupt...)
+	wire = append(wire, truncated...)
+	wire = append(wire, good...)
+
+	u := newTestUARTGW(wire)
+	pkt, err := u.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := pkt.Payload, []byte{0xfd, 0xfc, 0x42}; !bytes.Equal(got, want) {
+		t.Fatalf("unexpected payload: got %x, want %x", got, want)
+	}
+	if got, want := u.frameErrors, 0; got != want {
+		t.Fatalf("consecutive frame errors not reset: got %d, want %d", got, want)
+	}
+}
+
+func TestReadPacketMaxFrameErrors(t *testing.T) {
+	good := frame(t, &Packet{Dst: App, Cmd: AppRecv, Payload: []byte{0x42}})
+	corrupt := append([]byte(nil), good...)
+	corrupt[len(corrupt)-1] ^= 0xff
+
+	u := newTestUARTGW(bytes.Repeat(corrupt, 3))
+	u.SetMaxFrameErrors(3)
+	_, err := u.ReadPacket()
+	if err == nil || !strings.Contains(err.Error(), "3 consecutive invalid frames") {
+		t.Fatalf("unexpected error: got %v, want 3 consecutive invalid frames", err)
+	}
+}
+
+// respondingUART queues responses once a frame is written to it.
+type respondingUART struct {
+	bytes.Buffer
+	u         *UARTGW
+	responses []*Packet
+}
+
+func (r *respondingUART) Write(p []byte) (n int, err error) {
+	for _, pkt := range r.responses {
+		r.u.responses <- pkt
+	}
+	r.responses = nil
+	return r.Buffer.Write(p)
+}
+
+func newRespondingUARTGW(responses ...*Packet) *UARTGW {
+	u := &UARTGW{
+		devstate:      App,
+		responses:     make(chan *Packet, len(responses)),
+		peers:         make(map[[3]byte]peer),
+		appAckTimeout: time.Second,
+	}
+	u.uart = &respondingUART{u: u, responses: responses}
+	return u
+}
+
+func newAckingUARTGW(acks ...AckStatus) *UARTGW {
+	var responses []*Packet
+	for _, ack := range acks {
+		responses = append(responses, &Packet{Dst: App, Cmd: AppAck, Payload: []byte{byte(ack)}})
+	}
+	return newRespondingUARTGW(responses...)
+}
+
+func TestAppSendAckStatus(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		acks    []AckStatus
+		wantErr error
+	}{
+		{name: "OK", acks: []AckStatus{AckOK}},
+		{name: "Pending", acks: []AckStatus{AckPending, AckPending, AckOK}},
+		{name: "NoCredits", acks: []AckStatus{AckNoCredits}, wantErr: bidcos.ErrNoCredits},
+		{name: "CSMABusy", acks: []AckStatus{AckPending, AckCSMABusy}, wantErr: bidcos.ErrChannelBusy},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			u := newAckingUARTGW(tt.acks...)
+			err := u.AppSend([]byte{0x42})
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("unexpected error: got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAppSendNack(t *testing.T) {
+	u := newAckingUARTGW(AckNack)
+	if err := u.AppSend([]byte{0x42}); !errors.Is(err, bidcos.ErrNoAck) {
+		t.Fatalf("unexpected error: got %v, want %v", err, bidcos.ErrNoAck)
+	}
+}
+
+func TestAppSendPendingTimeout(t *testing.T) {
+	// The final AppAck after AckPending never arrives.
+	u := newAckingUARTGW(AckPending)
+	u.appAckTimeout = 10 * time.Millisecond
+	if err := appSend(t, u); !errors.Is(err, bidcos.ErrNoAck) {
+		t.Fatalf("unexpected error: got %v, want %v", err, bidcos.ErrNoAck)
+	}
+	// cmdMu was released.
+	u.uart.(*respondingUART).responses = []*Packet{{Dst: App, Cmd: AppAck, Payload: []byte{byte(AckOK)}}}
+	if err := appSend(t, u); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPeers(t *testing.T) {
+	aes := bytes.Repeat([]byte{0xff}, 8)
+	first := []byte{byte(AckWithMultipartData), 0x01, 0x01, 0x00, 0x03}
+	first = append(first, aes...)
+	first = append(first, 0x39, 0x06, 0xeb)
+	first = append(first, aes...)
+	first = append(first, 0x00)
+	second := []byte{byte(AckWithMultipartData)}
+	for _, addr := range [][3]byte{{0x39, 0x0f, 0x17}, {0x40, 0xc2, 0xa8}} {
+		second = append(second, addr[:]...)
+		second = append(second, aes...)
+		second = append(second, 0x00)
+	}
+	u := newRespondingUARTGW(
+		&Packet{Dst: App, Cmd: AppAck, Payload: first},
+		&Packet{Dst: App, Cmd: AppAck, Payload: second})
+	peers, err := u.Peers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][3]byte{{0x39, 0x06, 0xeb}, {0x39, 0x0f, 0x17}, {0x40, 0xc2, 0xa8}}
+	if !reflect.DeepEqual(peers, want) {
+		t.Fatalf("unexpected peers: got %x, want %x", peers, want)
+	}
+}
+
+func TestRemovePeer(t *testing.T) {
+	addr := [3]byte{0x39, 0x06, 0xeb}
+	u := newAckingUARTGW(AckOK)
+	u.peers[addr] = peer{channels: 2}
+	if err := u.RemovePeer(addr); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := u.peers[addr]; ok {
+		t.Fatalf("peer %x not removed from peers", addr)
+	}
+	// frame delimiter, length, destination, message counter, command, address
+	if got, want := u.uart.(*respondingUART).Bytes()[:9], []byte{0xfd, 0x00, 0x06, 0x01, 0x00, 0x07, 0x39, 0x06, 0xeb}; !bytes.Equal(got, want) {
+		t.Fatalf("unexpected frame: got %x, want %x", got, want)
+	}
+}
+
+// writtenPackets decodes the frames which were written to u.
+func writtenPackets(t *testing.T, u *UARTGW) []*Packet {
+	t.Helper()
+	dec := &UARTGW{
+		br:             bufio.NewReader(bytes.NewReader(u.uart.(*respondingUART).Bytes())),
+		devstate:       App,
+		maxFrameErrors: 1,
+	}
+	var pkts []*Packet
+	for {
+		pkt, err := dec.ReadPacket()
+		if err == io.EOF {
+			return pkts
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkts = append(pkts, pkt)
+	}
+}
+
+func TestSetCurrentKey(t *testing.T) {
+	key := bidcos.Key{Index: 0x04, Key: [16]byte{0x0f, 0x0e, 0x0d}}
+	u := newAckingUARTGW(AckOK)
+	if err := u.SetCurrentKey(key); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := u.currentKey, key; got != want {
+		t.Fatalf("unexpected current key: got %x, want %x", got, want)
+	}
+	pkts := writtenPackets(t, u)
+	if got, want := len(pkts), 1; got != want {
+		t.Fatalf("unexpected number of commands: got %d, want %d", got, want)
+	}
+	if got, want := pkts[0].Cmd, AppSetCurrentKey; got != want {
+		t.Fatalf("unexpected command: got %v, want %v", got, want)
+	}
+	if got, want := pkts[0].Payload, append(key.Key[:], key.Index); !bytes.Equal(got, want) {
+		t.Fatalf("unexpected payload: got %x, want %x", got, want)
+	}
+}
+
+func TestDefaultKey(t *testing.T) {
+	// bidcos.Sender must be able to answer challenges for the key index
+	// which AddPeerAES advertises before SetCurrentKey is called.
+	u := newAckingUARTGW(AckOK, AckOK, AckOK, AckOK, AckOK)
+	u.currentKey = newUARTGW(nil).currentKey
+	if err := u.AddPeerAES([]byte{0x39, 0x06, 0xeb}, 2); err != nil {
+		t.Fatal(err)
+	}
+	pkts := writtenPackets(t, u)
+	if got, want := pkts[4].Cmd, AppAddPeer; got != want {
+		t.Fatalf("unexpected command: got %v, want %v", got, want)
+	}
+	if got, want := pkts[4].Payload[3], bidcos.DefaultKey.Index; got != want {
+		t.Fatalf("unexpected key index: got %d, want %d", got, want)
+	}
+}
+
+func TestAddPeerAES(t *testing.T) {
+	addr := []byte{0x39, 0x06, 0xeb}
+	u := newAckingUARTGW(AckOK, AckOK, AckOK, AckOK, AckOK)
+	u.currentKey = bidcos.Key{Index: 0x04}
+	if err := u.AddPeerAES(addr, 2); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := u.peers[[3]byte{0x39, 0x06, 0xeb}], (peer{channels: 2, aes: true}); got != want {
+		t.Fatalf("unexpected peer: got %+v, want %+v", got, want)
+	}
+
+	pkts := writtenPackets(t, u)
+	if got, want := len(pkts), 5; got != want {
+		t.Fatalf("unexpected number of commands: got %d, want %d", got, want)
+	}
+	for _, tt := range []struct {
+		pkt     *Packet
+		cmd     uartcmd
+		payload []byte
+	}{
+		{pkts[2], AppPeerAddAES, []byte{0x39, 0x06, 0xeb, 0x00, 0x01}},
+		{pkts[4], AppAddPeer, []byte{0x39, 0x06, 0xeb, 0x04, 0x00, 0x00}},
+	} {
+		if got, want := tt.pkt.Cmd, tt.cmd; got != want {
+			t.Errorf("unexpected command: got %v, want %v", got, want)
+		}
+		if got, want := tt.pkt.Payload, tt.payload; !bytes.Equal(got, want) {
+			t.Errorf("%v: unexpected payload: got %x, want %x", tt.cmd, got, want)
+		}
+	}
+}
+
+// fakePCB emulates an HM-MOD-RPI-PCB on the device side of a net.Pipe:
+// it announces its bootloader, answers the commands of setup and
+// AddPeer and acknowledges AppSend.
+type fakePCB struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	mu sync.Mutex
+	// hung makes the fake read frames without answering, like a
+	// wedged UARTGW.
+	hung bool
+	// onSend (if non-nil) is called instead of acknowledging the next
+	// AppSend.
+	onSend func()
+	resets int
+	// added lists the address of every peer added, i.e. of every
+	// AppPeerAddAES or AppPeerRemoveAES command (see addPeer).
+	added [][3]byte
+}
+
+func newFakePCB(t *testing.T) (host net.Conn, f *fakePCB) {
+	host, dev := net.Pipe()
+	f = &fakePCB{conn: dev, br: bufio.NewReader(dev)}
+	t.Cleanup(func() { host.Close() })
+	go f.serve()
+	return host, f
+}
+
+// send writes pkt to the UARTGW.
+func (f *fakePCB) send(pkt *Packet) {
+	var buf bytes.Buffer
+	enc := &UARTGW{uart: &buf}
+	if err := enc.WritePacket(pkt); err != nil {
+		panic(err)
+	}
+	f.conn.Write(buf.Bytes())
+}
+
+func (f *fakePCB) ack(payload ...byte) {
+	f.send(&Packet{Dst: App, Cmd: AppAck, Payload: payload})
+}
+
+func (f *fakePCB) announce(app string) {
+	f.send(&Packet{Dst: OS, Cmd: OSGetApp, Payload: []byte(app)})
+}
+
+// reset implements the reset function of Watchdog.
+func (f *fakePCB) reset() error {
+	f.mu.Lock()
+	f.hung = false
+	f.resets++
+	f.mu.Unlock()
+	go f.announce("Co_CPU_BL")
+	return nil
+}
+
+// readFrame returns the destination, raw command byte and payload of
+// the next frame written by the UARTGW.
+func (f *fakePCB) readFrame() (dst, cmd byte, payload []byte, _ error) {
+	for {
+		b, err := f.br.ReadByte()
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		if b == 0xfd {
+			break
+		}
+	}
+	r := &unescapingReader{r: f.br}
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return 0, 0, nil, err
+	}
+	frame := make([]byte, length+2) // including checksum
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return 0, 0, nil, err
+	}
+	return frame[0], frame[2], frame[3:length], nil
+}
+
+func (f *fakePCB) serve() {
+	f.announce("Co_CPU_BL")
+	for {
+		dst, cmd, payload, err := f.readFrame()
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		hung := f.hung
+		onSend := f.onSend
+		if dst == byte(App) && cmd == 0x02 {
+			f.onSend = nil
+		}
+		if dst == byte(App) && (cmd == 0x09 || cmd == 0x0a) {
+			f.added = append(f.added, [3]byte{payload[0], payload[1], payload[2]})
+		}
+		f.mu.Unlock()
+		if hung {
+			continue
+		}
+		switch {
+		case dst == byte(OS) && cmd == 0x03: // OSChangeApp
+			f.send(&Packet{Dst: OS, Cmd: OSAck, Payload: []byte{0x01}})
+			f.announce("Co_CPU_App")
+		case dst == byte(OS) && cmd == 0x02: // OSGetFirmware
+			f.ack(0x02, 0x00, 0x00, 0x00, 0x01, 0x02, 0x01)
+		case dst == byte(OS) && cmd == 0x0b: // OSGetSerial
+			f.ack(append([]byte{0x02}, "NEQ1330980"...)...)
+		case dst == byte(App) && cmd == 0x06: // AppAddPeer
+			f.ack(0x07, 0x01, 0x01, 0x00, 0x01, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+		case dst == byte(App) && cmd == 0x02 && onSend != nil: // AppSend
+			onSend()
+		default:
+			f.ack(byte(AckOK))
+		}
+	}
+}
+
+// peersAdded returns how often addr was added.
+func (f *fakePCB) peersAdded(addr [3]byte) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var n int
+	for _, a := range f.added {
+		if a == addr {
+			n++
+		}
+	}
+	return n
+}
+
+// appSend calls u.AppSend, failing the test if it does not return.
+func appSend(t *testing.T, u *UARTGW) error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- u.AppSend([]byte{0x42}) }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatalf("AppSend did not return")
+		return nil
+	}
+}
+
+func TestWatchdogRecovery(t *testing.T) {
+	host, f := newFakePCB(t)
+	u, err := NewUARTGW(host, [3]byte{0xfd, 0xb0, 0x2c}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := [3]byte{0x39, 0x06, 0xeb}
+	if err := u.AddPeer(addr[:], 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Watchdog(200*time.Millisecond, f.reset); err != nil {
+		t.Fatal(err)
+	}
+	// The reader goroutine picks up the watchdog with the next frame.
+	if err := appSend(t, u); err != nil {
+		t.Fatal(err)
+	}
+
+	// The UARTGW wedges while AppSend waits for its acknowledgement.
+	f.mu.Lock()
+	f.hung = true
+	f.mu.Unlock()
+	if err := appSend(t, u); !errors.Is(err, bidcos.ErrGatewayReset) {
+		t.Fatalf("unexpected AppSend error: got %v, want %v", err, bidcos.ErrGatewayReset)
+	}
+
+	// Subsequent commands wait for the UARTGW to be re-initialized.
+	if err := appSend(t, u); err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	resets := f.resets
+	f.mu.Unlock()
+	if resets < 1 {
+		t.Fatalf("UARTGW not reset")
+	}
+	if got, want := f.peersAdded(addr), 1+resets; got < want {
+		t.Fatalf("peer not re-added after reset: added %d times, want >= %d", got, want)
+	}
+}
+
+func TestUnexpectedAnnouncement(t *testing.T) {
+	for _, app := range []string{"Co_CPU_BL", "Co_CPU_App"} {
+		t.Run(app, func(t *testing.T) {
+			host, f := newFakePCB(t)
+			u, err := NewUARTGW(host, [3]byte{0xfd, 0xb0, 0x2c}, time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			addr := [3]byte{0x39, 0x06, 0xeb}
+			if err := u.AddPeer(addr[:], 2); err != nil {
+				t.Fatal(err)
+			}
+
+			// The coprocessor restarts while AppSend waits for its
+			// acknowledgement.
+			f.mu.Lock()
+			f.onSend = func() { f.announce(app) }
+			f.mu.Unlock()
+			if err := appSend(t, u); !errors.Is(err, bidcos.ErrGatewayReset) {
+				t.Fatalf("unexpected AppSend error: got %v, want %v", err, bidcos.ErrGatewayReset)
+			}
+
+			// Subsequent commands wait for the UARTGW to be
+			// re-initialized.
+			if err := appSend(t, u); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := f.peersAdded(addr), 2; got != want {
+				t.Fatalf("peer not re-added: added %d times, want %d", got, want)
+			}
+
+			// Received packets are still delivered.
+			f.send(&Packet{Dst: App, Cmd: AppRecv, Payload: []byte{0x42}})
+			buf := make([]byte, 64)
+			n, err := u.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := buf[:n], []byte{0x42}; !bytes.Equal(got, want) {
+				t.Fatalf("unexpected packet: got %x, want %x", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/stapelberg/hmgo/internal/bidcos"
+	"github.com/stapelberg/hmgo/internal/hm"
+	"github.com/stapelberg/hmgo/internal/inventory"
+)
+
+// pairingWindow is open while devices which are not in the inventory
+// may pair, see handlePairing.
+type pairingWindow struct {
+	mu    sync.Mutex
+	until time.Time
+}
+
+// open opens the window until now+d.
+func (p *pairingWindow) open(now time.Time, d time.Duration) time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.until = now.Add(d)
+	return p.until
+}
+
+func (p *pairingWindow) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.until = time.Time{}
+}
+
+func (p *pairingWindow) isOpen(now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return now.Before(p.until)
+}
+
+// pairNew pairs the device with address addr, which is not in the
+// inventory and sent info, and appends it (with a placeholder name) to
+// the inventory file at path.
+func pairNew(gw gateway, bcs *bidcos.Sender, path string, addr [3]byte, info *bidcos.DeviceInfoFrame) (*inventory.Device, hm.Device, error) {
+	m := hm.ModelByID(info.Model)
+	if m == nil {
+		return nil, nil, fmt.Errorf("unsupported model %04x", info.Model)
+	}
+	name := "new-" + info.Serial
+	dev := m.New(hm.NewStandardDevice(bcs, addr, name))
+	d := &inventory.Device{
+		Serial: info.Serial,
+		Addr:   addr,
+		Name:   name,
+		// The hm device types are named like the inventory types.
+		Type: dev.HomeMaticType(),
+	}
+	if err := addPeer(gw, d, dev); err != nil {
+		return nil, nil, err
+	}
+	if err := dev.Pair(); err != nil {
+		return nil, nil, err
+	}
+	if err := inventory.Append(path, d); err != nil {
+		return nil, nil, fmt.Errorf("adding %s to the inventory: %v", info.Serial, err)
+	}
+	return d, dev, nil
+}
+
+// handlePairing opens or closes the pairing window via HTTP, e.g.:
+//
+//	curl -d duration=5m http://localhost:8012/pairing/start
+//	curl -d '' http://localhost:8012/pairing/stop
+//
+// While the window is open, devices which are not in the inventory are
+// paired when their pairing button is pressed, and added to the
+// inventory with a placeholder name. The duration defaults to 2
+// minutes.
+func handlePairing(w http.ResponseWriter, r *http.Request, p *pairingWindow) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	switch r.URL.Path {
+	case "/pairing/start":
+		d := 2 * time.Minute
+		if v := r.FormValue("duration"); v != "" {
+			var err error
+			if d, err = time.ParseDuration(v); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		until := p.open(time.Now(), d)
+		log.Printf("pairing window open until %v", until.Format(time.TimeOnly))
+		fmt.Fprintf(w, "OK, pairing until %v\n", until.Format(time.TimeOnly))
+
+	case "/pairing/stop":
+		p.close()
+		log.Printf("pairing window closed")
+		fmt.Fprintf(w, "OK")
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleUnpair unpairs a device (see hm.StandardDevice.Unpair) so that
+// it can be paired with another central, e.g.:
+//
+//	curl -d serial=MEQ0089016 -d factory_reset=true http://localhost:8012/unpair
+//
+// The device is removed from the gateway’s peer table and ignored by
+// the reconciler, but not removed from the inventory: remove it there
+// (and from the peers of other devices) before restarting hmgo, which
+// would otherwise add it again.
+func handleUnpair(w http.ResponseWriter, r *http.Request, gw gateway, lookup func(serial string) (*inventory.Device, hm.Device), ignore func(serial string, ignored bool)) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	serial := r.FormValue("serial")
+	d, dev := lookup(serial)
+	if dev == nil {
+		http.Error(w, fmt.Sprintf("serial %q not configured", serial), http.StatusNotFound)
+		return
+	}
+	var factoryReset bool
+	if v := r.FormValue("factory_reset"); v != "" {
+		var err error
+		if factoryReset, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, fmt.Sprintf("invalid factory_reset: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	log.Printf("unpairing %v (factory reset: %v)", dev, factoryReset)
+	ignore(serial, true)
+	if err := dev.Unpair(factoryReset); err != nil {
+		log.Printf("unpairing %v: %v", dev, err)
+		ignore(serial, false)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := gw.RemovePeer(d.Addr); err != nil {
+		log.Printf("removing peer %x: %v", d.Addr, err)
+		ignore(serial, false)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "OK, remove %s from the inventory\n", serial)
+}
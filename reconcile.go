@@ -0,0 +1,362 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stapelberg/hmgo/internal/hm"
+	"github.com/stapelberg/hmgo/internal/hm/heating"
+	"github.com/stapelberg/hmgo/internal/hm/thermal"
+	"github.com/stapelberg/hmgo/internal/inventory"
+)
+
+// reconcileRetry is how long the reconciler waits before trying again
+// to reach a device which failed, and the minimum interval between
+// attempts triggered by a device waking up.
+const reconcileRetry = 10 * time.Minute
+
+// reconcileState is the result of the most recent comparison of a
+// device with its desired state, shown on the status page.
+type reconcileState struct {
+	Checked time.Time // most recent attempt, zero if none yet
+	Synced  time.Time // most recent time the device was in its desired state
+
+	// Drift lists the differences which the most recent attempt found
+	// (and corrected, unless Err is set).
+	Drift []string
+	Err   error
+
+	// Asleep is set when the device did not reply (see unreachable),
+	// e.g. because it is a battery device which only listens briefly
+	// after sending an event. The reconciler tries again when the
+	// device wakes up, see reconciler.wakeup.
+	Asleep bool
+
+	// Ignored is set for unpaired devices, see reconciler.ignore.
+	Ignored bool
+
+	// overlays are the names of the overlays which were active when
+	// the device was last in its desired state.
+	overlays string
+}
+
+func (s reconcileState) String() string {
+	switch {
+	case s.Ignored:
+		return "unpaired, not reconciled"
+	case s.Checked.IsZero():
+		return "not compared with the inventory yet"
+	}
+	var drift string
+	if len(s.Drift) > 0 {
+		drift = " (drift: " + strings.Join(s.Drift, ", ") + ")"
+	}
+	if s.Err == nil {
+		return fmt.Sprintf("in sync as of %s%s", s.Checked.Format(time.DateTime), drift)
+	}
+	synced := "never"
+	if !s.Synced.IsZero() {
+		synced = s.Synced.Format(time.DateTime)
+	}
+	if s.Asleep {
+		return fmt.Sprintf("not reachable since %s (in sync: %s), retrying when it wakes up%s", s.Checked.Format(time.DateTime), synced, drift)
+	}
+	return fmt.Sprintf("error as of %s (in sync: %s): %v%s", s.Checked.Format(time.DateTime), synced, s.Err, drift)
+}
+
+// reconciler brings devices into the desired state described by the
+// inventory (config memory and peers) and keeps them there: devices
+// are compared with their desired state periodically, when the active
+// overlays change and when a device which could not be reached wakes
+// up. Differences are applied and reported per device.
+type reconciler struct {
+	inv      *inventory.Inventory
+	bySerial map[string]hm.Device // guarded by devicesMu, like inv.Devices
+
+	// interval is how often devices in sync are compared with their
+	// desired state.
+	interval time.Duration
+
+	wake chan [3]byte
+
+	// reconciling is held while a device is reconciled, so that ignore
+	// can wait for an attempt in progress.
+	reconciling sync.Mutex
+
+	mu     sync.Mutex
+	states map[string]*reconcileState // by serial
+}
+
+func newReconciler(inv *inventory.Inventory, bySerial map[string]hm.Device, interval time.Duration) *reconciler {
+	return &reconciler{
+		inv:      inv,
+		bySerial: bySerial,
+		interval: interval,
+		wake:     make(chan [3]byte, 16),
+		states:   make(map[string]*reconcileState),
+	}
+}
+
+// States returns a copy of the reconcile state of all devices, by
+// serial.
+func (r *reconciler) States() map[string]reconcileState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	states := make(map[string]reconcileState, len(r.states))
+	for serial, s := range r.states {
+		states[serial] = *s
+	}
+	return states
+}
+
+func (r *reconciler) state(serial string) *reconcileState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.states[serial]
+	if !ok {
+		s = &reconcileState{}
+		r.states[serial] = s
+	}
+	return s
+}
+
+// ignore stops (or, if ignored is false, resumes) reconciling the
+// device with serial, e.g. because it is being unpaired. When ignore
+// returns, no attempt to reconcile the device is in progress.
+func (r *reconciler) ignore(serial string, ignored bool) {
+	r.reconciling.Lock()
+	defer r.reconciling.Unlock()
+	s := r.state(serial)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s.Ignored = ignored
+}
+
+// ignored returns whether the device with serial is not reconciled,
+// see ignore.
+func (r *reconciler) ignored(serial string) bool {
+	return r.States()[serial].Ignored
+}
+
+// wakeup notes that the device with address addr sent a packet. It
+// does not block.
+func (r *reconciler) wakeup(addr [3]byte) {
+	select {
+	case r.wake <- addr:
+	default:
+	}
+}
+
+// devices returns the inventory devices with their hm.Device.
+func (r *reconciler) devices() ([]*inventory.Device, map[string]hm.Device) {
+	devicesMu.Lock()
+	defer devicesMu.Unlock()
+	devs := make(map[string]hm.Device, len(r.bySerial))
+	for serial, dev := range r.bySerial {
+		devs[serial] = dev
+	}
+	return append([]*inventory.Device(nil), r.inv.Devices...), devs
+}
+
+// run compares all devices with their desired state, then keeps doing
+// so whenever they are due. It never returns.
+func (r *reconciler) run() {
+	r.reconcileAll(time.Now())
+	t := time.NewTicker(1 * time.Minute)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			now := time.Now()
+			devs, bySerial := r.devices()
+			for _, d := range devs {
+				if r.due(d, now) {
+					r.reconcile(d, bySerial, now)
+				}
+			}
+
+		case addr := <-r.wake:
+			r.woke(addr, time.Now())
+		}
+	}
+}
+
+// reconcileAll compares all devices with their desired state.
+func (r *reconciler) reconcileAll(now time.Time) {
+	devs, bySerial := r.devices()
+	for _, d := range devs {
+		r.reconcile(d, bySerial, now)
+	}
+}
+
+// woke reconciles the device with address addr, which just sent a
+// packet, if the previous attempt failed.
+func (r *reconciler) woke(addr [3]byte, now time.Time) {
+	devs, bySerial := r.devices()
+	for _, d := range devs {
+		if d.Addr != addr {
+			continue
+		}
+		s := r.States()[d.Serial]
+		if s.Ignored || s.Err == nil || now.Sub(s.Checked) < reconcileRetry {
+			return
+		}
+		log.Printf("%s woke up, reconciling", d.Name)
+		r.reconcile(d, bySerial, now)
+		return
+	}
+}
+
+// due returns whether d needs to be compared with its desired state.
+func (r *reconciler) due(d *inventory.Device, now time.Time) bool {
+	s, ok := r.States()[d.Serial]
+	switch {
+	case !ok:
+		return true // e.g. paired after startup
+	case s.Ignored:
+		return false
+	case now.Sub(s.Checked) >= r.interval:
+		return true
+	case s.Asleep:
+		return false // see woke
+	case s.Err != nil:
+		return now.Sub(s.Checked) >= reconcileRetry
+	}
+	// Re-write the programs of thermal devices whose active overlays
+	// changed since they were last written, e.g. when winter starts.
+	if d.Type == inventory.Thermal && len(d.Overlays) > 0 {
+		_, active := thermal.ApplyOverlays(d.Programs, r.inv.OverlaysFor(d), now)
+		return strings.Join(active, ",") != s.overlays
+	}
+	return false
+}
+
+// reconcile brings d into its desired state and records the result.
+func (r *reconciler) reconcile(d *inventory.Device, bySerial map[string]hm.Device, now time.Time) {
+	r.reconciling.Lock()
+	defer r.reconciling.Unlock()
+	if r.ignored(d.Serial) {
+		return
+	}
+	dev := bySerial[d.Serial]
+	drift, overlays, err := reconcileDevice(r.inv, d, dev, bySerial, now)
+	if err != nil {
+		log.Printf("reconciling %v: %v", dev, err)
+	}
+	s := r.state(d.Serial)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s.Checked = now
+	s.Drift = drift
+	s.Err = err
+	s.Asleep = err != nil && unreachable(err)
+	if err == nil {
+		s.Synced = now
+		s.overlays = overlays
+	}
+}
+
+// thermalConfig returns a function which modifies the device memory of
+// the thermal device d into its desired state: the heating programs
+// and valve offset.
+func thermalConfig(tc *thermal.ThermalControl, d *inventory.Device, programs []thermal.Program) func(mem []byte) error {
+	return func(mem []byte) error {
+		if d.ValveOffset != nil {
+			const valveOffsetOffset = 11
+			const valveMaxOffset = 12
+			log.Printf("valve offset: %d", mem[valveOffsetOffset])
+			mem[valveOffsetOffset] = byte(*d.ValveOffset) & hm.Mask7Bit
+			log.Printf("valve max: %d", mem[valveMaxOffset])
+		}
+		if programs != nil {
+			tc.SetPrograms(mem, programs)
+		}
+		return nil
+	}
+}
+
+// desiredPeers returns the channel of dev which is peered with the
+// devices listed in its inventory entry d, and the channels of those
+// devices.
+func desiredPeers(d *inventory.Device, dev hm.Device, bySerial map[string]hm.Device) (byte, []hm.FullyQualifiedChannel) {
+	var dests []hm.FullyQualifiedChannel
+	switch dev.(type) {
+	case *thermal.ThermalControl:
+		for _, serial := range d.Peers {
+			dests = append(dests, hm.FullyQualifiedChannel{
+				Peer:    bySerial[serial].(*heating.Thermostat).Addr,
+				Channel: heating.ClimateControlReceiver,
+			})
+		}
+		return thermal.ThermalControlTransmit, dests
+
+	case *heating.Thermostat:
+		for _, serial := range d.Peers {
+			dests = append(dests, hm.FullyQualifiedChannel{
+				Peer:    bySerial[serial].(*thermal.ThermalControl).Addr,
+				Channel: thermal.ThermalControlTransmit,
+			})
+		}
+		return heating.ClimateControlReceiver, dests
+	}
+	// inventory.Parse rejects peers for other types
+	panic(fmt.Sprintf("BUG: peers for device type %q", d.Type))
+}
+
+// reconcileDevice brings dev into the desired state of its inventory
+// entry d: thermal devices get their programs (with the overlays
+// active at now applied) and valve offset, and devices are peered with
+// exactly the devices which d lists. It returns the differences it
+// found and the names of the active overlays.
+func reconcileDevice(inv *inventory.Inventory, d *inventory.Device, dev hm.Device, bySerial map[string]hm.Device, now time.Time) (drift []string, overlays string, _ error) {
+	if tc, ok := dev.(*thermal.ThermalControl); ok && (d.Programs != nil || d.ValveOffset != nil) {
+		programs, active := thermal.ApplyOverlays(d.Programs, inv.OverlaysFor(d), now)
+		log.Printf("reading program configuration of %v (active overlays: %v)", tc, active)
+		pairs, err := tc.ConfigDiff(0 /* channel */, 7 /* plist */, thermalConfig(tc, d, programs))
+		if err != nil {
+			return drift, "", err
+		}
+		if len(pairs) > 0 {
+			drift = append(drift, fmt.Sprintf("%d registers of paramlist 7", len(pairs)/2))
+			if err := tc.WriteConfig(0, 7, pairs); err != nil {
+				return drift, "", err
+			}
+		}
+		overlays = strings.Join(active, ",")
+	}
+
+	if len(d.Peers) > 0 {
+		sd := standardDevice(dev)
+		channel, dests := desiredPeers(d, dev, bySerial)
+		log.Printf("ensuring %v is peered with %v", dev, d.Peers)
+		remove, add, err := sd.PeerDiff(channel, dests...)
+		if err != nil {
+			return drift, "", err
+		}
+		for _, p := range remove {
+			drift = append(drift, fmt.Sprintf("unexpected peer %x:%d", p.Peer, p.Channel))
+		}
+		for _, p := range add {
+			drift = append(drift, fmt.Sprintf("missing peer %x:%d", p.Peer, p.Channel))
+		}
+		if err := sd.UpdatePeers(channel, remove, add); err != nil {
+			return drift, "", err
+		}
+	}
+
+	return drift, overlays, nil
+}
+
+// standardDevice returns the hm.StandardDevice of dev.
+func standardDevice(dev hm.Device) *hm.StandardDevice {
+	switch dev := dev.(type) {
+	case *thermal.ThermalControl:
+		return &dev.StandardDevice
+	case *heating.Thermostat:
+		return &dev.StandardDevice
+	}
+	panic(fmt.Sprintf("BUG: unexpected device %T", dev))
+}
@@ -20,6 +20,7 @@ const statusTmplContents = `
 <td>{{ $serial }}</td>
 <td>
 {{ $dev }}<br>
+{{ with index $.Reconcile $serial }}<small>config: {{ .String }}</small><br>{{ end }}
 {{ range $idx, $event := $dev.MostRecentEvents }}
 <ul>
 {{ $event.HTML }}
@@ -33,13 +34,15 @@ const statusTmplContents = `
 
 var statusTmpl = template.Must(template.New("status").Parse(statusTmplContents))
 
-func handleStatus(w http.ResponseWriter, r *http.Request, devs map[string]hm.Device) {
+func handleStatus(w http.ResponseWriter, r *http.Request, devs map[string]hm.Device, states map[string]reconcileState) {
 	var buf bytes.Buffer
 
 	if err := statusTmpl.Execute(&buf, struct {
-		Devices map[string]hm.Device
+		Devices   map[string]hm.Device
+		Reconcile map[string]reconcileState
 	}{
-		Devices: devs,
+		Devices:   devs,
+		Reconcile: states,
 	}); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return